@@ -4,10 +4,15 @@ package application
 import (
 	"html/template"
 	"log"
+	"time"
 
 	"github.com/BrianHarringtonUTSC/uTeach/config"
 	"github.com/BrianHarringtonUTSC/uTeach/libtemplate"
-	"github.com/gorilla/sessions"
+	"github.com/BrianHarringtonUTSC/uTeach/lti"
+	"github.com/BrianHarringtonUTSC/uTeach/ratelimit"
+	"github.com/BrianHarringtonUTSC/uTeach/scheduler"
+	"github.com/BrianHarringtonUTSC/uTeach/session"
+	"github.com/BrianHarringtonUTSC/uTeach/storage"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3" // blank identifier import registers the sqlite driver
 )
@@ -16,8 +21,12 @@ import (
 type App struct {
 	Config    *config.Config
 	DB        *sqlx.DB
-	Store     sessions.Store
+	Store     *session.DBStore
 	Templates map[string]*template.Template
+	Storage   storage.Storage
+	LTI       *lti.Tool
+	Limiter   *ratelimit.Limiter
+	Scheduler *scheduler.Scheduler
 }
 
 // New creates a new App based on the config. Exits if an error is encountered.
@@ -25,12 +34,32 @@ func New(conf config.Config) *App {
 	db := sqlx.MustOpen("sqlite3", conf.DBPath)
 	db.MustExec("PRAGMA foreign_keys=ON;")
 
-	store := sessions.NewCookieStore(conf.CookieAuthenticationKey, conf.CookieEncryptionKey)
+	store := session.NewDBStore(db, conf.SessionIdleTimeout, conf.SessionAbsoluteTimeout,
+		conf.CookieAuthenticationKey, conf.CookieEncryptionKey)
 
 	templates, err := libtemplate.Load(conf.TemplatesPath)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	return &App{&conf, db, store, templates}
+	var fileStorage storage.Storage
+	if conf.S3 != nil {
+		fileStorage, err = storage.NewS3(*conf.S3)
+	} else {
+		fileStorage, err = storage.NewLocal(conf.UploadsPath)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ltiTool, err := lti.NewTool(conf.LTIPlatforms, conf.LTIPrivateKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// expired sessions are deleted while the app runs rather than only at startup
+	sched := scheduler.New(db, time.Minute)
+	sched.OnTick(store.DeleteExpired)
+
+	return &App{&conf, db, store, templates, fileStorage, ltiTool, ratelimit.New(), sched}
 }
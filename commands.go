@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/BrianHarringtonUTSC/uTeach/application"
+	"github.com/BrianHarringtonUTSC/uTeach/models"
+	"github.com/Masterminds/squirrel"
+	"github.com/pkg/errors"
+)
+
+// commands are the commands that can be run instead of serving, by name.
+var commands = map[string]func(app *application.App, args []string) error{
+	"clone-topic": cloneTopic,
+}
+
+// runCommand runs the command named by the first of args with the rest of args.
+func runCommand(app *application.App, args []string) error {
+	command, ok := commands[args[0]]
+	if !ok {
+		return errors.Errorf("unknown command %q", args[0])
+	}
+	return command(app, args[1:])
+}
+
+// cloneTopic clones a topic into a new topic in one transaction, e.g. for a new semester. The usage is
+// clone-topic [--title=TITLE] [--posts=ID,ID] [--roles] SOURCE_NAME NEW_NAME.
+func cloneTopic(app *application.App, args []string) (err error) {
+	flags := flag.NewFlagSet("clone-topic", flag.ContinueOnError)
+	title := flags.String("title", "", "Title of the new topic, the source topic's title by default.")
+	posts := flags.String("posts", "", "Comma separated ids of the source topic's pinned posts to copy, e.g. the syllabus.")
+	roles := flags.Bool("roles", false, "Copy the source topic's role assignments.")
+	if err = flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return errors.New("usage: clone-topic [--title=TITLE] [--posts=ID,ID] [--roles] SOURCE_NAME NEW_NAME")
+	}
+
+	var postIDs []int64
+	for _, value := range strings.Split(*posts, ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		postID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.Wrap(err, "invalid post id")
+		}
+		postIDs = append(postIDs, postID)
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	tm := models.NewTopicModel(app.DB)
+	source, err := tm.FindOne(tx, squirrel.Eq{"topics.name": strings.ToLower(flags.Arg(0))})
+	if err != nil {
+		return errors.Wrap(err, "find source topic error")
+	}
+
+	clone := &models.Topic{Name: flags.Arg(1), Title: *title, Description: source.Description}
+	if clone.Title == "" {
+		clone.Title = source.Title
+	}
+	if err = tm.Clone(tx, source, clone, postIDs, *roles); err != nil {
+		return errors.Wrap(err, "clone error")
+	}
+
+	alm := models.NewAuditLogModel(app.DB)
+	entry := &models.AuditEntry{Action: models.AuditActionCloneTopic, Topic: clone,
+		TargetType: models.AuditTargetTopic, TargetID: clone.ID, Details: source.Name + " to " + clone.Name}
+	if err = alm.Add(tx, entry); err != nil {
+		return errors.Wrap(err, "add audit entry error")
+	}
+
+	fmt.Printf("Cloned %s to %s\n", source.Name, clone.URL())
+	return nil
+}
@@ -2,9 +2,19 @@
 package config
 
 import (
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
 	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/BrianHarringtonUTSC/uTeach/lti"
+	"github.com/BrianHarringtonUTSC/uTeach/ratelimit"
+	"github.com/BrianHarringtonUTSC/uTeach/storage"
+	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 	"golang.org/x/oauth2"
 )
@@ -17,6 +27,10 @@ const (
 	authURL     = base + "/authorize"
 	tokenURL    = base + "/oauth/token"
 	userInfoURL = base + "/userinfo"
+
+	// session timeouts used when a config file from before they could be set leaves them out
+	defaultSessionIdleTimeoutHours     = 24 * 7
+	defaultSessionAbsoluteTimeoutHours = 24 * 30
 )
 
 // Config stores context information required to run the app.
@@ -25,23 +39,93 @@ type Config struct {
 	DBPath                  string
 	TemplatesPath           string
 	StaticFilesPath         string
+	UploadsPath             string
+	S3                      *storage.S3Config // uploads are stored in S3 instead of UploadsPath if set
+	MaxAttachmentSize       int64             // in bytes, attachments are disabled if 0
+	AttachmentQuota         int64             // in bytes per user, unlimited if 0
 	CookieAuthenticationKey []byte
 	CookieEncryptionKey     []byte
+	SessionIdleTimeout      time.Duration
+	SessionAbsoluteTimeout  time.Duration
 	OAuth2                  *oauth2.Config
 	OAuth2UserInfoURL       string
+	LTIToolURL              string
+	LTIPrivateKey           *rsa.PrivateKey
+	LTIPlatforms            []lti.Platform
+	AllowedEmailDomains     []string
+	AdminEmails             []string
+	ReportAutoHideThreshold int
+	RateLimits              map[string]RateLimitClass
+	NewAccountAge           time.Duration
+}
+
+// RateLimitClass has the limits for a class of routes (e.g. voting). Users are limited by their account and everyone
+// is limited by their IP address. Accounts newer than NewAccountAge get the NewUser limit instead of the User limit.
+type RateLimitClass struct {
+	User    ratelimit.Limit
+	NewUser ratelimit.Limit
+	IP      ratelimit.Limit
 }
 
 // preprocessedConfig is created using env variables and config files and should be used to create the final "Config" above.
 type preprocessedConfig struct {
-	HTTPAddress                   string `mapstructure:"http_address"`
-	DBPath                        string `mapstructure:"db_path"`
-	TemplatesPath                 string `mapstructure:"templates_path"`
-	StaticFilesPath               string `mapstructure:"static_files_path"`
-	CookieAuthenticationKeyBase64 string `mapstructure:"cookie_authentication_key_base64"` // must be a base64 encoded string of a 64 byte array
-	CookieEncryptionKeyBase64     string `mapstructure:"cookie_encryption_key_base64"`     // must be a base64 encoded string of a 32 byte array
-	OAuth2ClientID                string `mapstructure:"oauth2_client_id"`
-	OAuth2ClientSecret            string `mapstructure:"oauth2_client_secret"`
-	OAuth2RedirectURL             string `mapstructure:"oauth2_redirect_url"`
+	HTTPAddress                   string                                `mapstructure:"http_address"`
+	DBPath                        string                                `mapstructure:"db_path"`
+	TemplatesPath                 string                                `mapstructure:"templates_path"`
+	StaticFilesPath               string                                `mapstructure:"static_files_path"`
+	UploadsPath                   string                                `mapstructure:"uploads_path"` // directory where uploaded files (e.g. avatars) are stored
+	S3Endpoint                    string                                `mapstructure:"s3_endpoint"`  // uploads are stored in this S3 compatible service instead of uploads_path if set
+	S3Region                      string                                `mapstructure:"s3_region"`
+	S3Bucket                      string                                `mapstructure:"s3_bucket"`
+	S3AccessKeyID                 string                                `mapstructure:"s3_access_key_id"`
+	S3SecretAccessKey             string                                `mapstructure:"s3_secret_access_key"`
+	MaxAttachmentSizeMB           int                                   `mapstructure:"max_attachment_size_mb"`           // largest file that can be attached to a post, 0 disables attachments
+	AttachmentQuotaMB             int                                   `mapstructure:"attachment_quota_mb"`              // total size of the files each user can attach, 0 is unlimited
+	CookieAuthenticationKeyBase64 string                                `mapstructure:"cookie_authentication_key_base64"` // must be a base64 encoded string of a 64 byte array
+	CookieEncryptionKeyBase64     string                                `mapstructure:"cookie_encryption_key_base64"`     // must be a base64 encoded string of a 32 byte array
+	SessionIdleTimeoutHours       int                                   `mapstructure:"session_idle_timeout_hours"`       // sessions expire after this long without a request, 168 if unset
+	SessionAbsoluteTimeoutHours   int                                   `mapstructure:"session_absolute_timeout_hours"`   // sessions expire this long after login regardless of use, 720 if unset
+	OAuth2ClientID                string                                `mapstructure:"oauth2_client_id"`
+	OAuth2ClientSecret            string                                `mapstructure:"oauth2_client_secret"`
+	OAuth2RedirectURL             string                                `mapstructure:"oauth2_redirect_url"`
+	LTIToolURL                    string                                `mapstructure:"lti_tool_url"`               // base URL platforms launch the app at, e.g. https://uteach.example.com
+	LTIPrivateKeyPath             string                                `mapstructure:"lti_private_key_path"`       // PEM encoded RSA key the app signs LTI messages with
+	LTIPlatforms                  []preprocessedLTIPlatform             `mapstructure:"lti_platforms"`              // LMSs allowed to launch the app, LTI is disabled if empty
+	AllowedEmailDomains           []string                              `mapstructure:"allowed_email_domains"`      // only emails at these exact domains can sign up, anyone can if empty
+	AdminEmails                   []string                              `mapstructure:"admin_emails"`               // users with these emails are made admins when they log in
+	ReportAutoHideThreshold       int                                   `mapstructure:"report_auto_hide_threshold"` // posts reported by this many users are hidden until reviewed, 0 disables
+	RateLimits                    map[string]preprocessedRateLimitClass `mapstructure:"rate_limits"`                // limits for each class of routes (post, vote, report), unlimited if missing
+	NewAccountDays                int                                   `mapstructure:"new_account_days"`           // accounts created within this many days get the new_user rate limits
+}
+
+// preprocessedRateLimitClass is the limits for a class of routes in the config. See RateLimitClass.
+type preprocessedRateLimitClass struct {
+	User    preprocessedRateLimit `mapstructure:"user"`
+	NewUser preprocessedRateLimit `mapstructure:"new_user"`
+	IP      preprocessedRateLimit `mapstructure:"ip"`
+}
+
+// preprocessedRateLimit is a token bucket in the config. See ratelimit.Limit.
+type preprocessedRateLimit struct {
+	PerMinute float64 `mapstructure:"per_minute"`
+	Burst     int     `mapstructure:"burst"`
+}
+
+// limit validates the rate limit and converts it to a ratelimit.Limit.
+func (p preprocessedRateLimit) limit() (ratelimit.Limit, error) {
+	if p.PerMinute < 0 || (p.PerMinute > 0 && p.Burst < 1) {
+		return ratelimit.Limit{}, errors.New("rate limits must have a positive per_minute and burst or a per_minute of 0")
+	}
+	return ratelimit.Limit{PerMinute: p.PerMinute, Burst: p.Burst}, nil
+}
+
+// preprocessedLTIPlatform is an LMS registered with the app in the config. See lti.Platform.
+type preprocessedLTIPlatform struct {
+	Issuer        string   `mapstructure:"issuer"`
+	ClientID      string   `mapstructure:"client_id"`
+	DeploymentIDs []string `mapstructure:"deployment_ids"`
+	AuthLoginURL  string   `mapstructure:"auth_login_url"`
+	JWKSURL       string   `mapstructure:"jwks_url"`
 }
 
 // Load loads the config file at path and environment variables into a Config.
@@ -67,6 +151,23 @@ func Load(path string) (*Config, error) {
 	conf.DBPath = joinIfNotAbs(dir, preprocessed.DBPath)
 	conf.TemplatesPath = joinIfNotAbs(dir, preprocessed.TemplatesPath)
 	conf.StaticFilesPath = joinIfNotAbs(dir, preprocessed.StaticFilesPath)
+	conf.UploadsPath = joinIfNotAbs(dir, preprocessed.UploadsPath)
+
+	if preprocessed.S3Endpoint != "" {
+		conf.S3 = &storage.S3Config{
+			Endpoint:        preprocessed.S3Endpoint,
+			Region:          preprocessed.S3Region,
+			Bucket:          preprocessed.S3Bucket,
+			AccessKeyID:     preprocessed.S3AccessKeyID,
+			SecretAccessKey: preprocessed.S3SecretAccessKey,
+		}
+	}
+
+	if preprocessed.MaxAttachmentSizeMB < 0 || preprocessed.AttachmentQuotaMB < 0 {
+		return nil, errors.New("attachment size and quota must not be negative")
+	}
+	conf.MaxAttachmentSize = int64(preprocessed.MaxAttachmentSizeMB) << 20
+	conf.AttachmentQuota = int64(preprocessed.AttachmentQuotaMB) << 20
 
 	var err error
 	conf.CookieAuthenticationKey, err = base64.StdEncoding.DecodeString(preprocessed.CookieAuthenticationKeyBase64)
@@ -79,6 +180,18 @@ func Load(path string) (*Config, error) {
 		return nil, err
 	}
 
+	if preprocessed.SessionIdleTimeoutHours == 0 {
+		preprocessed.SessionIdleTimeoutHours = defaultSessionIdleTimeoutHours
+	}
+	if preprocessed.SessionAbsoluteTimeoutHours == 0 {
+		preprocessed.SessionAbsoluteTimeoutHours = defaultSessionAbsoluteTimeoutHours
+	}
+	if preprocessed.SessionIdleTimeoutHours < 0 || preprocessed.SessionAbsoluteTimeoutHours < 0 {
+		return nil, errors.New("session timeouts must be positive")
+	}
+	conf.SessionIdleTimeout = time.Duration(preprocessed.SessionIdleTimeoutHours) * time.Hour
+	conf.SessionAbsoluteTimeout = time.Duration(preprocessed.SessionAbsoluteTimeoutHours) * time.Hour
+
 	oauth2Config := &oauth2.Config{
 		ClientID:     preprocessed.OAuth2ClientID,
 		ClientSecret: preprocessed.OAuth2ClientSecret,
@@ -93,9 +206,142 @@ func Load(path string) (*Config, error) {
 	conf.OAuth2 = oauth2Config
 	conf.OAuth2UserInfoURL = userInfoURL
 
+	if len(preprocessed.LTIPlatforms) > 0 {
+		if preprocessed.LTIToolURL == "" || preprocessed.LTIPrivateKeyPath == "" {
+			return nil, errors.New("lti_tool_url and lti_private_key_path are required when there are lti_platforms")
+		}
+
+		conf.LTIPrivateKey, err = loadRSAPrivateKey(joinIfNotAbs(dir, preprocessed.LTIPrivateKeyPath))
+		if err != nil {
+			return nil, errors.Wrap(err, "load lti private key error")
+		}
+	}
+
+	conf.LTIToolURL = strings.TrimRight(preprocessed.LTIToolURL, "/")
+	for _, p := range preprocessed.LTIPlatforms {
+		if p.Issuer == "" || p.ClientID == "" || p.AuthLoginURL == "" || p.JWKSURL == "" {
+			return nil, errors.New("lti platforms must have an issuer, client_id, auth_login_url and jwks_url")
+		}
+		conf.LTIPlatforms = append(conf.LTIPlatforms, lti.Platform{
+			Issuer:        p.Issuer,
+			ClientID:      p.ClientID,
+			DeploymentIDs: p.DeploymentIDs,
+			AuthLoginURL:  p.AuthLoginURL,
+			JWKSURL:       p.JWKSURL,
+		})
+	}
+
+	for _, domain := range preprocessed.AllowedEmailDomains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" || strings.Contains(domain, "@") {
+			return nil, errors.Errorf("invalid allowed email domain %q", domain)
+		}
+		conf.AllowedEmailDomains = append(conf.AllowedEmailDomains, domain)
+	}
+
+	for _, email := range preprocessed.AdminEmails {
+		email = strings.ToLower(strings.TrimSpace(email))
+		if emailDomain(email) == "" {
+			return nil, errors.Errorf("invalid admin email %q", email)
+		}
+		if !conf.IsEmailAllowed(email) {
+			return nil, errors.Errorf("admin email %q is not in an allowed email domain", email)
+		}
+		conf.AdminEmails = append(conf.AdminEmails, email)
+	}
+
+	if preprocessed.ReportAutoHideThreshold < 0 {
+		return nil, errors.New("report auto hide threshold must not be negative")
+	}
+	conf.ReportAutoHideThreshold = preprocessed.ReportAutoHideThreshold
+
+	conf.RateLimits = make(map[string]RateLimitClass)
+	for class, p := range preprocessed.RateLimits {
+		var c RateLimitClass
+		if c.User, err = p.User.limit(); err != nil {
+			return nil, errors.Wrapf(err, "%s user rate limit error", class)
+		}
+		if c.NewUser, err = p.NewUser.limit(); err != nil {
+			return nil, errors.Wrapf(err, "%s new user rate limit error", class)
+		}
+		if c.IP, err = p.IP.limit(); err != nil {
+			return nil, errors.Wrapf(err, "%s ip rate limit error", class)
+		}
+		conf.RateLimits[class] = c
+	}
+
+	if preprocessed.NewAccountDays < 0 {
+		return nil, errors.New("new account days must not be negative")
+	}
+	conf.NewAccountAge = time.Duration(preprocessed.NewAccountDays) * 24 * time.Hour
+
 	return conf, nil
 }
 
+// IsEmailAllowed returns true if a user with the email may sign up.
+func (c *Config) IsEmailAllowed(email string) bool {
+	if len(c.AllowedEmailDomains) == 0 {
+		return true
+	}
+
+	domain := emailDomain(strings.ToLower(email))
+	for _, allowed := range c.AllowedEmailDomains {
+		if domain == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdminEmail returns true if a user with the email should be made an admin.
+func (c *Config) IsAdminEmail(email string) bool {
+	email = strings.ToLower(email)
+	for _, adminEmail := range c.AdminEmails {
+		if email == adminEmail {
+			return true
+		}
+	}
+	return false
+}
+
+// emailDomain returns the part of the email after the @, or an empty string if the email is not valid.
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 1 {
+		return ""
+	}
+	return email[at+1:]
+}
+
+// loadRSAPrivateKey reads a PEM encoded RSA private key in either PKCS #1 or PKCS #8 form (as generated by
+// "openssl genrsa" and "openssl genpkey" respectively).
+func loadRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read file error")
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse error")
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("key is not an RSA key")
+	}
+	return key, nil
+}
+
 func joinIfNotAbs(base string, path string) string {
 	if !filepath.IsAbs(path) {
 		path = filepath.Join(base, path)
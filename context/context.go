@@ -11,11 +11,14 @@ import (
 // TODO: Use context in standard lib which will be added in go 1.7
 
 const (
-	templateDataKey = "template-data"
-	topicKey        = "topic"
-	postKey         = "post"
-	tagKey          = "tag"
-	sessionUserKey  = "session-user"
+	templateDataKey    = "template-data"
+	topicKey           = "topic"
+	postKey            = "post"
+	tagKey             = "tag"
+	sessionUserKey     = "session-user"
+	realSessionUserKey = "real-session-user"
+	impersonationKey   = "impersonation"
+	topicRoleKey       = "topic-role"
 )
 
 // SetTemplateData sets the template data map in the context.
@@ -63,8 +66,44 @@ func SetSessionUser(r *http.Request, user *models.User) {
 	context.Set(r, sessionUserKey, user)
 }
 
-// SessionUser gets the session user from the context.
+// SessionUser gets the session user from the context. If an admin is impersonating another user, this is the
+// impersonated user.
 func SessionUser(r *http.Request) (*models.User, bool) {
 	user, ok := context.Get(r, sessionUserKey).(*models.User)
 	return user, ok
 }
+
+// SetImpersonation sets the active impersonation in the context.
+func SetImpersonation(r *http.Request, impersonation *models.Impersonation) {
+	context.Set(r, impersonationKey, impersonation)
+}
+
+// Impersonation gets the active impersonation from the context.
+func Impersonation(r *http.Request) (*models.Impersonation, bool) {
+	impersonation, ok := context.Get(r, impersonationKey).(*models.Impersonation)
+	return impersonation, ok
+}
+
+// SetRealSessionUser sets the user that is actually logged in the context. This only differs from the session user if
+// an admin is impersonating another user.
+func SetRealSessionUser(r *http.Request, user *models.User) {
+	context.Set(r, realSessionUserKey, user)
+}
+
+// RealSessionUser gets the user that is actually logged in from the context.
+func RealSessionUser(r *http.Request) (*models.User, bool) {
+	user, ok := context.Get(r, realSessionUserKey).(*models.User)
+	return user, ok
+}
+
+// SetTopicRole sets the session user's role in the topic in the context.
+func SetTopicRole(r *http.Request, topicRole *models.TopicRole) {
+	context.Set(r, topicRoleKey, topicRole)
+}
+
+// TopicRole gets the session user's role in the topic from the context.
+// The second return value is a boolean which is true if the user has a role in the topic, else false.
+func TopicRole(r *http.Request) (*models.TopicRole, bool) {
+	topicRole, ok := context.Get(r, topicRoleKey).(*models.TopicRole)
+	return topicRole, ok
+}
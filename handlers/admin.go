@@ -0,0 +1,15 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/BrianHarringtonUTSC/uTeach/application"
+	"github.com/BrianHarringtonUTSC/uTeach/context"
+	"github.com/BrianHarringtonUTSC/uTeach/libtemplate"
+	"github.com/pkg/errors"
+)
+
+func getAdmin(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	err := libtemplate.Render(w, a.Templates, "admin.html", context.TemplateData(r))
+	return errors.Wrap(err, "render template error")
+}
@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/BrianHarringtonUTSC/uTeach/application"
+	"github.com/BrianHarringtonUTSC/uTeach/context"
+	"github.com/BrianHarringtonUTSC/uTeach/httperror"
+	"github.com/BrianHarringtonUTSC/uTeach/models"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// newPostApproval returns the approval state of a new post by the session user in the topic in the context. Posts by
+// users with fewer approved posts in the topic than its approve_first_posts setting are pending. Moderators never need
+// approval.
+func newPostApproval(tx *sqlx.Tx, a *application.App, r *http.Request) (string, error) {
+	topic := context.Topic(r)
+	user, _ := context.SessionUser(r)
+	if topic.ApproveFirstPosts == 0 || user.IsAdmin {
+		return "", nil
+	}
+
+	if topicRole, ok := context.TopicRole(r); ok && topicRole.IsModerator() {
+		return "", nil
+	}
+
+	pm := models.NewPostModel(a.DB)
+	count, err := pm.CountApproved(tx, topic, user)
+	if err != nil {
+		return "", errors.Wrap(err, "count approved error")
+	}
+
+	if count < topic.ApproveFirstPosts {
+		return models.PostApprovalPending, nil
+	}
+	return "", nil
+}
+
+func postApprovePost(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	return decidePostApproval(a, w, r, models.PostApprovalApproved)
+}
+
+func postRejectPost(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	return decidePostApproval(a, w, r, models.PostApprovalRejected)
+}
+
+// decidePostApproval approves or rejects a pending post, records it in the audit log and notifies the author. Approved
+// posts are shown and rejected posts stay hidden.
+func decidePostApproval(a *application.App, w http.ResponseWriter, r *http.Request, approval string) (err error) {
+	post := context.Post(r)
+	moderator, _ := context.SessionUser(r)
+	if !post.IsPending() {
+		return httperror.StatusError{http.StatusBadRequest, errors.New("This post is not waiting for approval")}
+	}
+
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	pm := models.NewPostModel(a.DB)
+	post.Approval = approval
+	post.IsVisible, post.HiddenBy = approval == models.PostApprovalApproved, models.PostHiddenByModerator
+	if err = pm.Update(tx, post); err != nil {
+		return errors.Wrap(err, "update error")
+	}
+
+	action := models.AuditActionApprovePost
+	if approval == models.PostApprovalRejected {
+		action = models.AuditActionRejectPost
+	}
+
+	alm := models.NewAuditLogModel(a.DB)
+	entry := &models.AuditEntry{Actor: moderator, Action: action, Topic: post.Topic,
+		TargetType: models.AuditTargetPost, TargetID: post.ID, Details: post.Title}
+	if err = alm.Add(tx, entry); err != nil {
+		return errors.Wrap(err, "add audit entry error")
+	}
+
+	nm := models.NewNotificationModel(a.DB)
+	notification := &models.Notification{UserID: post.Creator.ID, URL: post.URL(),
+		Message: "Your post \"" + post.Title + "\" in " + post.Topic.Name + " was " + approval + " by a moderator."}
+	if err = nm.Add(tx, notification); err != nil {
+		return errors.Wrap(err, "add notification error")
+	}
+
+	http.Redirect(w, r, "/moderation", http.StatusFound)
+	return nil
+}
+
+// postTopicApproval sets how many posts a user needs approved in the topic before they can post freely. 0 turns
+// approvals off.
+func postTopicApproval(a *application.App, w http.ResponseWriter, r *http.Request) (err error) {
+	topic := context.Topic(r)
+	moderator, _ := context.SessionUser(r)
+
+	approveFirstPosts, err := strconv.Atoi(r.FormValue("approve_first_posts"))
+	if err != nil || approveFirstPosts < 0 {
+		return httperror.StatusError{http.StatusBadRequest, errors.New("The number of posts to approve must be 0 or more")}
+	}
+
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	tm := models.NewTopicModel(a.DB)
+	topic.ApproveFirstPosts = approveFirstPosts
+	if err = tm.Update(tx, topic); err != nil {
+		return errors.Wrap(err, "update error")
+	}
+
+	alm := models.NewAuditLogModel(a.DB)
+	entry := &models.AuditEntry{Actor: moderator, Action: models.AuditActionUpdateTopic, Topic: topic,
+		TargetType: models.AuditTargetTopic, TargetID: topic.ID,
+		Details: "approve first " + strconv.Itoa(approveFirstPosts) + " posts"}
+	if err = alm.Add(tx, entry); err != nil {
+		return errors.Wrap(err, "add audit entry error")
+	}
+
+	http.Redirect(w, r, "/moderation", http.StatusFound)
+	return nil
+}
@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/BrianHarringtonUTSC/uTeach/application"
+	"github.com/BrianHarringtonUTSC/uTeach/context"
+	"github.com/BrianHarringtonUTSC/uTeach/httperror"
+	"github.com/BrianHarringtonUTSC/uTeach/models"
+	"github.com/Masterminds/squirrel"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+const (
+	// attachmentsFormField is the name of the file input posts are attached to with.
+	attachmentsFormField = "attachments"
+
+	// maxAttachmentsPerUpload is the most files that can be attached at once, which limits the size of the request.
+	maxAttachmentsPerUpload = 5
+
+	// maxPostFormSize is the size the rest of a post form can take up besides its attachments.
+	maxPostFormSize = 1 << 20 // 1 MB
+
+	// attachmentFormMemory is how much of a multipart form is kept in memory, the rest is stored in temporary files.
+	attachmentFormMemory = 8 << 20 // 8 MB
+)
+
+// addAttachmentLimitsToData adds the limits of attachments to the data so forms can show them. Nothing is added if
+// attachments are disabled.
+func addAttachmentLimitsToData(a *application.App, data map[string]interface{}) {
+	if a.Config.MaxAttachmentSize > 0 {
+		data["MaxAttachmentSize"] = models.HumanSize(a.Config.MaxAttachmentSize)
+		data["MaxAttachments"] = maxAttachmentsPerUpload
+	}
+}
+
+// parseAttachmentForm parses a form that may have attachments, limiting the size of the request to the most
+// attachments that can be uploaded at once. Forms that aren't multipart are parsed as usual.
+func parseAttachmentForm(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	r.Body = http.MaxBytesReader(w, r.Body, a.Config.MaxAttachmentSize*maxAttachmentsPerUpload+maxPostFormSize)
+	err := r.ParseMultipartForm(attachmentFormMemory)
+	if err == http.ErrNotMultipart {
+		return nil
+	}
+	if err != nil {
+		return httperror.StatusError{http.StatusBadRequest, errors.Errorf("Up to %d attachments of up to %s each "+
+			"can be uploaded at once", maxAttachmentsPerUpload, models.HumanSize(a.Config.MaxAttachmentSize))}
+	}
+
+	if len(r.MultipartForm.File[attachmentsFormField]) > maxAttachmentsPerUpload {
+		return httperror.StatusError{http.StatusBadRequest, errors.Errorf("Up to %d attachments can be uploaded at "+
+			"once", maxAttachmentsPerUpload)}
+	}
+	return nil
+}
+
+// addAttachments stores the files uploaded with the form and attaches them to the post in tx. The type of each file is
+// sniffed from its contents and must be one attachments are allowed to be, and the files must fit in the size limit and
+// the session user's quota. It returns the attachments it stored even if there is an error, the caller must delete
+// their files if tx is not committed.
+func addAttachments(tx *sqlx.Tx, a *application.App, r *http.Request, post *models.Post) ([]*models.Attachment, error) {
+	if r.MultipartForm == nil || len(r.MultipartForm.File[attachmentsFormField]) == 0 {
+		return nil, nil
+	}
+
+	if a.Config.MaxAttachmentSize == 0 {
+		return nil, models.InputError{"Attachments are disabled"}
+	}
+
+	user, _ := context.SessionUser(r)
+	am := models.NewAttachmentModel(a.DB)
+	used, err := am.UsedBytes(tx, user)
+	if err != nil {
+		return nil, errors.Wrap(err, "used bytes error")
+	}
+
+	var attachments []*models.Attachment
+	for _, fileHeader := range r.MultipartForm.File[attachmentsFormField] {
+		// browsers send the file's name but some clients send its whole path
+		filename := path.Base(strings.Replace(fileHeader.Filename, `\`, "/", -1))
+
+		b, err := readFormFile(fileHeader, a.Config.MaxAttachmentSize+1)
+		if err != nil {
+			return attachments, err
+		}
+
+		if int64(len(b)) > a.Config.MaxAttachmentSize {
+			return attachments, models.InputError{fmt.Sprintf("%s is larger than %s", filename,
+				models.HumanSize(a.Config.MaxAttachmentSize))}
+		}
+
+		used += int64(len(b))
+		if a.Config.AttachmentQuota > 0 && used > a.Config.AttachmentQuota {
+			return attachments, models.InputError{fmt.Sprintf("Attaching %s would go over your %s attachment quota",
+				filename, models.HumanSize(a.Config.AttachmentQuota))}
+		}
+
+		key, err := newAttachmentKey(post)
+		if err != nil {
+			return attachments, err
+		}
+
+		attachment := &models.Attachment{PostID: post.ID, UserID: user.ID, Key: key, Filename: filename,
+			ContentType: http.DetectContentType(b), Size: int64(len(b))}
+		if !attachment.IsValid() {
+			return attachments, models.ErrInvalidAttachment
+		}
+
+		if err = a.Storage.Put(key, bytes.NewReader(b)); err != nil {
+			return attachments, errors.Wrap(err, "storage put error")
+		}
+		attachments = append(attachments, attachment)
+
+		if err = am.Add(tx, attachment); err != nil {
+			return attachments, errors.Wrap(err, "add attachment error")
+		}
+	}
+	return attachments, nil
+}
+
+// readFormFile reads up to limit bytes of an uploaded file.
+func readFormFile(fileHeader *multipart.FileHeader, limit int64) ([]byte, error) {
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, errors.Wrap(err, "open form file error")
+	}
+	defer file.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(file, limit))
+	return b, errors.Wrap(err, "read form file error")
+}
+
+// newAttachmentKey returns a new random storage key for a file attached to the post. Keys are random so the file names
+// users choose never end up in storage.
+func newAttachmentKey(post *models.Post) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "rand error")
+	}
+	return fmt.Sprintf("attachments/%d/%s", post.ID, hex.EncodeToString(b)), nil
+}
+
+// deleteAttachmentFiles deletes the stored files of the attachments. It is used to clean up after the attachments are
+// deleted or were never added, so errors are ignored and at worst leave an unused file in storage.
+func deleteAttachmentFiles(a *application.App, attachments []*models.Attachment) {
+	for _, attachment := range attachments {
+		a.Storage.Delete(attachment.Key)
+	}
+}
+
+// canViewAttachments returns true if the session user can download the attachments of the post. The attachments of
+// hidden, pending and rejected posts can only be downloaded by their creator and moderators. Scheduled posts are
+// already only shown to their creator and admins.
+func canViewAttachments(r *http.Request, post *models.Post) bool {
+	if post.IsVisible && !post.IsPending() && post.Approval != models.PostApprovalRejected {
+		return true
+	}
+
+	user, ok := context.SessionUser(r)
+	if !ok {
+		return false
+	}
+
+	if user.IsAdmin || user.ID == post.Creator.ID {
+		return true
+	}
+
+	topicRole, ok := context.TopicRole(r)
+	return ok && topicRole.IsModerator()
+}
+
+// findPostAttachment finds the attachment with the id in the url of the post in the context.
+func findPostAttachment(a *application.App, r *http.Request) (*models.Attachment, error) {
+	attachmentID, err := strconv.ParseInt(mux.Vars(r)["attachmentID"], 10, 64)
+	if err != nil {
+		return nil, httperror.StatusError{http.StatusBadRequest, err}
+	}
+
+	am := models.NewAttachmentModel(a.DB)
+	attachment, err := am.FindOne(nil, squirrel.Eq{"post_attachments.id": attachmentID,
+		"post_attachments.post_id": context.Post(r).ID})
+	return attachment, errors.Wrap(err, "find one error")
+}
+
+// getAttachment sends the file of an attachment if the session user can see it. Only images are shown in the browser,
+// other files are downloaded.
+func getAttachment(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	if !canViewAttachments(r, context.Post(r)) {
+		return httperror.StatusError{http.StatusNotFound, nil}
+	}
+
+	attachment, err := findPostAttachment(a, r)
+	if err != nil {
+		return err
+	}
+
+	file, err := a.Storage.Get(attachment.Key)
+	if os.IsNotExist(errors.Cause(err)) {
+		return httperror.StatusError{http.StatusNotFound, nil}
+	}
+	if err != nil {
+		return errors.Wrap(err, "storage get error")
+	}
+	defer file.Close()
+
+	disposition := "attachment"
+	if attachment.IsImage() {
+		disposition = "inline"
+	}
+	if withFilename := mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}); withFilename != "" {
+		disposition = withFilename
+	}
+
+	// the content type was sniffed when the file was uploaded so browsers must not guess another one
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private")
+	_, err = io.Copy(w, file)
+	return errors.Wrap(err, "copy error")
+}
+
+// postAttachments attaches the uploaded files to the post in the context.
+func postAttachments(a *application.App, w http.ResponseWriter, r *http.Request) (err error) {
+	if err = parseAttachmentForm(a, w, r); err != nil {
+		return err
+	}
+
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	var attachments []*models.Attachment
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			deleteAttachmentFiles(a, attachments)
+			return
+		}
+		if err = tx.Commit(); err != nil {
+			deleteAttachmentFiles(a, attachments)
+		}
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	post := context.Post(r)
+	if attachments, err = addAttachments(tx, a, r, post); err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, post.URL(), http.StatusFound)
+	return nil
+}
+
+// postDeleteAttachment deletes an attachment of the post in the context and its file.
+func postDeleteAttachment(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	attachment, err := findPostAttachment(a, r)
+	if err != nil {
+		return err
+	}
+
+	am := models.NewAttachmentModel(a.DB)
+	if err = am.Delete(nil, attachment); err != nil {
+		return errors.Wrap(err, "delete error")
+	}
+
+	if err = a.Storage.Delete(attachment.Key); err != nil {
+		return errors.Wrap(err, "storage delete error")
+	}
+
+	http.Redirect(w, r, context.Post(r).URL(), http.StatusFound)
+	return nil
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BrianHarringtonUTSC/uTeach/application"
+	"github.com/BrianHarringtonUTSC/uTeach/context"
+	"github.com/BrianHarringtonUTSC/uTeach/httperror"
+	"github.com/BrianHarringtonUTSC/uTeach/libtemplate"
+	"github.com/BrianHarringtonUTSC/uTeach/models"
+	"github.com/Masterminds/squirrel"
+	"github.com/pkg/errors"
+)
+
+// auditLogDateFormat is the format of the from and to dates the audit log is filtered by.
+const auditLogDateFormat = "2006-01-02"
+
+// findAuditLog gets the audit log entries matching the actor handle, topic name, action and date range (inclusive, in
+// UTC) in the query string. Empty filters are ignored.
+func findAuditLog(a *application.App, r *http.Request) ([]*models.AuditEntry, error) {
+	var wheres []squirrel.Sqlizer
+
+	if handle := strings.ToLower(strings.TrimPrefix(r.FormValue("actor"), "@")); handle != "" {
+		wheres = append(wheres, squirrel.Eq{"actors.handle": handle})
+	}
+
+	if topicName := strings.ToLower(r.FormValue("topic")); topicName != "" {
+		wheres = append(wheres, squirrel.Eq{"topics.name": topicName})
+	}
+
+	if action := r.FormValue("action"); action != "" {
+		wheres = append(wheres, squirrel.Eq{"audit_log.action": action})
+	}
+
+	if from := r.FormValue("from"); from != "" {
+		t, err := time.Parse(auditLogDateFormat, from)
+		if err != nil {
+			return nil, httperror.StatusError{http.StatusBadRequest, errors.New("Dates must be formatted YYYY-MM-DD")}
+		}
+		wheres = append(wheres, squirrel.GtOrEq{"audit_log.created_at": t})
+	}
+
+	if to := r.FormValue("to"); to != "" {
+		t, err := time.Parse(auditLogDateFormat, to)
+		if err != nil {
+			return nil, httperror.StatusError{http.StatusBadRequest, errors.New("Dates must be formatted YYYY-MM-DD")}
+		}
+		wheres = append(wheres, squirrel.Lt{"audit_log.created_at": t.AddDate(0, 0, 1)})
+	}
+
+	alm := models.NewAuditLogModel(a.DB)
+	entries, err := alm.Find(nil, wheres...)
+	return entries, errors.Wrap(err, "find error")
+}
+
+func getAuditLog(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	entries, err := findAuditLog(a, r)
+	if err != nil {
+		return err
+	}
+
+	data := context.TemplateData(r)
+	data["AuditEntries"] = entries
+	data["AuditActions"] = models.AuditActions
+	data["Filters"] = r.URL.Query()
+	data["CSVURL"] = "/admin/audit_log.csv?" + r.URL.RawQuery
+	err = libtemplate.Render(w, a.Templates, "audit_log.html", data)
+	return errors.Wrap(err, "render template error")
+}
+
+func getAuditLogCSV(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	entries, err := findAuditLog(a, r)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit_log.csv"`)
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "time", "actor", "action", "topic", "target_type", "target_id", "details"})
+	for _, entry := range entries {
+		actor, topic := "", ""
+		if entry.Actor != nil {
+			actor = entry.Actor.Handle
+		}
+		if entry.Topic != nil {
+			topic = entry.Topic.Name
+		}
+
+		cw.Write([]string{strconv.FormatInt(entry.ID, 10), entry.CreatedAt.UTC().Format(time.RFC3339), actor,
+			entry.Action, topic, entry.TargetType, strconv.FormatInt(entry.TargetID, 10), entry.Details})
+	}
+	cw.Flush()
+	return errors.Wrap(cw.Error(), "write csv error")
+}
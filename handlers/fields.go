@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/BrianHarringtonUTSC/uTeach/application"
+	"github.com/BrianHarringtonUTSC/uTeach/context"
+	"github.com/BrianHarringtonUTSC/uTeach/httperror"
+	"github.com/BrianHarringtonUTSC/uTeach/libtemplate"
+	"github.com/BrianHarringtonUTSC/uTeach/models"
+	"github.com/Masterminds/squirrel"
+	"github.com/pkg/errors"
+)
+
+// fieldFormPrefix is the prefix of the names of custom field inputs in forms, followed by the field's id.
+const fieldFormPrefix = "field-"
+
+// fieldFilterPrefix is the prefix of custom field filters in the query string of the filter page, followed by the
+// field's name.
+const fieldFilterPrefix = "f."
+
+// findTopicFields gets the custom fields of the posts in the topic, including fields of its parent.
+func findTopicFields(a *application.App, topic *models.Topic) ([]*models.Field, error) {
+	fm := models.NewFieldModel(a.DB)
+	fields, err := fm.Find(nil, squirrel.Eq{"topic_fields.topic_id": topic.TopicIDs()})
+	return fields, errors.Wrap(err, "find fields error")
+}
+
+// formFieldValues gets the values of custom fields in the form by field id.
+func formFieldValues(r *http.Request) (map[int64]string, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, httperror.StatusError{http.StatusBadRequest, err}
+	}
+
+	values := make(map[int64]string)
+	for key := range r.PostForm {
+		if !strings.HasPrefix(key, fieldFormPrefix) {
+			continue
+		}
+
+		fieldID, err := strconv.ParseInt(strings.TrimPrefix(key, fieldFormPrefix), 10, 64)
+		if err != nil {
+			return nil, httperror.StatusError{http.StatusBadRequest, err}
+		}
+		values[fieldID] = r.PostForm.Get(key)
+	}
+	return values, nil
+}
+
+// getFields lists the topic's custom fields with a form to add one.
+func getFields(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	fields, err := findTopicFields(a, context.Topic(r))
+	if err != nil {
+		return err
+	}
+
+	data := context.TemplateData(r)
+	data["Fields"] = fields
+	err = libtemplate.Render(w, a.Templates, "fields.html", data)
+	return errors.Wrap(err, "render template error")
+}
+
+// postNewField adds a custom field to the topic's posts and records it in the audit log.
+func postNewField(a *application.App, w http.ResponseWriter, r *http.Request) (err error) {
+	topic := context.Topic(r)
+	user, _ := context.SessionUser(r)
+
+	field := &models.Field{TopicID: topic.ID, Name: r.FormValue("name"), Label: r.FormValue("label"),
+		Type: r.FormValue("type"), Options: r.FormValue("options"), IsRequired: r.FormValue("required") == "on"}
+
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	fm := models.NewFieldModel(a.DB)
+	if err = fm.Add(tx, field); err != nil {
+		return err
+	}
+
+	alm := models.NewAuditLogModel(a.DB)
+	entry := &models.AuditEntry{Actor: user, Action: models.AuditActionAddField, Topic: topic,
+		TargetType: models.AuditTargetTopic, TargetID: topic.ID, Details: field.Name + " (" + field.Type + ")"}
+	if err = alm.Add(tx, entry); err != nil {
+		return errors.Wrap(err, "add audit entry error")
+	}
+
+	http.Redirect(w, r, topic.URL()+"/fields", http.StatusFound)
+	return nil
+}
+
+// postDeleteField deletes the topic's field in the form and the values posts have for it.
+func postDeleteField(a *application.App, w http.ResponseWriter, r *http.Request) (err error) {
+	topic := context.Topic(r)
+	user, _ := context.SessionUser(r)
+
+	fieldID, err := strconv.ParseInt(r.FormValue("field"), 10, 64)
+	if err != nil {
+		return httperror.StatusError{http.StatusBadRequest, err}
+	}
+
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	fm := models.NewFieldModel(a.DB)
+	field, err := fm.FindOne(tx, squirrel.Eq{"topic_fields.id": fieldID, "topic_fields.topic_id": topic.ID})
+	if err != nil {
+		return errors.Wrap(err, "find one error")
+	}
+
+	if err = fm.Delete(tx, field); err != nil {
+		return errors.Wrap(err, "delete error")
+	}
+
+	alm := models.NewAuditLogModel(a.DB)
+	entry := &models.AuditEntry{Actor: user, Action: models.AuditActionDeleteField, Topic: topic,
+		TargetType: models.AuditTargetTopic, TargetID: topic.ID, Details: field.Name}
+	if err = alm.Add(tx, entry); err != nil {
+		return errors.Wrap(err, "add audit entry error")
+	}
+
+	http.Redirect(w, r, topic.URL()+"/fields", http.StatusFound)
+	return nil
+}
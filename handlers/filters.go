@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/BrianHarringtonUTSC/uTeach/application"
+	"github.com/BrianHarringtonUTSC/uTeach/context"
+	"github.com/BrianHarringtonUTSC/uTeach/httperror"
+	"github.com/BrianHarringtonUTSC/uTeach/libtemplate"
+	"github.com/BrianHarringtonUTSC/uTeach/models"
+	"github.com/Masterminds/squirrel"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// renderFilterRules shows the filter rules with a form to add a rule. The data can include the results of a dry run.
+func renderFilterRules(a *application.App, w http.ResponseWriter, r *http.Request, data map[string]interface{}) error {
+	frm := models.NewFilterRuleModel(a.DB)
+	rules, err := frm.Find(nil)
+	if err != nil {
+		return errors.Wrap(err, "find filter rules error")
+	}
+
+	tm := models.NewTopicModel(a.DB)
+	topics, err := tm.Find(nil)
+	if err != nil {
+		return errors.Wrap(err, "find topics error")
+	}
+
+	data["FilterRules"] = rules
+	data["Topics"] = topics
+	data["FilterKinds"] = models.FilterKinds
+	data["FilterActions"] = models.FilterActions
+	err = libtemplate.Render(w, a.Templates, "filters.html", data)
+	return errors.Wrap(err, "render template error")
+}
+
+func getFilterRules(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	return renderFilterRules(a, w, r, context.TemplateData(r))
+}
+
+// filterRuleFromForm gets the rule in the add form. Rules without a topic are site wide.
+func filterRuleFromForm(a *application.App, r *http.Request) (*models.FilterRule, error) {
+	rule := &models.FilterRule{Kind: r.FormValue("kind"), Pattern: strings.TrimSpace(r.FormValue("pattern")),
+		Action: r.FormValue("action")}
+	if !rule.IsValid() {
+		return nil, models.ErrInvalidFilterRule
+	}
+
+	if topicName := r.FormValue("topic"); topicName != "" {
+		tm := models.NewTopicModel(a.DB)
+		topic, err := tm.FindOne(nil, squirrel.Eq{"topics.name": strings.ToLower(topicName)})
+		if err != nil {
+			return nil, errors.Wrap(err, "find one topic error")
+		}
+		rule.Topic = topic
+	}
+	return rule, nil
+}
+
+// postFilterRule adds the rule in the form. If the form was submitted as a dry run the rule isn't added, instead the
+// existing posts it would match are shown.
+func postFilterRule(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	rule, err := filterRuleFromForm(a, r)
+	if err != nil {
+		return err
+	}
+
+	if r.FormValue("dry_run") != "" {
+		return dryRunFilterRule(a, w, r, rule)
+	}
+
+	user, _ := context.SessionUser(r)
+	entry := &models.AuditEntry{Actor: user, Action: models.AuditActionAddFilterRule, Topic: rule.Topic,
+		TargetType: models.AuditTargetFilterRule}
+	if err = changeFilterRule(a, rule, entry); err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, "/admin/filters", http.StatusFound)
+	return nil
+}
+
+// dryRunFilterRule shows the existing posts that the rule would match without adding it. Rules for a topic apply to
+// the posts in its sections too.
+func dryRunFilterRule(a *application.App, w http.ResponseWriter, r *http.Request, rule *models.FilterRule) error {
+	var wheres []squirrel.Sqlizer
+	if rule.Topic != nil {
+		tm := models.NewTopicModel(a.DB)
+		topicIDs, err := tm.WithSectionIDs(nil, []int64{rule.Topic.ID})
+		if err != nil {
+			return errors.Wrap(err, "with section ids error")
+		}
+		wheres = append(wheres, squirrel.Eq{"posts.topic_id": topicIDs})
+	}
+
+	pm := models.NewPostModel(a.DB)
+	posts, err := pm.Find(nil, wheres...)
+	if err != nil {
+		return errors.Wrap(err, "find posts error")
+	}
+
+	// posts are listed once per tag so skip the ones already checked
+	checked := make(map[int64]bool)
+	var matches []*models.Post
+	for _, post := range posts {
+		if !checked[post.ID] && rule.Matches(post) {
+			matches = append(matches, post)
+		}
+		checked[post.ID] = true
+	}
+
+	data := context.TemplateData(r)
+	data["DryRunRule"] = rule
+	data["DryRunPosts"] = matches
+	return renderFilterRules(a, w, r, data)
+}
+
+func deleteFilterRule(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	ruleID, err := strconv.ParseInt(mux.Vars(r)["ruleID"], 10, 64)
+	if err != nil {
+		return httperror.StatusError{http.StatusBadRequest, err}
+	}
+
+	frm := models.NewFilterRuleModel(a.DB)
+	rules, err := frm.Find(nil, squirrel.Eq{"filter_rules.id": ruleID})
+	if err != nil {
+		return errors.Wrap(err, "find error")
+	}
+	if len(rules) == 0 {
+		return httperror.StatusError{http.StatusNotFound, nil}
+	}
+	rule := rules[0]
+
+	user, _ := context.SessionUser(r)
+	entry := &models.AuditEntry{Actor: user, Action: models.AuditActionDeleteFilterRule, Topic: rule.Topic,
+		TargetType: models.AuditTargetFilterRule}
+	return changeFilterRule(a, rule, entry)
+}
+
+// changeFilterRule adds or deletes the rule depending on the entry's action and records it in the audit log in one tx.
+func changeFilterRule(a *application.App, rule *models.FilterRule, entry *models.AuditEntry) (err error) {
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	frm := models.NewFilterRuleModel(a.DB)
+	if entry.Action == models.AuditActionDeleteFilterRule {
+		err = errors.Wrap(frm.Delete(tx, rule), "delete error")
+	} else {
+		err = frm.Add(tx, rule)
+	}
+	if err != nil {
+		return err
+	}
+
+	entry.TargetID = rule.ID
+	entry.Details = rule.String() + " " + rule.Action
+	alm := models.NewAuditLogModel(a.DB)
+	err = alm.Add(tx, entry)
+	return errors.Wrap(err, "add audit entry error")
+}
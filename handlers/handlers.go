@@ -11,6 +11,9 @@ import (
 	"github.com/justinas/alice"
 )
 
+// topicRoute matches the URL of a topic or a section of a topic, e.g. /topics/csc108/sections/l0101.
+const topicRoute = "/topics/{topicName:[[:alnum:]_]+(?:/sections/[[:alnum:]_]+)?}"
+
 // Handler allows passing an application context to a handler and handling errors.
 // See: http://elithrar.github.io/article/http-handler-error-handling-revisited/
 type Handler struct {
@@ -36,35 +39,110 @@ func Router(a *application.App) http.Handler {
 	router.Handle("/", h(getTopics))
 	router.Handle("/topics/new", m.MustBeAdmin(h(getNewTopic))).Methods("GET")
 	router.Handle("/topics/new", m.MustBeAdmin(h(postNewTopic))).Methods("POST")
+	router.Handle(topicRoute+"/settings", m.SetTopic(m.MustLogin(m.MustBeInstructor(h(getTopicSettings))))).Methods("GET")
+	router.Handle(topicRoute+"/settings", m.SetTopic(m.MustLogin(m.MustNotBeArchived(m.MustBeInstructor(h(postTopicSettings)))))).Methods("POST")
+	router.Handle(topicRoute+"/stats", m.SetTopic(m.MustLogin(m.MustBeModerator(h(getTopicStats))))).Methods("GET")
+	router.Handle(topicRoute+"/stats.csv", m.SetTopic(m.MustLogin(m.MustBeModerator(h(getTopicStatsCSV))))).Methods("GET")
+	router.Handle(topicRoute+"/fields", m.SetTopic(m.MustLogin(m.MustBeModerator(h(getFields))))).Methods("GET")
+	router.Handle(topicRoute+"/fields", m.SetTopic(m.MustLogin(m.MustNotBeArchived(m.MustBeModerator(h(postNewField)))))).Methods("POST")
+	router.Handle(topicRoute+"/fields/delete", m.SetTopic(m.MustLogin(m.MustNotBeArchived(m.MustBeModerator(h(postDeleteField)))))).Methods("POST")
+	router.Handle(topicRoute+"/settings/approval", m.SetTopic(m.MustLogin(m.MustNotBeArchived(m.MustBeModerator(h(postTopicApproval)))))).Methods("POST")
+	router.Handle(topicRoute+"/subscription", m.SetTopic(m.MustLogin(h(postSubscription)))).Methods("POST")
+	router.Handle(topicRoute+"/subscription", m.SetTopic(m.MustLogin(h(deleteSubscription)))).Methods("DELETE")
+	router.Handle(topicRoute+"/edit", m.MustBeAdmin(m.SetTopic(h(getEditTopic)))).Methods("GET")
+	router.Handle(topicRoute+"/edit", m.MustBeAdmin(m.SetTopic(h(postEditTopic)))).Methods("POST")
+	router.Handle(topicRoute+"/delete", m.MustBeAdmin(m.SetTopic(h(getDeleteTopic)))).Methods("GET")
+	router.Handle(topicRoute+"/delete", m.MustBeAdmin(m.SetTopic(h(postDeleteTopic)))).Methods("POST")
+	router.Handle(topicRoute+"/clone", m.MustBeAdmin(m.SetTopic(h(getCloneTopic)))).Methods("GET")
+	router.Handle(topicRoute+"/clone", m.MustBeAdmin(m.SetTopic(h(postCloneTopic)))).Methods("POST")
 
 	// user routes
-	router.Handle("/users/{email}", h(getUser))
+	router.Handle("/users/{handle}", h(getUser))
+	router.Handle("/settings/handle", m.MustLogin(h(getEditHandle))).Methods("GET")
+	router.Handle("/settings/handle", m.MustLogin(h(postEditHandle))).Methods("POST")
+	router.Handle("/settings/profile", m.MustLogin(h(getEditProfile))).Methods("GET")
+	router.Handle("/settings/profile", m.MustLogin(h(postEditProfile))).Methods("POST")
+	router.Handle("/avatars/{avatarName}", h(getAvatar))
+	router.Handle("/users/{handle}/sessions", m.MustBeAdmin(h(deleteUserSessions))).Methods("DELETE")
+	router.Handle("/users/{handle}/suspension", m.MustBeAdmin(h(postUserSuspension))).Methods("POST")
+	router.Handle("/users/{handle}/suspension", m.MustBeAdmin(h(deleteUserSuspension))).Methods("DELETE")
+	router.Handle("/users/{handle}/impersonation", m.MustBeAdmin(h(postUserImpersonation))).Methods("POST")
+	router.Handle("/impersonation/stop", m.MustLogin(h(getStopImpersonation)))
+
+	// admin routes
+	router.Handle("/admin", m.MustBeAdmin(h(getAdmin)))
+	router.Handle("/admin/suspensions", m.MustBeAdmin(h(getSuspensions)))
+	router.Handle("/admin/impersonations", m.MustBeAdmin(h(getImpersonations)))
+	router.Handle("/admin/audit_log", m.MustBeAdmin(h(getAuditLog)))
+	router.Handle("/admin/audit_log.csv", m.MustBeAdmin(h(getAuditLogCSV)))
+	router.Handle("/admin/filters", m.MustBeAdmin(h(getFilterRules))).Methods("GET")
+	router.Handle("/admin/filters", m.MustBeAdmin(h(postFilterRule))).Methods("POST")
+	router.Handle("/admin/filters/{ruleID}", m.MustBeAdmin(h(deleteFilterRule))).Methods("DELETE")
+	router.Handle("/moderation", m.MustLogin(h(getModeration)))
+	router.Handle("/notifications", m.MustLogin(h(getNotifications)))
+
+	// session routes
+	router.Handle("/settings/sessions", m.MustLogin(h(getSessions))).Methods("GET")
+	router.Handle("/settings/sessions/{sessionID}", m.MustLogin(h(deleteSession))).Methods("DELETE")
 	router.Handle("/login", h(getLogin))
 	router.Handle("/oauth2callback", h(getOauth2Callback))
 	router.Handle("/logout", h(getLogout))
 
+	// lti routes, only if an LMS is registered
+	if a.LTI.IsEnabled() {
+		router.Handle("/lti/login", h(ltiLogin)).Methods("GET", "POST")
+		router.Handle("/lti/launch", h(postLTILaunch)).Methods("POST")
+		router.Handle("/lti/deep_link", m.MustLogin(h(postLTIDeepLink))).Methods("POST")
+		router.Handle("/lti/jwks", h(getLTIJWKS))
+	}
+
 	// tag routes
-	router.Handle("/topics/{topicName}/tags", m.SetTopic(h(getTags)))
-	router.Handle("/topics/{topicName}/tags/new", m.MustBeAdmin(m.SetTopic(h(getNewTag)))).Methods("GET")
-	router.Handle("/topics/{topicName}/tags/new", m.MustBeAdmin(m.SetTopic(h(postNewTag)))).Methods("POST")
-	router.Handle("/topics/{topicName}/tags/{tagName}", m.SetTopic(m.SetTag(h(getPostsByTag))))
+	router.Handle(topicRoute+"/tags", m.SetTopic(h(getTags)))
+	router.Handle(topicRoute+"/tags/new", m.SetTopic(m.MustLogin(m.MustNotBeArchived(h(getNewTag))))).Methods("GET")
+	router.Handle(topicRoute+"/tags/new", m.SetTopic(m.MustLogin(m.MustNotBeArchived(h(postNewTag))))).Methods("POST")
+	router.Handle(topicRoute+"/tags/{tagName}", m.SetTopic(m.SetTag(h(getPostsByTag))))
+	router.Handle(topicRoute+"/filter", m.SetTopic(h(getFilteredPosts)))
+	router.Handle(topicRoute+"/tags/{tagName}/mute", m.SetTopic(m.MustLogin(m.SetTag(h(postMuteTag))))).Methods("POST")
+	router.Handle(topicRoute+"/tags/{tagName}/mute", m.SetTopic(m.MustLogin(m.SetTag(h(deleteMuteTag))))).Methods("DELETE")
+
+	t := alice.New(m.SetTopic, m.MustLogin, m.MustNotBeArchived, m.MustBeModerator, m.SetTag, m.MustBeTopicTag)
+	router.Handle(topicRoute+"/tags/{tagName}/edit", t.Then(h(getEditTag))).Methods("GET")
+	router.Handle(topicRoute+"/tags/{tagName}/edit", t.Then(h(postEditTag))).Methods("POST")
+	router.Handle(topicRoute+"/tags/{tagName}/merge", t.Then(h(postMergeTag))).Methods("POST")
+	router.Handle(topicRoute+"/tags/{tagName}/delete", t.Then(h(postDeleteTag))).Methods("POST")
 
 	// post routes
 	p := alice.New(m.SetTopic)
-	router.Handle("/topics/{topicName}", p.Then(h(getPosts)))
+	router.Handle(topicRoute, p.Then(h(getPosts)))
 
+	// archived topics are read only for students (c routes) but can still be moderated
 	p = p.Append(m.MustLogin)
-	router.Handle("/topics/{topicName}/new", p.Then(h(getNewPost))).Methods("GET")
-	router.Handle("/topics/{topicName}/new", p.Then(m.SetTopic(h(postNewPost)))).Methods("POST")
+	c := p.Append(m.MustNotBeArchived)
+	router.Handle(topicRoute+"/new", c.Then(h(getNewPost))).Methods("GET")
+	router.Handle(topicRoute+"/new", c.Then(m.RateLimit("post")(m.SetTopic(h(postNewPost))))).Methods("POST")
 
 	p = p.Append(m.SetPost)
-	router.Handle("/topics/{topicName}/posts/{postID}", m.SetTopic(m.SetPost(h(getPost))))
-	router.Handle("/topics/{topicName}/posts/{postID}/vote", p.Then(h(postPostVote))).Methods("POST")
-	router.Handle("/topics/{topicName}/posts/{postID}/vote", p.Then(h(deletePostVote))).Methods("DELETE")
-	router.Handle("/topics/{topicName}/posts/{postID}/hide", p.Then(m.MustBeAdminOrPostCreator(h(postHidePost)))).Methods("POST")
-	router.Handle("/topics/{topicName}/posts/{postID}/hide", p.Then(m.MustBeAdminOrPostCreator(h(deleteHidePost)))).Methods("DELETE")
-	router.Handle("/topics/{topicName}/posts/{postID}/pin", p.Then(m.MustBeAdmin(h(postPinPost)))).Methods("POST")
-	router.Handle("/topics/{topicName}/posts/{postID}/pin", p.Then(m.MustBeAdmin(h(deletePinPost)))).Methods("DELETE")
+	c = c.Append(m.SetPost)
+	router.Handle(topicRoute+"/posts/{postID}", m.SetTopic(m.SetPost(h(getPost))))
+	router.Handle(topicRoute+"/posts/{postID}/vote", c.Then(m.MustNotBeLocked(m.RateLimit("vote")(h(postPostVote))))).Methods("POST")
+	router.Handle(topicRoute+"/posts/{postID}/vote", c.Then(m.MustNotBeLocked(m.RateLimit("vote")(h(deletePostVote))))).Methods("DELETE")
+	router.Handle(topicRoute+"/posts/{postID}/hide", p.Then(m.MustBeAdminOrPostCreator(h(postHidePost)))).Methods("POST")
+	router.Handle(topicRoute+"/posts/{postID}/hide", p.Then(m.MustBeAdminOrPostCreator(h(deleteHidePost)))).Methods("DELETE")
+	router.Handle(topicRoute+"/posts/{postID}/pin", p.Then(m.MustBeAdmin(h(postPinPost)))).Methods("POST")
+	router.Handle(topicRoute+"/posts/{postID}/pin", p.Then(m.MustBeAdmin(h(deletePinPost)))).Methods("DELETE")
+	router.Handle(topicRoute+"/posts/{postID}/lock", p.Then(m.MustBeAdmin(h(postLockPost)))).Methods("POST")
+	router.Handle(topicRoute+"/posts/{postID}/lock", p.Then(m.MustBeAdmin(h(deleteLockPost)))).Methods("DELETE")
+	router.Handle(topicRoute+"/posts/{postID}/move", p.Then(m.MustBeAdmin(h(getMovePost)))).Methods("GET")
+	router.Handle(topicRoute+"/posts/{postID}/move", p.Then(m.MustBeAdmin(h(postMovePost)))).Methods("POST")
+	router.Handle(topicRoute+"/posts/{postID}/crossposts", p.Then(m.MustBeAdmin(h(postCrossPost)))).Methods("POST")
+	router.Handle(topicRoute+"/posts/{postID}/crossposts", p.Then(m.MustBeAdmin(h(deleteCrossPost)))).Methods("DELETE")
+	router.Handle(topicRoute+"/posts/{postID}/attachments", c.Then(m.MustBeAdminOrPostCreator(m.MustNotBeLocked(h(postAttachments))))).Methods("POST")
+	router.Handle(topicRoute+"/posts/{postID}/attachments/{attachmentID}", m.SetTopic(m.SetPost(h(getAttachment)))).Methods("GET")
+	router.Handle(topicRoute+"/posts/{postID}/attachments/{attachmentID}/delete", c.Then(m.MustBeAdminOrPostCreator(m.MustNotBeLocked(h(postDeleteAttachment))))).Methods("POST")
+	router.Handle(topicRoute+"/posts/{postID}/report", c.Then(m.RateLimit("report")(h(postReportPost)))).Methods("POST")
+	router.Handle(topicRoute+"/posts/{postID}/reports/resolve", p.Then(m.MustBeModerator(h(postResolveReports)))).Methods("POST")
+	router.Handle(topicRoute+"/posts/{postID}/approve", p.Then(m.MustBeModerator(h(postApprovePost)))).Methods("POST")
+	router.Handle(topicRoute+"/posts/{postID}/reject", p.Then(m.MustBeModerator(h(postRejectPost)))).Methods("POST")
 
 	// serve static files -- should be the last route
 	staticFileServer := http.FileServer(http.Dir(a.Config.StaticFilesPath))
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/BrianHarringtonUTSC/uTeach/application"
+	"github.com/BrianHarringtonUTSC/uTeach/context"
+	"github.com/BrianHarringtonUTSC/uTeach/httperror"
+	"github.com/BrianHarringtonUTSC/uTeach/libtemplate"
+	"github.com/BrianHarringtonUTSC/uTeach/models"
+	"github.com/BrianHarringtonUTSC/uTeach/session"
+	"github.com/pkg/errors"
+)
+
+func getImpersonations(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	im := models.NewImpersonationModel(a.DB)
+	impersonations, err := im.Find(nil)
+	if err != nil {
+		return errors.Wrap(err, "find error")
+	}
+
+	data := context.TemplateData(r)
+	data["Impersonations"] = impersonations
+	err = libtemplate.Render(w, a.Templates, "impersonations.html", data)
+	return errors.Wrap(err, "render template error")
+}
+
+func postUserImpersonation(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	user, err := findUserByHandleVar(a, r)
+	if err != nil {
+		return err
+	}
+	admin, _ := context.SessionUser(r)
+
+	im := models.NewImpersonationModel(a.DB)
+	impersonation := &models.Impersonation{Admin: admin, User: user, AllowWrites: r.FormValue("allow_writes") != ""}
+	if err = im.Add(nil, impersonation); err != nil {
+		return err
+	}
+
+	us := session.NewUserSession(a.Store)
+	if err = us.SaveImpersonationID(w, r, impersonation.ID); err != nil {
+		return errors.Wrap(err, "save impersonation id error")
+	}
+
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
+
+func getStopImpersonation(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	impersonation, ok := context.Impersonation(r)
+	if !ok {
+		return httperror.StatusError{http.StatusBadRequest, errors.New("Not impersonating a user")}
+	}
+
+	im := models.NewImpersonationModel(a.DB)
+	if err := im.End(nil, impersonation); err != nil {
+		return errors.Wrap(err, "end error")
+	}
+
+	us := session.NewUserSession(a.Store)
+	if err := us.DeleteImpersonationID(w, r); err != nil {
+		return errors.Wrap(err, "delete impersonation id error")
+	}
+
+	http.Redirect(w, r, impersonation.User.URL(), http.StatusFound)
+	return nil
+}
@@ -0,0 +1,538 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/BrianHarringtonUTSC/uTeach/application"
+	"github.com/BrianHarringtonUTSC/uTeach/context"
+	"github.com/BrianHarringtonUTSC/uTeach/httperror"
+	"github.com/BrianHarringtonUTSC/uTeach/libtemplate"
+	"github.com/BrianHarringtonUTSC/uTeach/lti"
+	"github.com/BrianHarringtonUTSC/uTeach/models"
+	"github.com/BrianHarringtonUTSC/uTeach/session"
+	"github.com/Masterminds/squirrel"
+	"github.com/gorilla/securecookie"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ltiDeepLinkName is the name the deep linking form's state is signed and encrypted under.
+	ltiDeepLinkName = "lti-deep-link"
+
+	// ltiStateCookiePrefix prefixes the name of the cookie that ties a login's state to the browser that started it.
+	ltiStateCookiePrefix = "lti-state-"
+)
+
+// ltiDeepLink is the state of a deep linking request carried in the topic selection form until the user picks a topic.
+type ltiDeepLink struct {
+	Issuer       string
+	ClientID     string
+	DeploymentID string
+	Settings     lti.DeepLinkingSettings
+	UserID       int64
+}
+
+// topicRoleForLaunch maps the user's LMS roles to their role in the topic. Returns an empty string if none of their
+// roles map to a topic role (e.g. mentors).
+func topicRoleForLaunch(launch *lti.Launch) string {
+	switch {
+	case launch.HasRole(lti.RoleTeachingAssistant):
+		return models.TopicRoleTA
+	case launch.HasRole(lti.RoleInstructor, lti.RoleAdministrator, lti.RoleContentDeveloper):
+		return models.TopicRoleInstructor
+	case launch.HasRole(lti.RoleLearner):
+		return models.TopicRoleStudent
+	}
+	return ""
+}
+
+func getLTIJWKS(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(a.LTI.JWKS())
+	return errors.Wrap(err, "json encode error")
+}
+
+// ltiLogin starts the OIDC login the platform initiates before each launch by redirecting back to the platform with a
+// state and nonce that the launch must return.
+func ltiLogin(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	login := &lti.LoginRequest{
+		Issuer:        r.FormValue("iss"),
+		LoginHint:     r.FormValue("login_hint"),
+		TargetLinkURI: r.FormValue("target_link_uri"),
+		MessageHint:   r.FormValue("lti_message_hint"),
+		ClientID:      r.FormValue("client_id"),
+		DeploymentID:  r.FormValue("lti_deployment_id"),
+	}
+	if login.Issuer == "" || login.LoginHint == "" {
+		return httperror.StatusError{http.StatusBadRequest, errors.New("Missing iss or login_hint")}
+	}
+
+	platform, ok := a.LTI.Platform(login.Issuer, login.ClientID)
+	if !ok {
+		return httperror.StatusError{http.StatusBadRequest, errors.New("Unknown LTI platform")}
+	}
+
+	state, err := lti.RandomString()
+	if err != nil {
+		return errors.Wrap(err, "state error")
+	}
+
+	nonce, err := lti.RandomString()
+	if err != nil {
+		return errors.Wrap(err, "nonce error")
+	}
+
+	lm := models.NewLTIModel(a.DB)
+	if err = lm.AddState(nil, state, nonce); err != nil {
+		return errors.Wrap(err, "add state error")
+	}
+	http.SetCookie(w, ltiStateCookie(a, state, int(models.LTIStateLifetime.Seconds())))
+
+	url := a.LTI.AuthURL(platform, login, a.Config.LTIToolURL+"/lti/launch", state, nonce)
+	http.Redirect(w, r, url, http.StatusFound)
+	return nil
+}
+
+func postLTILaunch(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	errorParam := r.FormValue("error")
+	if errorParam != "" {
+		return httperror.StatusError{http.StatusUnauthorized,
+			errors.Errorf("%s: %s", errorParam, r.FormValue("error_description"))}
+	}
+
+	// the launch must come back to the browser that started the login, otherwise someone could log others in as them
+	state := r.FormValue("state")
+	if _, err := r.Cookie(ltiStateCookiePrefix + state); state == "" || err != nil {
+		return httperror.StatusError{http.StatusUnauthorized,
+			errors.New("The LTI login was started in another browser, open uTeach from your course again")}
+	}
+	http.SetCookie(w, ltiStateCookie(a, state, -1))
+
+	nonce, err := consumeLTIState(a, state)
+	if err == sql.ErrNoRows {
+		return httperror.StatusError{http.StatusUnauthorized,
+			errors.New("The LTI login expired or was already used, open uTeach from your course again")}
+	}
+	if err != nil {
+		return err
+	}
+
+	launch, err := a.LTI.ValidateLaunch(r.FormValue("id_token"), nonce)
+	if errors.Cause(err) == lti.ErrInvalidLaunch {
+		return httperror.StatusError{http.StatusUnauthorized, err}
+	}
+	if err != nil {
+		return errors.Wrap(err, "validate launch error")
+	}
+
+	role := topicRoleForLaunch(launch)
+	isDeepLinking := launch.MessageType == lti.MessageTypeDeepLinking
+	if isDeepLinking && role != models.TopicRoleInstructor && role != models.TopicRoleTA {
+		return httperror.StatusError{http.StatusForbidden, errors.New("Only instructors can add uTeach to a course")}
+	}
+
+	user, topic, err := linkLTILaunch(a, launch, role)
+	if errors.Cause(err) == errSignUpNotAllowed {
+		return renderSignUpNotAllowed(a, w, r, launch.Email)
+	}
+	if err != nil {
+		return err
+	}
+
+	us := session.NewUserSession(a.Store)
+	if err = us.SaveSessionUserID(w, r, user.ID); err != nil {
+		return errors.Wrap(err, "save session user error")
+	}
+
+	if isDeepLinking {
+		return renderLTIDeepLink(a, w, r, launch, user, topic)
+	}
+
+	redirectURL := "/"
+	if topic != nil {
+		redirectURL = topic.URL()
+	}
+	http.Redirect(w, r, redirectURL, http.StatusFound)
+	return nil
+}
+
+// ltiStateCookie returns the cookie for a login's state. The launch is posted from the platform's site, so over HTTPS
+// the cookie is also sent on cross site requests. A negative maxAge deletes the cookie.
+func ltiStateCookie(a *application.App, state string, maxAge int) *http.Cookie {
+	cookie := &http.Cookie{Name: ltiStateCookiePrefix + state, Value: "1", Path: "/lti", MaxAge: maxAge, HttpOnly: true}
+	if strings.HasPrefix(a.Config.LTIToolURL, "https://") {
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	return cookie
+}
+
+// consumeLTIState returns the nonce of the login's state and removes the state in one tx so it can only be used once.
+// Returns sql.ErrNoRows if the state expired or was already used.
+func consumeLTIState(a *application.App, state string) (string, error) {
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return "", errors.Wrap(err, "begin transaction error")
+	}
+
+	lm := models.NewLTIModel(a.DB)
+	nonce, err := lm.ConsumeState(tx, state)
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return "", err
+		}
+		return "", errors.Wrap(err, "consume state error")
+	}
+
+	err = tx.Commit()
+	return nonce, errors.Wrap(err, "commit error")
+}
+
+// linkLTILaunch finds or adds the launching user and the topic for the launch's context and gives the user their role
+// in the topic if it was created for the context. The topic is nil if the launch is not from a context and does not
+// link to a topic.
+func linkLTILaunch(a *application.App, launch *lti.Launch, role string) (user *models.User, topic *models.Topic,
+	err error) {
+	// users, topics and roles should be linked together so use one tx
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	user, err = findOrAddLTIUser(tx, a, launch)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	topic, grantsRoles, err := findOrAddLTITopic(tx, a, launch, user, role)
+	if err != nil || topic == nil || !grantsRoles || role == "" {
+		return user, topic, err
+	}
+
+	err = setLTITopicRole(tx, a, topic, user, role)
+	return user, topic, err
+}
+
+// setLTITopicRole gives the user the role from their LMS in the topic. Changes are recorded in the audit log with no
+// actor since the LMS made them.
+func setLTITopicRole(tx *sqlx.Tx, a *application.App, topic *models.Topic, user *models.User, role string) error {
+	trm := models.NewTopicRoleModel(a.DB)
+	topicRole, err := trm.FindOne(tx, squirrel.Eq{"topic_roles.topic_id": topic.ID, "topic_roles.user_id": user.ID})
+	switch {
+	case err == nil && topicRole.Role == role:
+		return nil
+	case err != nil && err != sql.ErrNoRows:
+		return errors.Wrap(err, "find one error")
+	}
+
+	if err = trm.Set(tx, &models.TopicRole{TopicID: topic.ID, UserID: user.ID, Role: role}); err != nil {
+		return errors.Wrap(err, "set topic role error")
+	}
+
+	alm := models.NewAuditLogModel(a.DB)
+	entry := &models.AuditEntry{Action: models.AuditActionSetRole, Topic: topic, TargetType: models.AuditTargetUser,
+		TargetID: user.ID, Details: fmt.Sprintf("@%s role set to %s (from LTI launch)", user.Handle, role)}
+	err = alm.Add(tx, entry)
+	return errors.Wrap(err, "add audit entry error")
+}
+
+// findOrAddLTIUser gets the user linked to the launch's issuer and subject, adding them if this is their first launch.
+// Platforms can claim any email address, so launches are never linked to an existing account by email and new accounts
+// get a placeholder address that can't be used to log in or be made an admin.
+func findOrAddLTIUser(tx *sqlx.Tx, a *application.App, launch *lti.Launch) (*models.User, error) {
+	lm := models.NewLTIModel(a.DB)
+	um := models.NewUserModel(a.DB)
+
+	userID, err := lm.FindUserID(tx, launch.Issuer, launch.Subject)
+	if err == nil {
+		user, err := um.FindOne(tx, squirrel.Eq{"users.id": userID})
+		return user, errors.Wrap(err, "find one error")
+	}
+	if err != sql.ErrNoRows {
+		return nil, errors.Wrap(err, "find user id error")
+	}
+
+	if !a.Config.IsEmailAllowed(launch.Email) {
+		return nil, errSignUpNotAllowed
+	}
+
+	name := launch.DisplayName()
+	if name == "" && launch.Email != "" {
+		name = strings.Split(launch.Email, "@")[0]
+	}
+	if name == "" {
+		name = "User"
+	}
+
+	handle, err := um.SuggestHandle(tx, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "suggest handle error")
+	}
+
+	user := &models.User{Email: ltiUserEmail(launch.Issuer, launch.Subject), Handle: handle, Name: name}
+	if err = um.Add(tx, user); err != nil {
+		return nil, errors.Wrap(err, "add error")
+	}
+
+	err = lm.LinkUser(tx, launch.Issuer, launch.Subject, user.ID)
+	return user, errors.Wrap(err, "link user error")
+}
+
+// ltiUserEmail returns the placeholder email address of the user added for the platform's subject. It is under the
+// reserved .invalid domain so no one can log in with it.
+func ltiUserEmail(issuer, subject string) string {
+	sum := sha256.Sum256([]byte(issuer + "\n" + subject))
+	return hex.EncodeToString(sum[:12]) + "@lti.invalid"
+}
+
+// findOrAddLTITopic gets the topic for the launch. Links created by deep linking name their topic in a custom
+// parameter, otherwise the topic linked to the launch's context is used. The first instructor to launch from a context
+// that isn't linked creates a topic for it. Returns a nil topic if there is none, and true if the platform's roles
+// apply in the topic because it was created for the context.
+func findOrAddLTITopic(tx *sqlx.Tx, a *application.App, launch *lti.Launch, user *models.User,
+	role string) (*models.Topic, bool, error) {
+	lm := models.NewLTIModel(a.DB)
+	tm := models.NewTopicModel(a.DB)
+	hasContext := launch.Context != nil && launch.Context.ID != ""
+
+	if name := launch.Custom["topic"]; name != "" {
+		topic, err := tm.FindOne(tx, squirrel.Eq{"topics.name": strings.ToLower(name)})
+		if err != nil {
+			return nil, false, errors.Wrap(err, "find one error")
+		}
+
+		if !hasContext {
+			return topic, false, nil
+		}
+
+		ltiContext, err := lm.FindContext(tx, launch.Issuer, launch.Context.ID)
+		if err == nil {
+			return topic, ltiContext.TopicID == topic.ID && ltiContext.GrantsRoles, nil
+		}
+		if err != sql.ErrNoRows {
+			return nil, false, errors.Wrap(err, "find context error")
+		}
+
+		// custom parameters can be set by hand in most platforms, so only moderators of the topic may link it
+		isModerator, err := isTopicModerator(tx, a, user, topic)
+		if err != nil || !isModerator {
+			return topic, false, err
+		}
+
+		err = lm.LinkContext(tx, launch.Issuer, launch.Context.ID, &models.LTIContext{TopicID: topic.ID})
+		return topic, false, errors.Wrap(err, "link context error")
+	}
+
+	if !hasContext {
+		return nil, false, nil
+	}
+
+	ltiContext, err := lm.FindContext(tx, launch.Issuer, launch.Context.ID)
+	if err == nil {
+		topic, err := tm.FindOne(tx, squirrel.Eq{"topics.id": ltiContext.TopicID})
+		return topic, ltiContext.GrantsRoles, errors.Wrap(err, "find one error")
+	}
+	if err != sql.ErrNoRows {
+		return nil, false, errors.Wrap(err, "find context error")
+	}
+
+	// instructors adding a link may pick an existing topic, so a topic is only created when the link is first used
+	if launch.MessageType == lti.MessageTypeDeepLinking {
+		return nil, false, nil
+	}
+
+	if role != models.TopicRoleInstructor {
+		return nil, false, httperror.StatusError{http.StatusNotFound,
+			errors.New("This course has not been set up in uTeach yet, ask your instructor to open it first")}
+	}
+
+	title := launch.Context.Title
+	if title == "" {
+		title = launch.Context.Label
+	}
+	if title == "" {
+		title = "Course"
+	}
+
+	label := launch.Context.Label
+	if label == "" {
+		label = title
+	}
+
+	name, err := tm.SuggestName(tx, label)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "suggest name error")
+	}
+
+	topic := &models.Topic{Name: name, Title: title, Description: "Discussion for " + title}
+	if err = tm.Add(tx, topic); err != nil {
+		return nil, false, errors.Wrap(err, "add topic error")
+	}
+
+	if err = addTopicAuditEntry(tx, a, user, topic); err != nil {
+		return nil, false, err
+	}
+
+	err = lm.LinkContext(tx, launch.Issuer, launch.Context.ID, &models.LTIContext{TopicID: topic.ID, GrantsRoles: true})
+	return topic, true, errors.Wrap(err, "link context error")
+}
+
+// moderatedTopicWheres returns the conditions that limit topics to those the user moderates. Admins moderate all
+// topics so there are none for them.
+func moderatedTopicWheres(tx *sqlx.Tx, a *application.App, user *models.User) ([]squirrel.Sqlizer, error) {
+	if user.IsAdmin {
+		return nil, nil
+	}
+
+	trm := models.NewTopicRoleModel(a.DB)
+	topicRoles, err := trm.Find(tx, squirrel.Eq{"topic_roles.user_id": user.ID,
+		"topic_roles.role": []string{models.TopicRoleTA, models.TopicRoleInstructor}})
+	if err != nil {
+		return nil, errors.Wrap(err, "find topic roles error")
+	}
+
+	topicIDs := []int64{}
+	for _, topicRole := range topicRoles {
+		topicIDs = append(topicIDs, topicRole.TopicID)
+	}
+
+	// moderators of a topic moderate its sections too
+	tm := models.NewTopicModel(a.DB)
+	topicIDs, err = tm.WithSectionIDs(tx, topicIDs)
+	if err != nil {
+		return nil, errors.Wrap(err, "with section ids error")
+	}
+	return []squirrel.Sqlizer{squirrel.Eq{"topics.id": topicIDs}}, nil
+}
+
+// isTopicModerator returns true if the user is an admin or a TA or instructor in the topic or its parent.
+func isTopicModerator(tx *sqlx.Tx, a *application.App, user *models.User, topic *models.Topic) (bool, error) {
+	if user.IsAdmin {
+		return true, nil
+	}
+
+	trm := models.NewTopicRoleModel(a.DB)
+	topicRoles, err := trm.Find(tx, squirrel.Eq{"topic_roles.topic_id": topic.TopicIDs(),
+		"topic_roles.user_id": user.ID, "topic_roles.role": []string{models.TopicRoleTA, models.TopicRoleInstructor}})
+	if err != nil {
+		return false, errors.Wrap(err, "find topic roles error")
+	}
+	return len(topicRoles) > 0, nil
+}
+
+// renderLTIDeepLink shows the page where an instructor picks the topic to link to from their course.
+func renderLTIDeepLink(a *application.App, w http.ResponseWriter, r *http.Request, launch *lti.Launch,
+	user *models.User, topic *models.Topic) error {
+	deepLink := &ltiDeepLink{
+		Issuer:       launch.Platform.Issuer,
+		ClientID:     launch.Platform.ClientID,
+		DeploymentID: launch.DeploymentID,
+		Settings:     *launch.DeepLinkingSettings,
+		UserID:       user.ID,
+	}
+
+	encoded, err := securecookie.EncodeMulti(ltiDeepLinkName, deepLink, a.Store.Codecs...)
+	if err != nil {
+		return errors.Wrap(err, "encode error")
+	}
+
+	// only topics the user already moderates may be linked to their course
+	wheres, err := moderatedTopicWheres(nil, a, user)
+	if err != nil {
+		return err
+	}
+
+	tm := models.NewTopicModel(a.DB)
+	topics, err := tm.Find(nil, wheres...)
+	if err != nil {
+		return errors.Wrap(err, "find error")
+	}
+
+	data := context.TemplateData(r)
+	data["Topics"] = topics
+	data["SelectedTopic"] = topic
+	data["Context"] = launch.Context
+	data["DeepLink"] = encoded
+	err = libtemplate.Render(w, a.Templates, "lti_deep_link.html", data)
+	return errors.Wrap(err, "render template error")
+}
+
+// postLTIDeepLink returns the chosen topic to the platform as a link that launches straight into the topic.
+func postLTIDeepLink(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	deepLink := new(ltiDeepLink)
+	if err := securecookie.DecodeMulti(ltiDeepLinkName, r.FormValue("deep_link"), deepLink,
+		a.Store.Codecs...); err != nil {
+		return httperror.StatusError{http.StatusBadRequest, errors.New("Invalid deep linking request")}
+	}
+
+	user, _ := context.SessionUser(r)
+	if user.ID != deepLink.UserID {
+		return httperror.StatusError{http.StatusForbidden, nil}
+	}
+
+	if !deepLink.Settings.Accepts(lti.ContentItemTypeLTIResourceLink) {
+		return httperror.StatusError{http.StatusBadRequest,
+			errors.New("The LMS does not accept links to uTeach topics here")}
+	}
+
+	platform, ok := a.LTI.Platform(deepLink.Issuer, deepLink.ClientID)
+	if !ok {
+		return httperror.StatusError{http.StatusBadRequest, errors.New("Unknown LTI platform")}
+	}
+
+	// without a topic the link launches into the topic for the course, which is created by the first instructor to use it
+	item := lti.ContentItem{
+		Type:  lti.ContentItemTypeLTIResourceLink,
+		Title: "uTeach",
+		URL:   a.Config.LTIToolURL + "/lti/launch",
+	}
+
+	if name := r.FormValue("topic"); name != "" {
+		tm := models.NewTopicModel(a.DB)
+		topic, err := tm.FindOne(nil, squirrel.Eq{"topics.name": name})
+		if err != nil {
+			return errors.Wrap(err, "find one error")
+		}
+
+		isModerator, err := isTopicModerator(nil, a, user, topic)
+		if err != nil {
+			return err
+		}
+		if !isModerator {
+			return httperror.StatusError{http.StatusForbidden,
+				errors.New("You can only add topics you moderate to your course")}
+		}
+
+		item.Title = topic.Title
+		item.Text = topic.Description
+		item.Custom = map[string]string{"topic": topic.Name}
+	}
+
+	jwt, err := a.LTI.DeepLinkingResponse(platform, deepLink.DeploymentID, &deepLink.Settings, []lti.ContentItem{item})
+	if err != nil {
+		return errors.Wrap(err, "deep linking response error")
+	}
+
+	data := context.TemplateData(r)
+	data["ReturnURL"] = deepLink.Settings.ReturnURL
+	data["JWT"] = jwt
+	err = libtemplate.Render(w, a.Templates, "lti_deep_link_response.html", data)
+	return errors.Wrap(err, "render template error")
+}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/BrianHarringtonUTSC/uTeach/application"
+	"github.com/BrianHarringtonUTSC/uTeach/context"
+	"github.com/BrianHarringtonUTSC/uTeach/libtemplate"
+	"github.com/BrianHarringtonUTSC/uTeach/models"
+	"github.com/Masterminds/squirrel"
+	"github.com/pkg/errors"
+)
+
+// getNotifications shows the session user's notifications and marks them as read. Unread ones are still highlighted
+// on this visit.
+func getNotifications(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	user, _ := context.SessionUser(r)
+
+	nm := models.NewNotificationModel(a.DB)
+	notifications, err := nm.Find(nil, squirrel.Eq{"user_id": user.ID})
+	if err != nil {
+		return errors.Wrap(err, "find error")
+	}
+
+	if _, impersonating := context.Impersonation(r); !impersonating {
+		if err = nm.MarkAllRead(nil, user); err != nil {
+			return errors.Wrap(err, "mark all read error")
+		}
+	}
+
+	data := context.TemplateData(r)
+	data["Notifications"] = notifications
+	err = libtemplate.Render(w, a.Templates, "notifications.html", data)
+	return errors.Wrap(err, "render template error")
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/BrianHarringtonUTSC/uTeach/application"
+	"github.com/BrianHarringtonUTSC/uTeach/context"
+	"github.com/BrianHarringtonUTSC/uTeach/libtemplate"
+	"github.com/BrianHarringtonUTSC/uTeach/models"
+	"github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// getMovePost shows the forms to move the post to another topic and to cross-post it to other topics.
+func getMovePost(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	post := context.Post(r)
+
+	tm := models.NewTopicModel(a.DB)
+	topics, err := tm.Find(nil, squirrel.NotEq{"topics.id": post.Topic.ID})
+	if err != nil {
+		return errors.Wrap(err, "find error")
+	}
+
+	pm := models.NewPostModel(a.DB)
+	crossPostTopics, err := pm.CrossPostTopics(nil, post)
+	if err != nil {
+		return errors.Wrap(err, "cross-post topics error")
+	}
+
+	data := context.TemplateData(r)
+	data["Topics"] = topics
+	data["CrossPostTopics"] = crossPostTopics
+	err = libtemplate.Render(w, a.Templates, "move_post.html", data)
+	return errors.Wrap(err, "render template error")
+}
+
+// formTopic gets the topic named in the form.
+func formTopic(tx *sqlx.Tx, a *application.App, r *http.Request) (*models.Topic, error) {
+	tm := models.NewTopicModel(a.DB)
+	topic, err := tm.FindOne(tx, squirrel.Eq{"topics.name": strings.ToLower(r.FormValue("topic"))})
+	return topic, errors.Wrap(err, "find one error")
+}
+
+// postMovePost moves the post to the topic in the form. Tags that the topic has no tag with the same name for are
+// dropped and listed in the audit log.
+func postMovePost(a *application.App, w http.ResponseWriter, r *http.Request) (err error) {
+	post := context.Post(r)
+	user, _ := context.SessionUser(r)
+
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	topic, err := formTopic(tx, a, r)
+	if err != nil {
+		return err
+	}
+
+	oldTopic := post.Topic
+	pm := models.NewPostModel(a.DB)
+	dropped, err := pm.Move(tx, post, topic)
+	if err != nil {
+		return err
+	}
+
+	details := post.Title + " from " + oldTopic.Name + " to " + topic.Name
+	if len(dropped) > 0 {
+		var names []string
+		for _, tag := range dropped {
+			names = append(names, tag.Name)
+		}
+		details += ", dropped tags " + strings.Join(names, ", ")
+	}
+
+	alm := models.NewAuditLogModel(a.DB)
+	entry := &models.AuditEntry{Actor: user, Action: models.AuditActionMovePost, Topic: topic,
+		TargetType: models.AuditTargetPost, TargetID: post.ID, Details: details}
+	if err = alm.Add(tx, entry); err != nil {
+		return errors.Wrap(err, "add audit entry error")
+	}
+
+	http.Redirect(w, r, post.URL(), http.StatusFound)
+	return nil
+}
+
+// changeCrossPost adds or removes the cross-post of the post to the topic in the form and records it in the audit
+// log.
+func changeCrossPost(a *application.App, r *http.Request, action string) (err error) {
+	post := context.Post(r)
+	user, _ := context.SessionUser(r)
+
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	topic, err := formTopic(tx, a, r)
+	if err != nil {
+		return err
+	}
+
+	pm := models.NewPostModel(a.DB)
+	if action == models.AuditActionCrossPost {
+		err = pm.AddCrossPost(tx, post, topic)
+	} else {
+		err = pm.DeleteCrossPost(tx, post, topic)
+	}
+	if err != nil {
+		return err
+	}
+
+	alm := models.NewAuditLogModel(a.DB)
+	entry := &models.AuditEntry{Actor: user, Action: action, Topic: post.Topic, TargetType: models.AuditTargetPost,
+		TargetID: post.ID, Details: post.Title + " in " + topic.Name}
+	err = alm.Add(tx, entry)
+	return errors.Wrap(err, "add audit entry error")
+}
+
+func postCrossPost(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	if err := changeCrossPost(a, r, models.AuditActionCrossPost); err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, context.Post(r).URL()+"/move", http.StatusFound)
+	return nil
+}
+
+func deleteCrossPost(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	return changeCrossPost(a, r, models.AuditActionDeleteCrossPost)
+}
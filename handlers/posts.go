@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/BrianHarringtonUTSC/uTeach/application"
 	"github.com/BrianHarringtonUTSC/uTeach/context"
@@ -14,6 +15,9 @@ import (
 	"github.com/pkg/errors"
 )
 
+// formTimeLayout is the format of datetime-local inputs.
+const formTimeLayout = "2006-01-02T15:04"
+
 func addUserUpvotedPostIDsToData(r *http.Request, postModel *models.PostModel, data map[string]interface{}) error {
 	if user, ok := context.SessionUser(r); ok {
 		userUpvotedPostIDs, err := postModel.GetVotedPostIds(nil, squirrel.Eq{"post_votes.user_id": user.ID})
@@ -25,13 +29,70 @@ func addUserUpvotedPostIDsToData(r *http.Request, postModel *models.PostModel, d
 	return nil
 }
 
+// withPublishedPosts adds a where to wheres that leaves scheduled posts out of listings until they are published.
+// Admins see all posts and users see their own scheduled posts.
+func withPublishedPosts(r *http.Request, wheres ...squirrel.Sqlizer) []squirrel.Sqlizer {
+	user, ok := context.SessionUser(r)
+	switch {
+	case ok && user.IsAdmin:
+		return wheres
+	case ok:
+		return append(wheres, squirrel.Or{models.PublishedPosts, squirrel.Eq{"posts.creator_user_id": user.ID}})
+	default:
+		return append(wheres, models.PublishedPosts)
+	}
+}
+
+// parseFormTime parses a time from a datetime-local input in the server's time zone, which is what times are shown
+// in. It returns nil if the input is empty.
+func parseFormTime(r *http.Request, name string) (*time.Time, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return nil, nil
+	}
+
+	t, err := time.ParseInLocation(formTimeLayout, value, time.Local)
+	if err != nil {
+		return nil, httperror.StatusError{http.StatusBadRequest, errors.Errorf("Invalid time %q", value)}
+	}
+	return &t, nil
+}
+
+// getPosts shows the posts in the topic sorted by the sort in the query string or else the topic's default sort. Topics
+// with sections show the posts in all of their sections and sections also show their parent's pinned posts.
 func getPosts(a *application.App, w http.ResponseWriter, r *http.Request) error {
 	topic := context.Topic(r)
 
-	whereEq := squirrel.Eq{"posts.topic_id": topic.ID, "posts.is_pinned": true}
+	data := context.TemplateData(r)
+	settings, err := addTopicSettingsToData(a, r, data)
+	if err != nil {
+		return err
+	}
+
+	sort := r.URL.Query().Get("sort")
+	if !models.IsValidPostSort(sort) {
+		sort = settings.DefaultSort
+	}
+
+	tm := models.NewTopicModel(a.DB)
+	sections, err := tm.Find(nil, squirrel.Eq{"topics.parent_topic_id": topic.ID})
+	if err != nil {
+		return errors.Wrap(err, "find sections error")
+	}
+
+	pinnedWhere := models.InTopics(topic.TopicIDs()...)
+	where := models.InTopics(topic.ID)
+	if len(sections) > 0 {
+		topicIDs := []int64{topic.ID}
+		for _, section := range sections {
+			topicIDs = append(topicIDs, section.ID)
+		}
+		pinnedWhere = models.InTopics(topicIDs...)
+		where = pinnedWhere
+	}
 
 	pm := models.NewPostModel(a.DB)
-	pinnedPosts, err := pm.Find(nil, whereEq)
+	pinnedPosts, err := pm.FindSorted(nil, models.PostSortTop, withPublishedPosts(r, pinnedWhere, models.PinnedPosts)...)
 	switch {
 	case err == sql.ErrNoRows:
 		pinnedPosts = make([]*models.Post, 0)
@@ -39,8 +100,7 @@ func getPosts(a *application.App, w http.ResponseWriter, r *http.Request) error
 		return errors.Wrap(err, "find error")
 	}
 
-	whereEq["posts.is_pinned"] = false
-	unpinnedPosts, err := pm.Find(nil, whereEq)
+	unpinnedPosts, err := pm.FindSorted(nil, sort, withPublishedPosts(r, where, models.UnpinnedPosts)...)
 	switch {
 	case err == sql.ErrNoRows:
 		unpinnedPosts = make([]*models.Post, 0)
@@ -49,46 +109,149 @@ func getPosts(a *application.App, w http.ResponseWriter, r *http.Request) error
 	}
 
 	tagModel := models.NewTagModel(a.DB)
-	tags, err := tagModel.Find(nil, squirrel.Eq{"tags.topic_id": topic.ID})
+	tags, err := tagModel.Find(nil, squirrel.Eq{"tags.topic_id": topic.TopicIDs()})
 	if err != nil {
 		return errors.Wrap(err, "find error")
 	}
 
-	data := context.TemplateData(r)
+	if err = tagModel.FindForPosts(nil, append(pinnedPosts, unpinnedPosts...)); err != nil {
+		return errors.Wrap(err, "find tags for posts error")
+	}
+
 	data["PinnedPosts"] = pinnedPosts
 	data["UnpinnedPosts"] = unpinnedPosts
 	data["Tags"] = tags
+	data["Sections"] = sections
+	data["Sort"] = sort
 
 	if err = addUserUpvotedPostIDsToData(r, pm, data); err != nil {
 		return errors.Wrap(err, "add upvoted post ids to data error")
 	}
 
+	if user, ok := context.SessionUser(r); ok {
+		sm := models.NewSubscriptionModel(a.DB)
+		subscriptions, err := sm.Find(nil, squirrel.Eq{"user_id": user.ID, "topic_id": topic.ID})
+		if err != nil {
+			return errors.Wrap(err, "find subscription error")
+		}
+		data["IsSubscribed"] = len(subscriptions) > 0
+	}
+
+	if err = markTopicRead(a, r); err != nil {
+		return err
+	}
+
 	return libtemplate.Render(w, a.Templates, "posts.html", data)
 }
 
 func getPost(a *application.App, w http.ResponseWriter, r *http.Request) error {
-	return libtemplate.Render(w, a.Templates, "post.html", context.TemplateData(r))
+	post := context.Post(r)
+	tm := models.NewTagModel(a.DB)
+	if err := tm.FindForPosts(nil, []*models.Post{post}); err != nil {
+		return errors.Wrap(err, "find tags for post error")
+	}
+
+	fields, err := findTopicFields(a, context.Topic(r))
+	if err != nil {
+		return err
+	}
+
+	fm := models.NewFieldModel(a.DB)
+	if err = fm.FindForPosts(nil, []*models.Post{post}); err != nil {
+		return errors.Wrap(err, "find field values for post error")
+	}
+
+	data := context.TemplateData(r)
+	if canViewAttachments(r, post) {
+		am := models.NewAttachmentModel(a.DB)
+		attachments, err := am.Find(nil, squirrel.Eq{"post_attachments.post_id": post.ID})
+		if err != nil {
+			return errors.Wrap(err, "find attachments error")
+		}
+		data["Attachments"] = attachments
+	}
+
+	data["Fields"] = fields
+	data["ReportReasons"] = models.ReportReasons
+	addAttachmentLimitsToData(a, data)
+	return libtemplate.Render(w, a.Templates, "post.html", data)
 }
 
 func getNewPost(a *application.App, w http.ResponseWriter, r *http.Request) error {
 	topic := context.Topic(r)
 
 	tm := models.NewTagModel(a.DB)
-	tags, err := tm.Find(nil, squirrel.Eq{"tags.topic_id": topic.ID})
+	tags, err := tm.Find(nil, squirrel.Eq{"tags.topic_id": topic.TopicIDs()})
 	if err != nil {
 		return errors.Wrap(err, "find error")
 	}
 
+	fields, err := findTopicFields(a, topic)
+	if err != nil {
+		return err
+	}
+
 	data := context.TemplateData(r)
 	data["Tags"] = tags
+	data["Fields"] = fields
+	addAttachmentLimitsToData(a, data)
+	if _, err = addTopicSettingsToData(a, r, data); err != nil {
+		return err
+	}
+	if canPost, _ := data["CanPost"].(bool); !canPost {
+		return httperror.StatusError{http.StatusForbidden, nil}
+	}
 	return libtemplate.Render(w, a.Templates, "new_post.html", data)
 }
 
+// postNewPost adds a post to the topic if the topic's settings let the session user post in it.
 func postNewPost(a *application.App, w http.ResponseWriter, r *http.Request) (err error) {
+	if err = parseAttachmentForm(a, w, r); err != nil {
+		return err
+	}
+
 	title := r.FormValue("title")
 	text := r.FormValue("text")
 	topic := context.Topic(r)
 	user, _ := context.SessionUser(r)
+	role, _ := context.TopicRole(r)
+
+	tsm := models.NewTopicSettingsModel(a.DB)
+	settings, err := tsm.Get(nil, topic)
+	if err != nil {
+		return errors.Wrap(err, "get topic settings error")
+	}
+
+	if !settings.CanPost(user, role) {
+		return httperror.StatusError{http.StatusForbidden, errors.New("Only " + settings.WhoCanPost + " can post in this topic")}
+	}
+
+	if settings.RequireTag && r.FormValue("tag") == "" {
+		return models.InputError{"Posts in this topic need a tag"}
+	}
+
+	fieldValues, err := formFieldValues(r)
+	if err != nil {
+		return err
+	}
+
+	post := &models.Post{Title: title, Content: text, Topic: topic, Creator: user, FieldValues: fieldValues,
+		IsAnonymous: settings.AllowAnonymous && r.FormValue("anonymous") == "on"}
+	post.PublishAt, err = parseFormTime(r, "publish_at")
+	if err != nil {
+		return err
+	}
+	if post.PublishAt != nil && !post.PublishAt.After(time.Now()) {
+		post.PublishAt = nil
+	}
+
+	// only admins can pin, e.g. an announcement for the week it matters
+	if user.IsAdmin {
+		if post.PinnedUntil, err = parsePinnedUntil(r); err != nil {
+			return err
+		}
+		post.IsPinned = post.PinnedUntil != nil
+	}
 
 	// we want the post and tags to be created together so use one tx. If one part fails the rest won't be committed.
 	tx, err := a.DB.Beginx()
@@ -96,21 +259,38 @@ func postNewPost(a *application.App, w http.ResponseWriter, r *http.Request) (er
 		return errors.Wrap(err, "begin transacion error")
 	}
 
+	// attached files are stored as they are added so they need to be deleted if the post isn't
+	var attachments []*models.Attachment
 	defer func() {
 		if err != nil {
 			tx.Rollback()
+			deleteAttachmentFiles(a, attachments)
 			return
 		}
-		err = tx.Commit()
+		if err = tx.Commit(); err != nil {
+			deleteAttachmentFiles(a, attachments)
+		}
 		err = errors.Wrap(err, "commit error")
 	}()
 
 	postModel := models.NewPostModel(a.DB)
-	post := &models.Post{Title: title, Content: text, Topic: topic, Creator: user}
+	if post.Approval, err = newPostApproval(tx, a, r); err != nil {
+		return err
+	}
+
 	if err = postModel.Add(tx, post); err != nil {
 		return errors.Wrap(err, "add post error")
 	}
 
+	if post.IsPinned {
+		alm := models.NewAuditLogModel(a.DB)
+		entry := &models.AuditEntry{Actor: user, Action: models.AuditActionPinPost, Topic: post.Topic,
+			TargetType: models.AuditTargetPost, TargetID: post.ID, Details: pinDetails(post)}
+		if err = alm.Add(tx, entry); err != nil {
+			return errors.Wrap(err, "add audit entry error")
+		}
+	}
+
 	tagIDStr := r.FormValue("tag")
 	if tagIDStr != "" {
 		tagID, err := strconv.ParseInt(tagIDStr, 10, 64)
@@ -119,7 +299,7 @@ func postNewPost(a *application.App, w http.ResponseWriter, r *http.Request) (er
 		}
 
 		tagModel := models.NewTagModel(a.DB)
-		tag, err := tagModel.FindOne(nil, squirrel.Eq{"tags.id": tagID})
+		tag, err := tagModel.FindOne(nil, squirrel.Eq{"tags.id": tagID, "tags.topic_id": topic.TopicIDs()})
 		if err != nil {
 			return errors.Wrap(err, "find one error")
 		}
@@ -129,40 +309,132 @@ func postNewPost(a *application.App, w http.ResponseWriter, r *http.Request) (er
 		}
 	}
 
+	if attachments, err = addAttachments(tx, a, r, post); err != nil {
+		return err
+	}
+
 	http.Redirect(w, r, post.URL(), http.StatusFound)
 	return nil
 }
 
-func postHidePost(a *application.App, w http.ResponseWriter, r *http.Request) error {
-	pm := models.NewPostModel(a.DB)
+// updatePostAudited changes the post with update and records the change in the audit log in one tx.
+func updatePostAudited(a *application.App, r *http.Request, action string, update func(post *models.Post)) (err error) {
 	post := context.Post(r)
-	post.IsVisible = false
-	err := pm.Update(nil, post)
-	return errors.Wrap(err, "update error")
+	user, _ := context.SessionUser(r)
+
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	update(post)
+	pm := models.NewPostModel(a.DB)
+	if err = pm.Update(tx, post); err != nil {
+		return errors.Wrap(err, "update error")
+	}
+
+	details := post.Title
+	if action == models.AuditActionPinPost {
+		details = pinDetails(post)
+	}
+
+	alm := models.NewAuditLogModel(a.DB)
+	entry := &models.AuditEntry{Actor: user, Action: action, Topic: post.Topic, TargetType: models.AuditTargetPost,
+		TargetID: post.ID, Details: details}
+	err = alm.Add(tx, entry)
+	return errors.Wrap(err, "add audit entry error")
+}
+
+// parsePinnedUntil gets the optional time a pin expires from the form.
+func parsePinnedUntil(r *http.Request) (*time.Time, error) {
+	pinnedUntil, err := parseFormTime(r, "pinned_until")
+	if err == nil && pinnedUntil != nil && !pinnedUntil.After(time.Now()) {
+		return nil, httperror.StatusError{http.StatusBadRequest, errors.New("Pins must end in the future")}
+	}
+	return pinnedUntil, err
 }
 
+// pinDetails describes a pinned post for the audit log.
+func pinDetails(post *models.Post) string {
+	if post.PinnedUntil == nil {
+		return post.Title
+	}
+	return post.Title + " (until " + libtemplate.FormatAndLocalizeTime(*post.PinnedUntil) + ")"
+}
+
+func postHidePost(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	user, _ := context.SessionUser(r)
+	hiddenBy := models.PostHiddenByModerator
+	if user.ID == context.Post(r).Creator.ID {
+		hiddenBy = models.PostHiddenByCreator
+	}
+
+	return updatePostAudited(a, r, models.AuditActionHidePost, func(post *models.Post) {
+		// hiding an already hidden post mustn't let its creator unhide it
+		if post.IsVisible {
+			post.IsVisible, post.HiddenBy = false, hiddenBy
+		}
+	})
+}
+
+// deleteHidePost unhides the post. Creators can only unhide posts they hid themselves, posts hidden by a filter rule,
+// reports or a moderator stay hidden until a moderator unhides them.
 func deleteHidePost(a *application.App, w http.ResponseWriter, r *http.Request) error {
-	pm := models.NewPostModel(a.DB)
+	user, _ := context.SessionUser(r)
 	post := context.Post(r)
-	post.IsVisible = true
-	err := pm.Update(nil, post)
-	return errors.Wrap(err, "update error")
+	if !user.IsAdmin && post.Approval != "" && post.Approval != models.PostApprovalApproved {
+		return httperror.StatusError{http.StatusForbidden, errors.New("This post needs a moderator's approval")}
+	}
+
+	topicRole, ok := context.TopicRole(r)
+	isModerator := user.IsAdmin || (ok && topicRole.IsModerator())
+	if !isModerator && !post.IsVisible && !post.IsHiddenByCreator() {
+		return httperror.StatusError{http.StatusForbidden, errors.New("This post was hidden by a moderator")}
+	}
+
+	return updatePostAudited(a, r, models.AuditActionUnhidePost, func(post *models.Post) { post.IsVisible = true })
 }
 
+// postPinPost pins the post, until pinned_until if it is in the form. Pinning until a time is done with a form on the
+// post's page so it redirects back to the post.
 func postPinPost(a *application.App, w http.ResponseWriter, r *http.Request) error {
-	pm := models.NewPostModel(a.DB)
-	post := context.Post(r)
-	post.IsPinned = true
-	err := pm.Update(nil, post)
-	return errors.Wrap(err, "update error")
+	pinnedUntil, err := parsePinnedUntil(r)
+	if err != nil {
+		return err
+	}
+
+	err = updatePostAudited(a, r, models.AuditActionPinPost, func(post *models.Post) {
+		post.IsPinned, post.PinnedUntil = true, pinnedUntil
+	})
+	if err != nil || pinnedUntil == nil {
+		return err
+	}
+
+	http.Redirect(w, r, context.Post(r).URL(), http.StatusFound)
+	return nil
 }
 
 func deletePinPost(a *application.App, w http.ResponseWriter, r *http.Request) error {
-	pm := models.NewPostModel(a.DB)
-	post := context.Post(r)
-	post.IsPinned = false
-	err := pm.Update(nil, post)
-	return errors.Wrap(err, "update error")
+	return updatePostAudited(a, r, models.AuditActionUnpinPost, func(post *models.Post) {
+		post.IsPinned, post.PinnedUntil = false, nil
+	})
+}
+
+func postLockPost(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	return updatePostAudited(a, r, models.AuditActionLockPost, func(post *models.Post) { post.IsLocked = true })
+}
+
+func deleteLockPost(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	return updatePostAudited(a, r, models.AuditActionUnlockPost, func(post *models.Post) { post.IsLocked = false })
 }
 
 func updatePostVote(a *application.App, w http.ResponseWriter, r *http.Request, voted bool) error {
@@ -189,11 +461,16 @@ func getPostsByTag(a *application.App, w http.ResponseWriter, r *http.Request) e
 	tag := context.Tag(r)
 
 	pm := models.NewPostModel(a.DB)
-	posts, err := pm.Find(nil, squirrel.Eq{"post_tags.tag_id": tag.ID})
+	posts, err := pm.Find(nil, withPublishedPosts(r, squirrel.Eq{"post_tags.tag_id": tag.ID})...)
 	if err != nil {
 		return errors.Wrap(err, "find error")
 	}
 
+	tm := models.NewTagModel(a.DB)
+	if err = tm.FindForPosts(nil, posts); err != nil {
+		return errors.Wrap(err, "find tags for posts error")
+	}
+
 	data := context.TemplateData(r)
 	data["Posts"] = posts
 	if err = addUserUpvotedPostIDsToData(r, pm, data); err != nil {
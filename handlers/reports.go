@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/BrianHarringtonUTSC/uTeach/application"
+	"github.com/BrianHarringtonUTSC/uTeach/context"
+	"github.com/BrianHarringtonUTSC/uTeach/httperror"
+	"github.com/BrianHarringtonUTSC/uTeach/libtemplate"
+	"github.com/BrianHarringtonUTSC/uTeach/models"
+	"github.com/Masterminds/squirrel"
+	"github.com/pkg/errors"
+)
+
+// defaultReportSuspensionDays is how long authors are suspended for from the moderation queue.
+const defaultReportSuspensionDays = 7
+
+// reportedPost is a post in the moderation queue with its open reports.
+type reportedPost struct {
+	Post    *models.Post
+	Reports []*models.Report
+}
+
+func postReportPost(a *application.App, w http.ResponseWriter, r *http.Request) (err error) {
+	post := context.Post(r)
+	user, _ := context.SessionUser(r)
+	if post.Creator.ID == user.ID {
+		return httperror.StatusError{http.StatusBadRequest, errors.New("You cannot report your own post")}
+	}
+
+	// the report and auto hiding should happen together so use one tx
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	rm := models.NewReportModel(a.DB)
+	report := &models.Report{PostID: post.ID, Reporter: user, Reason: r.FormValue("reason"), Details: r.FormValue("details")}
+	if err = rm.Add(tx, report); err != nil {
+		return err
+	}
+
+	threshold := a.Config.ReportAutoHideThreshold
+	if threshold > 0 && post.IsVisible {
+		count, err := rm.CountReporters(tx, post.ID)
+		if err != nil {
+			return errors.Wrap(err, "count reporters error")
+		}
+
+		if count >= threshold {
+			// hidden until a moderator reviews the reports
+			pm := models.NewPostModel(a.DB)
+			post.IsVisible, post.HiddenBy = false, models.PostHiddenByReports
+			if err = pm.Update(tx, post); err != nil {
+				return errors.Wrap(err, "update error")
+			}
+
+			alm := models.NewAuditLogModel(a.DB)
+			entry := &models.AuditEntry{Action: models.AuditActionHidePost, Topic: post.Topic,
+				TargetType: models.AuditTargetPost, TargetID: post.ID,
+				Details: fmt.Sprintf("%s (reported by %d users)", post.Title, count)}
+			if err = alm.Add(tx, entry); err != nil {
+				return errors.Wrap(err, "add audit entry error")
+			}
+		}
+	}
+
+	http.Redirect(w, r, post.URL(), http.StatusFound)
+	return nil
+}
+
+// moderatedTopic is a topic on the moderation page with its number of posts waiting for approval.
+type moderatedTopic struct {
+	Topic        *models.Topic
+	PendingCount int
+}
+
+func getModeration(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	user, _ := context.SessionUser(r)
+
+	wheres := []squirrel.Sqlizer{squirrel.Eq{"reports.resolved_at": nil}}
+	pendingWheres := []squirrel.Sqlizer{squirrel.Eq{"posts.approval": models.PostApprovalPending}}
+	var topicWheres []squirrel.Sqlizer
+	if !user.IsAdmin {
+		// moderators only see reports in the topics they moderate
+		trm := models.NewTopicRoleModel(a.DB)
+		topicRoles, err := trm.Find(nil, squirrel.Eq{"topic_roles.user_id": user.ID,
+			"topic_roles.role": []string{models.TopicRoleTA, models.TopicRoleInstructor}})
+		if err != nil {
+			return errors.Wrap(err, "find topic roles error")
+		}
+
+		if len(topicRoles) == 0 {
+			return httperror.StatusError{http.StatusForbidden, nil}
+		}
+
+		var topicIDs []int64
+		for _, topicRole := range topicRoles {
+			topicIDs = append(topicIDs, topicRole.TopicID)
+		}
+
+		// moderators of a topic moderate its sections too
+		tm := models.NewTopicModel(a.DB)
+		topicIDs, err = tm.WithSectionIDs(nil, topicIDs)
+		if err != nil {
+			return errors.Wrap(err, "with section ids error")
+		}
+		wheres = append(wheres, squirrel.Eq{"posts.topic_id": topicIDs})
+		pendingWheres = append(pendingWheres, squirrel.Eq{"posts.topic_id": topicIDs})
+		topicWheres = append(topicWheres, squirrel.Eq{"topics.id": topicIDs})
+	}
+
+	rm := models.NewReportModel(a.DB)
+	reports, err := rm.Find(nil, wheres...)
+	if err != nil {
+		return errors.Wrap(err, "find reports error")
+	}
+
+	reportedPosts, err := groupReportsByPost(a, reports)
+	if err != nil {
+		return err
+	}
+
+	pm := models.NewPostModel(a.DB)
+	posts, err := pm.Find(nil, pendingWheres...)
+	if err != nil {
+		return errors.Wrap(err, "find pending posts error")
+	}
+
+	// posts are listed once per tag so skip the ones already seen
+	pendingCounts := make(map[int64]int)
+	seen := make(map[int64]bool)
+	var pendingPosts []*models.Post
+	for _, post := range posts {
+		if !seen[post.ID] {
+			pendingPosts = append(pendingPosts, post)
+			pendingCounts[post.Topic.ID]++
+		}
+		seen[post.ID] = true
+	}
+
+	tm := models.NewTopicModel(a.DB)
+	topics, err := tm.Find(nil, topicWheres...)
+	if err != nil {
+		return errors.Wrap(err, "find topics error")
+	}
+
+	var moderatedTopics []*moderatedTopic
+	for _, topic := range topics {
+		moderatedTopics = append(moderatedTopics, &moderatedTopic{topic, pendingCounts[topic.ID]})
+	}
+
+	data := context.TemplateData(r)
+	data["ReportedPosts"] = reportedPosts
+	data["PendingPosts"] = pendingPosts
+	data["ModeratedTopics"] = moderatedTopics
+	data["DefaultSuspensionDays"] = defaultReportSuspensionDays
+	err = libtemplate.Render(w, a.Templates, "moderation.html", data)
+	return errors.Wrap(err, "render template error")
+}
+
+// groupReportsByPost groups the reports under their posts, most reported posts first.
+func groupReportsByPost(a *application.App, reports []*models.Report) ([]*reportedPost, error) {
+	byPostID := make(map[int64]*reportedPost)
+	var postIDs []int64
+	for _, report := range reports {
+		if _, ok := byPostID[report.PostID]; !ok {
+			byPostID[report.PostID] = new(reportedPost)
+			postIDs = append(postIDs, report.PostID)
+		}
+		byPostID[report.PostID].Reports = append(byPostID[report.PostID].Reports, report)
+	}
+
+	if len(postIDs) == 0 {
+		return nil, nil
+	}
+
+	pm := models.NewPostModel(a.DB)
+	posts, err := pm.Find(nil, squirrel.Eq{"posts.id": postIDs})
+	if err != nil {
+		return nil, errors.Wrap(err, "find posts error")
+	}
+
+	for _, post := range posts {
+		byPostID[post.ID].Post = post
+	}
+
+	var reportedPosts []*reportedPost
+	for _, postID := range postIDs {
+		reportedPosts = append(reportedPosts, byPostID[postID])
+	}
+
+	sort.Stable(byReportCount(reportedPosts))
+	return reportedPosts, nil
+}
+
+// byReportCount sorts reported posts by their number of reports, most first.
+type byReportCount []*reportedPost
+
+func (b byReportCount) Len() int           { return len(b) }
+func (b byReportCount) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byReportCount) Less(i, j int) bool { return len(b[i].Reports) > len(b[j].Reports) }
+
+// postResolveReports resolves the open reports on a post by hiding it, dismissing the reports or hiding it and
+// suspending its author. Dismissing shows the post again in case it was hidden automatically. Suspensions apply site
+// wide so only admins can suspend, and never admins or moderators of the topic.
+func postResolveReports(a *application.App, w http.ResponseWriter, r *http.Request) (err error) {
+	post := context.Post(r)
+	moderator, _ := context.SessionUser(r)
+	resolution := r.FormValue("resolution")
+
+	if resolution == models.ReportResolutionSuspended {
+		if !moderator.IsAdmin {
+			return httperror.StatusError{http.StatusForbidden, errors.New("Only admins can suspend users")}
+		}
+
+		isModerator, err := isTopicModerator(nil, a, post.Creator, context.Topic(r))
+		if err != nil {
+			return err
+		}
+		if isModerator {
+			return httperror.StatusError{http.StatusForbidden,
+				errors.New("Admins and moderators of the topic can't be suspended")}
+		}
+	}
+
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	rm := models.NewReportModel(a.DB)
+	if err = rm.Resolve(tx, post.ID, moderator, resolution); err != nil {
+		return err
+	}
+
+	if resolution == models.ReportResolutionSuspended {
+		days, err := strconv.Atoi(r.FormValue("days"))
+		if err != nil || days < 1 || days > maxSuspensionDays {
+			return httperror.StatusError{http.StatusBadRequest, errors.New("Suspensions must be 1 to 365 days")}
+		}
+
+		until := time.Now().UTC().AddDate(0, 0, days)
+		suspension := &models.Suspension{
+			User:           post.Creator,
+			Actor:          moderator,
+			Action:         models.SuspensionActionSuspend,
+			Reason:         "Reported post: " + post.Title,
+			SuspendedUntil: &until,
+		}
+		if err = applySuspension(tx, a, suspension); err != nil {
+			return err
+		}
+	}
+
+	isVisible := resolution == models.ReportResolutionDismissed
+	if post.IsVisible != isVisible {
+		pm := models.NewPostModel(a.DB)
+		post.IsVisible, post.HiddenBy = isVisible, models.PostHiddenByModerator
+		if err = pm.Update(tx, post); err != nil {
+			return errors.Wrap(err, "update error")
+		}
+
+		action := models.AuditActionHidePost
+		if isVisible {
+			action = models.AuditActionUnhidePost
+		}
+
+		alm := models.NewAuditLogModel(a.DB)
+		entry := &models.AuditEntry{Actor: moderator, Action: action, Topic: post.Topic,
+			TargetType: models.AuditTargetPost, TargetID: post.ID, Details: post.Title + " (reports " + resolution + ")"}
+		if err = alm.Add(tx, entry); err != nil {
+			return errors.Wrap(err, "add audit entry error")
+		}
+	}
+
+	http.Redirect(w, r, "/moderation", http.StatusFound)
+	return nil
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/BrianHarringtonUTSC/uTeach/application"
+	"github.com/BrianHarringtonUTSC/uTeach/context"
+	"github.com/BrianHarringtonUTSC/uTeach/httperror"
+	"github.com/BrianHarringtonUTSC/uTeach/libtemplate"
+	"github.com/BrianHarringtonUTSC/uTeach/models"
+	"github.com/BrianHarringtonUTSC/uTeach/session"
+	"github.com/Masterminds/squirrel"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+func getSessions(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	user, _ := context.SessionUser(r)
+
+	sm := models.NewSessionModel(a.DB)
+	allSessions, err := sm.Find(nil, squirrel.Eq{"sessions.user_id": user.ID})
+	if err != nil {
+		return errors.Wrap(err, "find error")
+	}
+
+	var sessions []*models.Session
+	for _, s := range allSessions {
+		if !a.Store.IsExpired(s) {
+			sessions = append(sessions, s)
+		}
+	}
+
+	us := session.NewUserSession(a.Store)
+	currentToken, _ := us.Token(r)
+
+	data := context.TemplateData(r)
+	data["Sessions"] = sessions
+	data["CurrentToken"] = currentToken
+	err = libtemplate.Render(w, a.Templates, "sessions.html", data)
+	return errors.Wrap(err, "render template error")
+}
+
+func deleteSession(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	user, _ := context.SessionUser(r)
+
+	sessionID, err := strconv.ParseInt(mux.Vars(r)["sessionID"], 10, 64)
+	if err != nil {
+		return httperror.StatusError{http.StatusBadRequest, err}
+	}
+
+	// users can only revoke their own sessions
+	sm := models.NewSessionModel(a.DB)
+	err = sm.Delete(nil, squirrel.Eq{"sessions.id": sessionID, "sessions.user_id": user.ID})
+	return errors.Wrap(err, "delete error")
+}
+
+func deleteUserSessions(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	user, err := findUserByHandleVar(a, r)
+	if err != nil {
+		return err
+	}
+
+	sm := models.NewSessionModel(a.DB)
+	err = sm.Delete(nil, squirrel.Eq{"sessions.user_id": user.ID})
+	return errors.Wrap(err, "delete error")
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BrianHarringtonUTSC/uTeach/application"
+	"github.com/BrianHarringtonUTSC/uTeach/context"
+	"github.com/BrianHarringtonUTSC/uTeach/httperror"
+	"github.com/BrianHarringtonUTSC/uTeach/libtemplate"
+	"github.com/BrianHarringtonUTSC/uTeach/models"
+	"github.com/Masterminds/squirrel"
+	"github.com/pkg/errors"
+)
+
+// statsDateFormat is the format of the from and to dates of topic stats.
+const statsDateFormat = "2006-01-02"
+
+// statsDays is the number of days topic stats cover by default, ending today.
+const statsDays = 30
+
+// findTopicStats computes the stats of the topic in the context and its sections over the date range (inclusive, in
+// UTC) in the query string, the last statsDays days by default.
+func findTopicStats(a *application.App, r *http.Request) (*models.TopicStats, error) {
+	topic := context.Topic(r)
+
+	to := time.Now().UTC()
+	if value := r.FormValue("to"); value != "" {
+		t, err := time.Parse(statsDateFormat, value)
+		if err != nil {
+			return nil, httperror.StatusError{http.StatusBadRequest, errors.New("Dates must be formatted YYYY-MM-DD")}
+		}
+		to = t
+	}
+
+	from := to.AddDate(0, 0, 1-statsDays)
+	if value := r.FormValue("from"); value != "" {
+		t, err := time.Parse(statsDateFormat, value)
+		if err != nil {
+			return nil, httperror.StatusError{http.StatusBadRequest, errors.New("Dates must be formatted YYYY-MM-DD")}
+		}
+		from = t
+	}
+
+	if from.After(to) {
+		return nil, httperror.StatusError{http.StatusBadRequest, errors.New("The from date must not be after the to date")}
+	}
+
+	tm := models.NewTopicModel(a.DB)
+	sections, err := tm.Find(nil, squirrel.Eq{"topics.parent_topic_id": topic.ID})
+	if err != nil {
+		return nil, errors.Wrap(err, "find sections error")
+	}
+
+	topicIDs := []int64{topic.ID}
+	for _, section := range sections {
+		topicIDs = append(topicIDs, section.ID)
+	}
+
+	sm := models.NewStatsModel(a.DB)
+	stats, err := sm.Get(nil, topicIDs, from, to)
+	return stats, errors.Wrap(err, "get stats error")
+}
+
+// getTopicStats shows how active the topic is, e.g. posts per day, the most active users and top tags.
+func getTopicStats(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	stats, err := findTopicStats(a, r)
+	if err != nil {
+		return err
+	}
+
+	maxDayPosts := 0
+	for _, day := range stats.Days {
+		if day.Posts > maxDayPosts {
+			maxDayPosts = day.Posts
+		}
+	}
+
+	data := context.TemplateData(r)
+	data["Stats"] = stats
+	data["MaxDayPosts"] = maxDayPosts
+	data["From"] = stats.From.Format(statsDateFormat)
+	data["To"] = stats.To.Format(statsDateFormat)
+	data["CSVURL"] = context.Topic(r).URL() + "/stats.csv?" + r.URL.RawQuery
+	err = libtemplate.Render(w, a.Templates, "stats.html", data)
+	return errors.Wrap(err, "render template error")
+}
+
+// getTopicStatsCSV downloads the topic's stats with one row per day, user, tag and number of votes. Each row starts
+// with which of those it is.
+func getTopicStatsCSV(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	stats, err := findTopicStats(a, r)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+strings.Replace(context.Topic(r).Name, "/", "_", -1)+`_stats.csv"`)
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"kind", "name", "posts", "votes", "unvoted"})
+	for _, day := range stats.Days {
+		cw.Write([]string{"day", day.Day, strconv.Itoa(day.Posts), strconv.Itoa(day.Votes), strconv.Itoa(day.Unvoted)})
+	}
+	for _, user := range stats.Users {
+		cw.Write([]string{"user", user.Handle, strconv.Itoa(user.Posts), strconv.Itoa(user.Votes), ""})
+	}
+	for _, tag := range stats.Tags {
+		cw.Write([]string{"tag", tag.Name, strconv.Itoa(tag.Posts), "", ""})
+	}
+	for _, votes := range stats.VoteDistribution {
+		cw.Write([]string{"votes", strconv.Itoa(votes.Votes), strconv.Itoa(votes.Posts), "", ""})
+	}
+	cw.Flush()
+	return errors.Wrap(cw.Error(), "write csv error")
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/BrianHarringtonUTSC/uTeach/application"
+	"github.com/BrianHarringtonUTSC/uTeach/context"
+	"github.com/BrianHarringtonUTSC/uTeach/models"
+	"github.com/Masterminds/squirrel"
+	"github.com/pkg/errors"
+)
+
+// feedPinnedPosts and feedRecentPosts are how many pinned and recent posts are shown in the home feed.
+const (
+	feedPinnedPosts = 10
+	feedRecentPosts = 30
+)
+
+// addFeedToData adds the session user's subscribed topics, unread counts and home feed to the data. The feed has the
+// pinned and most recent posts across the subscribed topics, leaving out posts with muted tags.
+func addFeedToData(a *application.App, r *http.Request, data map[string]interface{}) error {
+	user, ok := context.SessionUser(r)
+	if !ok {
+		return nil
+	}
+
+	sm := models.NewSubscriptionModel(a.DB)
+	subscriptions, err := sm.Find(nil, squirrel.Eq{"user_id": user.ID})
+	if err != nil {
+		return errors.Wrap(err, "find subscriptions error")
+	}
+
+	unreadCounts, err := sm.CountUnread(nil, user)
+	if err != nil {
+		return errors.Wrap(err, "count unread error")
+	}
+
+	mutedTags, err := sm.MutedTags(nil, user)
+	if err != nil {
+		return errors.Wrap(err, "muted tags error")
+	}
+
+	subscribed := make(map[int64]bool)
+	var topicIDs []int64
+	for _, subscription := range subscriptions {
+		subscribed[subscription.TopicID] = true
+		topicIDs = append(topicIDs, subscription.TopicID)
+	}
+
+	data["SubscribedTopics"] = subscribed
+	data["UnreadCounts"] = unreadCounts
+	if len(topicIDs) == 0 {
+		return nil
+	}
+
+	pm := models.NewPostModel(a.DB)
+	wheres := withPublishedPosts(r, models.InTopics(topicIDs...), &models.TagFilter{Not: mutedTags})
+	pinnedPosts, err := pm.FindPage(nil, models.PostSortNew, feedPinnedPosts, 0, append(wheres, models.PinnedPosts)...)
+	if err != nil {
+		return errors.Wrap(err, "find pinned posts error")
+	}
+
+	recentPosts, err := pm.FindPage(nil, models.PostSortNew, feedRecentPosts, 0, append(wheres, models.UnpinnedPosts)...)
+	if err != nil {
+		return errors.Wrap(err, "find recent posts error")
+	}
+
+	tm := models.NewTagModel(a.DB)
+	if err = tm.FindForPosts(nil, append(pinnedPosts, recentPosts...)); err != nil {
+		return errors.Wrap(err, "find tags for posts error")
+	}
+
+	data["FeedPinnedPosts"] = pinnedPosts
+	data["FeedRecentPosts"] = recentPosts
+	return addUserUpvotedPostIDsToData(r, pm, data)
+}
+
+// markTopicRead marks the topic in the context as read for the session user. Impersonating admins don't change what
+// the user has read.
+func markTopicRead(a *application.App, r *http.Request) error {
+	user, ok := context.SessionUser(r)
+	if _, impersonating := context.Impersonation(r); !ok || impersonating {
+		return nil
+	}
+
+	sm := models.NewSubscriptionModel(a.DB)
+	return errors.Wrap(sm.MarkRead(nil, user, context.Topic(r)), "mark read error")
+}
+
+func postSubscription(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	user, _ := context.SessionUser(r)
+	sm := models.NewSubscriptionModel(a.DB)
+	return errors.Wrap(sm.Subscribe(nil, user, context.Topic(r)), "subscribe error")
+}
+
+func deleteSubscription(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	user, _ := context.SessionUser(r)
+	sm := models.NewSubscriptionModel(a.DB)
+	return errors.Wrap(sm.Unsubscribe(nil, user, context.Topic(r)), "unsubscribe error")
+}
+
+func postMuteTag(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	user, _ := context.SessionUser(r)
+	sm := models.NewSubscriptionModel(a.DB)
+	return errors.Wrap(sm.MuteTag(nil, user, context.Tag(r)), "mute tag error")
+}
+
+func deleteMuteTag(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	user, _ := context.SessionUser(r)
+	sm := models.NewSubscriptionModel(a.DB)
+	return errors.Wrap(sm.UnmuteTag(nil, user, context.Tag(r)), "unmute tag error")
+}
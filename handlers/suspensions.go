@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BrianHarringtonUTSC/uTeach/application"
+	"github.com/BrianHarringtonUTSC/uTeach/context"
+	"github.com/BrianHarringtonUTSC/uTeach/httperror"
+	"github.com/BrianHarringtonUTSC/uTeach/libtemplate"
+	"github.com/BrianHarringtonUTSC/uTeach/models"
+	"github.com/Masterminds/squirrel"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+const maxSuspensionDays = 365
+
+func getSuspensions(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	um := models.NewUserModel(a.DB)
+	restrictedUsers, err := um.Find(nil, squirrel.Or{
+		squirrel.Eq{"users.is_banned": true},
+		squirrel.Gt{"users.suspended_until": time.Now().UTC()},
+	})
+	if err != nil {
+		return errors.Wrap(err, "find users error")
+	}
+
+	sm := models.NewSuspensionModel(a.DB)
+	history, err := sm.Find(nil)
+	if err != nil {
+		return errors.Wrap(err, "find suspensions error")
+	}
+
+	data := context.TemplateData(r)
+	data["RestrictedUsers"] = restrictedUsers
+	data["Suspensions"] = history
+	err = libtemplate.Render(w, a.Templates, "suspensions.html", data)
+	return errors.Wrap(err, "render template error")
+}
+
+// addSuspension applies the suspension in its own transaction.
+func addSuspension(a *application.App, suspension *models.Suspension) (err error) {
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	return applySuspension(tx, a, suspension)
+}
+
+// applySuspension applies the suspension to its user and records it in the suspension history using the tx. Banned
+// users are logged out of all their sessions.
+func applySuspension(tx *sqlx.Tx, a *application.App, suspension *models.Suspension) error {
+	sm := models.NewSuspensionModel(a.DB)
+	if err := sm.Add(tx, suspension); err != nil {
+		return err
+	}
+
+	if suspension.Action == models.SuspensionActionBan {
+		sessionModel := models.NewSessionModel(a.DB)
+		if err := sessionModel.Delete(tx, squirrel.Eq{"sessions.user_id": suspension.User.ID}); err != nil {
+			return errors.Wrap(err, "delete sessions error")
+		}
+	}
+	return nil
+}
+
+func findUserByHandleVar(a *application.App, r *http.Request) (*models.User, error) {
+	handle := strings.ToLower(mux.Vars(r)["handle"])
+	um := models.NewUserModel(a.DB)
+	user, err := um.FindOne(nil, squirrel.Eq{"users.handle": handle})
+	return user, errors.Wrap(err, "find one error")
+}
+
+func postUserSuspension(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	user, err := findUserByHandleVar(a, r)
+	if err != nil {
+		return err
+	}
+	actor, _ := context.SessionUser(r)
+
+	suspension := &models.Suspension{User: user, Actor: actor, Reason: r.FormValue("reason")}
+	switch r.FormValue("action") {
+	case models.SuspensionActionSuspend:
+		days, err := strconv.Atoi(r.FormValue("days"))
+		if err != nil || days < 1 || days > maxSuspensionDays {
+			return httperror.StatusError{http.StatusBadRequest, errors.New("Suspensions must be 1 to 365 days")}
+		}
+		until := time.Now().UTC().AddDate(0, 0, days)
+		suspension.Action = models.SuspensionActionSuspend
+		suspension.SuspendedUntil = &until
+	case models.SuspensionActionBan:
+		suspension.Action = models.SuspensionActionBan
+	default:
+		return httperror.StatusError{http.StatusBadRequest, errors.New("Unknown suspension action")}
+	}
+
+	if err = addSuspension(a, suspension); err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, user.URL(), http.StatusFound)
+	return nil
+}
+
+func deleteUserSuspension(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	user, err := findUserByHandleVar(a, r)
+	if err != nil {
+		return err
+	}
+	actor, _ := context.SessionUser(r)
+
+	suspension := &models.Suspension{User: user, Actor: actor, Action: models.SuspensionActionLift}
+	return addSuspension(a, suspension)
+}
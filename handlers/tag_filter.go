@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/BrianHarringtonUTSC/uTeach/application"
+	"github.com/BrianHarringtonUTSC/uTeach/context"
+	"github.com/BrianHarringtonUTSC/uTeach/libtemplate"
+	"github.com/BrianHarringtonUTSC/uTeach/models"
+	"github.com/Masterminds/squirrel"
+	"github.com/pkg/errors"
+)
+
+const (
+	postsPerPage = 20    // how many posts are shown on each page of filtered posts
+	maxPage      = 10000 // pages past this are shown as this page so the offset can't overflow
+)
+
+// tagFilterParams are the query string parameters of the tag filter, each a comma separated list of tag names.
+var tagFilterParams = []string{"all", "any", "not"}
+
+// tagFilterChip is a tag shown on the filter page with links that add it to or remove it from the filter.
+type tagFilterChip struct {
+	Tag *models.Tag
+	// Param is the filter parameter the tag is in, empty if it isn't in the filter.
+	Param     string
+	AllURL    string
+	AnyURL    string
+	NotURL    string
+	RemoveURL string
+}
+
+// splitTagNames splits a comma separated list of tag names.
+func splitTagNames(s string) []string {
+	var names []string
+	for _, name := range strings.Split(strings.ToLower(s), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// tagFilterFromQuery gets the tag filter in the query string from the topic's tags. Tags repeated in a parameter are
+// only added once.
+func tagFilterFromQuery(query url.Values, tags []*models.Tag) (*models.TagFilter, error) {
+	byName := make(map[string]*models.Tag)
+	for _, tag := range tags {
+		byName[tag.Name] = tag
+	}
+
+	filter := new(models.TagFilter)
+	lists := map[string]*[]*models.Tag{"all": &filter.All, "any": &filter.Any, "not": &filter.Not}
+	for _, param := range tagFilterParams {
+		added := make(map[int64]bool)
+		for _, name := range splitTagNames(query.Get(param)) {
+			tag, ok := byName[name]
+			if !ok {
+				return nil, models.InputError{"There is no tag named " + name}
+			}
+
+			if !added[tag.ID] {
+				added[tag.ID] = true
+				*lists[param] = append(*lists[param], tag)
+			}
+		}
+	}
+	return filter, nil
+}
+
+// tagFilterURL returns the filter page URL with the tag moved to param, or removed from the filter if param is empty.
+// Other parameters like the sort are kept but the page is reset.
+func tagFilterURL(topic *models.Topic, query url.Values, tag *models.Tag, param string) string {
+	values := url.Values{}
+	for key, value := range query {
+		values[key] = value
+	}
+	values.Del("page")
+
+	for _, p := range tagFilterParams {
+		var names []string
+		for _, name := range splitTagNames(query.Get(p)) {
+			if name != tag.Name {
+				names = append(names, name)
+			}
+		}
+		if p == param {
+			names = append(names, tag.Name)
+		}
+
+		if len(names) > 0 {
+			values.Set(p, strings.Join(names, ","))
+		} else {
+			values.Del(p)
+		}
+	}
+	return topic.URL() + "/filter?" + values.Encode()
+}
+
+// pageURL returns the current URL with the page changed.
+func pageURL(r *http.Request, page int) string {
+	values := r.URL.Query()
+	values.Set("page", strconv.Itoa(page))
+	return r.URL.Path + "?" + values.Encode()
+}
+
+// getFilteredPosts shows the posts in the topic that match the tag filter and custom field filters in the query string,
+// sorted and paginated. Posts are sorted by the topic's default sort unless the query string has a sort.
+func getFilteredPosts(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	topic := context.Topic(r)
+	query := r.URL.Query()
+
+	tm := models.NewTagModel(a.DB)
+	tags, err := tm.Find(nil, squirrel.Eq{"tags.topic_id": topic.TopicIDs()})
+	if err != nil {
+		return errors.Wrap(err, "find tags error")
+	}
+
+	filter, err := tagFilterFromQuery(query, tags)
+	if err != nil {
+		return err
+	}
+
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	if page > maxPage {
+		page = maxPage
+	}
+
+	data := context.TemplateData(r)
+	settings, err := addTopicSettingsToData(a, r, data)
+	if err != nil {
+		return err
+	}
+
+	sort := query.Get("sort")
+	if !models.IsValidPostSort(sort) {
+		sort = settings.DefaultSort
+	}
+
+	fields, err := findTopicFields(a, topic)
+	if err != nil {
+		return err
+	}
+
+	wheres := withPublishedPosts(r, models.InTopics(topic.ID), filter)
+
+	// hidden posts must be left out before the page is cut, otherwise pages come up short
+	user, ok := context.SessionUser(r)
+	topicRole, hasRole := context.TopicRole(r)
+	switch {
+	case !ok:
+		wheres = append(wheres, models.VisiblePosts)
+	case !user.IsAdmin && !(hasRole && topicRole.IsModerator()):
+		wheres = append(wheres, squirrel.Or{models.VisiblePosts, squirrel.Eq{"posts.creator_user_id": user.ID}})
+	}
+	fieldFilters := make(map[string]string)
+	for _, field := range fields {
+		if value := strings.TrimSpace(query.Get(fieldFilterPrefix + field.Name)); value != "" {
+			wheres = append(wheres, field.Filter(value))
+			fieldFilters[field.Name] = value
+		}
+	}
+	data["Fields"] = fields
+	data["FieldFilters"] = fieldFilters
+
+	// the field filter form keeps the tag filter and sort
+	fieldFormParams := make(map[string]string)
+	for _, param := range []string{"all", "any", "not", "sort"} {
+		if value := query.Get(param); value != "" {
+			fieldFormParams[param] = value
+		}
+	}
+	data["FieldFormParams"] = fieldFormParams
+
+	// get one more post than shown to know if there is a next page
+	pm := models.NewPostModel(a.DB)
+	posts, err := pm.FindPage(nil, sort, postsPerPage+1, uint64((page-1)*postsPerPage), wheres...)
+	if err != nil {
+		return errors.Wrap(err, "find page error")
+	}
+
+	if len(posts) > postsPerPage {
+		posts = posts[:postsPerPage]
+		if page < maxPage {
+			data["NextPageURL"] = pageURL(r, page+1)
+		}
+	}
+	if page > 1 {
+		data["PrevPageURL"] = pageURL(r, page-1)
+	}
+
+	if err = tm.FindForPosts(nil, posts); err != nil {
+		return errors.Wrap(err, "find tags for posts error")
+	}
+
+	params := make(map[int64]string)
+	for param, list := range map[string][]*models.Tag{"all": filter.All, "any": filter.Any, "not": filter.Not} {
+		for _, tag := range list {
+			params[tag.ID] = param
+		}
+	}
+
+	var chips []*tagFilterChip
+	for _, tag := range tags {
+		chips = append(chips, &tagFilterChip{
+			Tag:       tag,
+			Param:     params[tag.ID],
+			AllURL:    tagFilterURL(topic, query, tag, "all"),
+			AnyURL:    tagFilterURL(topic, query, tag, "any"),
+			NotURL:    tagFilterURL(topic, query, tag, "not"),
+			RemoveURL: tagFilterURL(topic, query, tag, ""),
+		})
+	}
+
+	sortValues := url.Values{}
+	for key, value := range query {
+		sortValues[key] = value
+	}
+	sortValues.Del("page")
+	sortValues.Set("sort", models.PostSortTop)
+	data["TopSortURL"] = topic.URL() + "/filter?" + sortValues.Encode()
+	sortValues.Set("sort", models.PostSortNew)
+	data["NewSortURL"] = topic.URL() + "/filter?" + sortValues.Encode()
+
+	data["Posts"] = posts
+	data["TagFilter"] = filter
+	data["TagChips"] = chips
+	data["Sort"] = sort
+	data["Page"] = page
+	if err = addUserUpvotedPostIDsToData(r, pm, data); err != nil {
+		return errors.Wrap(err, "add upvoted post ids to data error")
+	}
+
+	err = libtemplate.Render(w, a.Templates, "filtered_posts.html", data)
+	return errors.Wrap(err, "render template error")
+}
@@ -2,12 +2,16 @@ package handlers
 
 import (
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/BrianHarringtonUTSC/uTeach/application"
 	"github.com/BrianHarringtonUTSC/uTeach/context"
+	"github.com/BrianHarringtonUTSC/uTeach/httperror"
 	"github.com/BrianHarringtonUTSC/uTeach/libtemplate"
 	"github.com/BrianHarringtonUTSC/uTeach/models"
 	"github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 )
 
@@ -15,7 +19,7 @@ func getTags(a *application.App, w http.ResponseWriter, r *http.Request) error {
 	topic := context.Topic(r)
 
 	tm := models.NewTagModel(a.DB)
-	tags, err := tm.Find(nil, squirrel.Eq{"tags.topic_id": topic.ID})
+	tags, err := tm.Find(nil, squirrel.Eq{"tags.topic_id": topic.TopicIDs()})
 	if err != nil {
 		return errors.Wrap(err, "find error")
 	}
@@ -23,26 +27,228 @@ func getTags(a *application.App, w http.ResponseWriter, r *http.Request) error {
 	data := context.TemplateData(r)
 	data["Tags"] = tags
 	data["Topic"] = topic
+	if _, err = addTopicSettingsToData(a, r, data); err != nil {
+		return err
+	}
+
+	if user, ok := context.SessionUser(r); ok {
+		sm := models.NewSubscriptionModel(a.DB)
+		mutedTags, err := sm.MutedTags(nil, user)
+		if err != nil {
+			return errors.Wrap(err, "muted tags error")
+		}
+
+		muted := make(map[int64]bool)
+		for _, tag := range mutedTags {
+			muted[tag.ID] = true
+		}
+		data["MutedTags"] = muted
+	}
 
 	err = libtemplate.Render(w, a.Templates, "tags.html", data)
 	return errors.Wrap(err, "render template error")
 }
 
+// canCreateTags returns a forbidden error unless the topic's settings let the session user create tags in it.
+func canCreateTags(a *application.App, r *http.Request) error {
+	user, _ := context.SessionUser(r)
+	role, _ := context.TopicRole(r)
+
+	tsm := models.NewTopicSettingsModel(a.DB)
+	settings, err := tsm.Get(nil, context.Topic(r))
+	if err != nil {
+		return errors.Wrap(err, "get topic settings error")
+	}
+
+	if !settings.CanCreateTags(user, role) {
+		return httperror.StatusError{http.StatusForbidden, nil}
+	}
+	return nil
+}
+
 func getNewTag(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	if err := canCreateTags(a, r); err != nil {
+		return err
+	}
+
 	err := libtemplate.Render(w, a.Templates, "new_tag.html", context.TemplateData(r))
 	return errors.Wrap(err, "render template error")
 }
 
-func postNewTag(a *application.App, w http.ResponseWriter, r *http.Request) error {
+func postNewTag(a *application.App, w http.ResponseWriter, r *http.Request) (err error) {
 	topic := context.Topic(r)
 	name := r.FormValue("name")
+	user, _ := context.SessionUser(r)
+
+	if err = canCreateTags(a, r); err != nil {
+		return err
+	}
+
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
 
 	tm := models.NewTagModel(a.DB)
-	tag := &models.Tag{Name: name, Topic: topic}
-	if err := tm.Add(nil, tag); err != nil {
+	tag := &models.Tag{Name: name, Topic: topic, Description: strings.TrimSpace(r.FormValue("description")),
+		Color: strings.ToLower(r.FormValue("color"))}
+	if err = tm.Add(tx, tag); err != nil {
+		return err
+	}
+
+	if err = addTagAuditEntry(tx, a, user, models.AuditActionAddTag, tag, tag.Name); err != nil {
 		return err
 	}
 
 	http.Redirect(w, r, tag.Topic.URL(), http.StatusFound)
 	return nil
 }
+
+// addTagAuditEntry records that the actor took the action on the tag.
+func addTagAuditEntry(tx *sqlx.Tx, a *application.App, actor *models.User, action string, tag *models.Tag,
+	details string) error {
+	alm := models.NewAuditLogModel(a.DB)
+	entry := &models.AuditEntry{Actor: actor, Action: action, Topic: tag.Topic,
+		TargetType: models.AuditTargetTag, TargetID: tag.ID, Details: details}
+	err := alm.Add(tx, entry)
+	return errors.Wrap(err, "add audit entry error")
+}
+
+// getEditTag shows forms to change, merge and delete the tag.
+func getEditTag(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	tag := context.Tag(r)
+
+	tm := models.NewTagModel(a.DB)
+	tags, err := tm.Find(nil, squirrel.Eq{"tags.topic_id": tag.Topic.ID}, squirrel.NotEq{"tags.id": tag.ID})
+	if err != nil {
+		return errors.Wrap(err, "find error")
+	}
+
+	data := context.TemplateData(r)
+	data["MergeTags"] = tags
+	err = libtemplate.Render(w, a.Templates, "edit_tag.html", data)
+	return errors.Wrap(err, "render template error")
+}
+
+// postEditTag renames the tag and changes its description and color.
+func postEditTag(a *application.App, w http.ResponseWriter, r *http.Request) (err error) {
+	tag := context.Tag(r)
+	user, _ := context.SessionUser(r)
+	oldName := tag.Name
+
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	tm := models.NewTagModel(a.DB)
+	tag.Name = strings.TrimSpace(r.FormValue("name"))
+	tag.Description = strings.TrimSpace(r.FormValue("description"))
+	tag.Color = strings.ToLower(r.FormValue("color"))
+	if err = tm.Update(tx, tag); err != nil {
+		return err
+	}
+
+	details := tag.Name
+	if tag.Name != oldName {
+		details = oldName + " renamed to " + tag.Name
+	}
+	if err = addTagAuditEntry(tx, a, user, models.AuditActionUpdateTag, tag, details); err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, tag.Topic.TagsURL(), http.StatusFound)
+	return nil
+}
+
+// postMergeTag merges the tag into the tag with the id in the form.
+func postMergeTag(a *application.App, w http.ResponseWriter, r *http.Request) (err error) {
+	tag := context.Tag(r)
+	user, _ := context.SessionUser(r)
+
+	intoID, err := strconv.ParseInt(r.FormValue("into"), 10, 64)
+	if err != nil {
+		return httperror.StatusError{http.StatusBadRequest, err}
+	}
+
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	tm := models.NewTagModel(a.DB)
+	into, err := tm.FindOne(tx, squirrel.Eq{"tags.id": intoID, "tags.topic_id": tag.Topic.ID})
+	if err != nil {
+		return errors.Wrap(err, "find one error")
+	}
+
+	if err = tm.Merge(tx, tag, into); err != nil {
+		return err
+	}
+
+	if err = addTagAuditEntry(tx, a, user, models.AuditActionMergeTag, into, tag.Name+" merged into "+into.Name); err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, into.URL(), http.StatusFound)
+	return nil
+}
+
+// postDeleteTag deletes the tag. Posts with the tag are kept.
+func postDeleteTag(a *application.App, w http.ResponseWriter, r *http.Request) (err error) {
+	tag := context.Tag(r)
+	user, _ := context.SessionUser(r)
+
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	tm := models.NewTagModel(a.DB)
+	if err = tm.Delete(tx, tag); err != nil {
+		return errors.Wrap(err, "delete error")
+	}
+
+	if err = addTagAuditEntry(tx, a, user, models.AuditActionDeleteTag, tag, tag.Name); err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, tag.Topic.TagsURL(), http.StatusFound)
+	return nil
+}
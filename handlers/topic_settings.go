@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/BrianHarringtonUTSC/uTeach/application"
+	"github.com/BrianHarringtonUTSC/uTeach/context"
+	"github.com/BrianHarringtonUTSC/uTeach/libtemplate"
+	"github.com/BrianHarringtonUTSC/uTeach/models"
+	"github.com/pkg/errors"
+)
+
+// addTopicSettingsToData gets the settings of the topic in the context and adds them and whether the session user may
+// post and create tags to data.
+func addTopicSettingsToData(a *application.App, r *http.Request, data map[string]interface{}) (*models.TopicSettings,
+	error) {
+	tsm := models.NewTopicSettingsModel(a.DB)
+	settings, err := tsm.Get(nil, context.Topic(r))
+	if err != nil {
+		return nil, errors.Wrap(err, "get topic settings error")
+	}
+
+	data["TopicSettings"] = settings
+	if user, ok := context.SessionUser(r); ok {
+		role, _ := context.TopicRole(r)
+		data["CanPost"] = settings.CanPost(user, role)
+		data["CanCreateTags"] = settings.CanCreateTags(user, role)
+	}
+	return settings, nil
+}
+
+func getTopicSettings(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	data := context.TemplateData(r)
+	if _, err := addTopicSettingsToData(a, r, data); err != nil {
+		return err
+	}
+
+	err := libtemplate.Render(w, a.Templates, "topic_settings.html", data)
+	return errors.Wrap(err, "render template error")
+}
+
+// postTopicSettings saves the topic's settings and records the change in the audit log. Only instructors and admins
+// can change the settings, not TAs.
+func postTopicSettings(a *application.App, w http.ResponseWriter, r *http.Request) (err error) {
+	topic := context.Topic(r)
+	user, _ := context.SessionUser(r)
+
+	settings := &models.TopicSettings{
+		TopicID:               topic.ID,
+		WhoCanPost:            r.FormValue("who_can_post"),
+		AllowAnonymous:        r.FormValue("allow_anonymous") == "on",
+		StudentsCanCreateTags: r.FormValue("students_can_create_tags") == "on",
+		DefaultSort:           r.FormValue("default_sort"),
+		RequireTag:            r.FormValue("require_tag") == "on",
+	}
+
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	tsm := models.NewTopicSettingsModel(a.DB)
+	if err = tsm.Save(tx, settings); err != nil {
+		return err
+	}
+
+	details := []string{"who can post: " + settings.WhoCanPost, "default sort: " + settings.DefaultSort}
+	if settings.AllowAnonymous {
+		details = append(details, "anonymous posts allowed")
+	}
+	if settings.StudentsCanCreateTags {
+		details = append(details, "students can create tags")
+	}
+	if settings.RequireTag {
+		details = append(details, "tag required")
+	}
+
+	alm := models.NewAuditLogModel(a.DB)
+	entry := &models.AuditEntry{Actor: user, Action: models.AuditActionUpdateSettings, Topic: topic,
+		TargetType: models.AuditTargetTopic, TargetID: topic.ID, Details: strings.Join(details, ", ")}
+	if err = alm.Add(tx, entry); err != nil {
+		return errors.Wrap(err, "add audit entry error")
+	}
+
+	http.Redirect(w, r, topic.URL(), http.StatusFound)
+	return nil
+}
@@ -2,14 +2,21 @@ package handlers
 
 import (
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/BrianHarringtonUTSC/uTeach/application"
 	"github.com/BrianHarringtonUTSC/uTeach/context"
+	"github.com/BrianHarringtonUTSC/uTeach/httperror"
 	"github.com/BrianHarringtonUTSC/uTeach/libtemplate"
 	"github.com/BrianHarringtonUTSC/uTeach/models"
+	"github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 )
 
+// getTopics lists the topics with archived topics in their own section and sections under their parents. Logged in
+// users also get their home feed.
 func getTopics(a *application.App, w http.ResponseWriter, r *http.Request) error {
 	tm := models.NewTopicModel(a.DB)
 	topics, err := tm.Find(nil)
@@ -17,29 +24,307 @@ func getTopics(a *application.App, w http.ResponseWriter, r *http.Request) error
 		return errors.Wrap(err, "find error")
 	}
 
+	var activeTopics, archivedTopics []*models.Topic
+	sections := make(map[int64][]*models.Topic)
+	for _, topic := range topics {
+		if topic.IsSection() {
+			sections[*topic.ParentID] = append(sections[*topic.ParentID], topic)
+		} else if topic.IsArchived {
+			archivedTopics = append(archivedTopics, topic)
+		} else {
+			activeTopics = append(activeTopics, topic)
+		}
+	}
+
 	data := context.TemplateData(r)
-	data["Topics"] = topics
+	data["Topics"] = activeTopics
+	data["ArchivedTopics"] = archivedTopics
+	data["Sections"] = sections
+	if err = addFeedToData(a, r, data); err != nil {
+		return errors.Wrap(err, "add feed to data error")
+	}
 	err = libtemplate.Render(w, a.Templates, "topics.html", data)
 	return errors.Wrap(err, "render template error")
 }
 
 func getNewTopic(a *application.App, w http.ResponseWriter, r *http.Request) error {
-	err := libtemplate.Render(w, a.Templates, "new_topic.html", context.TemplateData(r))
+	tm := models.NewTopicModel(a.DB)
+	topics, err := tm.Find(nil, squirrel.Eq{"topics.parent_topic_id": nil})
+	if err != nil {
+		return errors.Wrap(err, "find error")
+	}
+
+	data := context.TemplateData(r)
+	data["ParentTopics"] = topics
+	err = libtemplate.Render(w, a.Templates, "new_topic.html", data)
 	return errors.Wrap(err, "render template error")
 }
 
-func postNewTopic(a *application.App, w http.ResponseWriter, r *http.Request) error {
+// postNewTopic adds a topic, or a section of the parent topic in the form.
+func postNewTopic(a *application.App, w http.ResponseWriter, r *http.Request) (err error) {
 	name := r.FormValue("name")
 	title := r.FormValue("title")
 	description := r.FormValue("description")
+	user, _ := context.SessionUser(r)
+
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
 
 	tm := models.NewTopicModel(a.DB)
 
 	topic := &models.Topic{Name: name, Title: title, Description: description}
-	if err := tm.Add(nil, topic); err != nil {
+	if parentName := r.FormValue("parent"); parentName != "" {
+		parent, err := tm.FindOne(tx, squirrel.Eq{"topics.name": strings.ToLower(parentName),
+			"topics.parent_topic_id": nil})
+		if err != nil {
+			return errors.Wrap(err, "find one parent error")
+		}
+		topic.Name = parent.Name + "/" + name
+		topic.ParentID = &parent.ID
+	}
+
+	if err = tm.Add(tx, topic); err != nil {
+		return err
+	}
+
+	if err = addTopicAuditEntry(tx, a, user, topic); err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, topic.URL(), http.StatusFound)
+	return nil
+}
+
+// addTopicAuditEntry records that the actor added the topic.
+func addTopicAuditEntry(tx *sqlx.Tx, a *application.App, actor *models.User, topic *models.Topic) error {
+	alm := models.NewAuditLogModel(a.DB)
+	entry := &models.AuditEntry{Actor: actor, Action: models.AuditActionAddTopic, Topic: topic,
+		TargetType: models.AuditTargetTopic, TargetID: topic.ID, Details: topic.Title}
+	err := alm.Add(tx, entry)
+	return errors.Wrap(err, "add audit entry error")
+}
+
+func getEditTopic(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	err := libtemplate.Render(w, a.Templates, "edit_topic.html", context.TemplateData(r))
+	return errors.Wrap(err, "render template error")
+}
+
+// postEditTopic updates the topic's title, description, name and archived state. Each kind of change gets its own
+// audit log entry.
+func postEditTopic(a *application.App, w http.ResponseWriter, r *http.Request) (err error) {
+	topic := context.Topic(r)
+	user, _ := context.SessionUser(r)
+	old := *topic
+
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	tm := models.NewTopicModel(a.DB)
+	topic.Title = strings.TrimSpace(r.FormValue("title"))
+	topic.Description = strings.TrimSpace(r.FormValue("description"))
+	topic.IsArchived = r.FormValue("archived") != ""
+	if err = tm.Update(tx, topic); err != nil {
+		return err
+	}
+
+	if err = tm.Rename(tx, topic, strings.TrimSpace(r.FormValue("name"))); err != nil {
 		return err
 	}
 
+	var entries []*models.AuditEntry
+	if topic.Title != old.Title || topic.Description != old.Description {
+		entries = append(entries, &models.AuditEntry{Action: models.AuditActionUpdateTopic, Details: topic.Title})
+	}
+	if topic.Name != old.Name {
+		entries = append(entries, &models.AuditEntry{Action: models.AuditActionRenameTopic,
+			Details: old.Name + " to " + topic.Name})
+	}
+	if topic.IsArchived != old.IsArchived {
+		action := models.AuditActionArchiveTopic
+		if !topic.IsArchived {
+			action = models.AuditActionUnarchiveTopic
+		}
+		entries = append(entries, &models.AuditEntry{Action: action, Details: topic.Title})
+	}
+
+	alm := models.NewAuditLogModel(a.DB)
+	for _, entry := range entries {
+		entry.Actor, entry.Topic, entry.TargetType, entry.TargetID = user, topic, models.AuditTargetTopic, topic.ID
+		if err = alm.Add(tx, entry); err != nil {
+			return errors.Wrap(err, "add audit entry error")
+		}
+	}
+
 	http.Redirect(w, r, topic.URL(), http.StatusFound)
 	return nil
 }
+
+// getDeleteTopic asks to confirm deleting the topic, showing what will be deleted with it including its sections.
+func getDeleteTopic(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	topic := context.Topic(r)
+
+	tm := models.NewTopicModel(a.DB)
+	topicIDs, err := tm.WithSectionIDs(nil, []int64{topic.ID})
+	if err != nil {
+		return errors.Wrap(err, "with section ids error")
+	}
+
+	postCount, err := tm.CountPosts(nil, topic)
+	if err != nil {
+		return errors.Wrap(err, "count posts error")
+	}
+
+	tagModel := models.NewTagModel(a.DB)
+	tags, err := tagModel.Find(nil, squirrel.Eq{"tags.topic_id": topicIDs})
+	if err != nil {
+		return errors.Wrap(err, "find tags error")
+	}
+
+	data := context.TemplateData(r)
+	data["SectionCount"] = len(topicIDs) - 1
+	data["PostCount"] = postCount
+	data["TagCount"] = len(tags)
+	err = libtemplate.Render(w, a.Templates, "delete_topic.html", data)
+	return errors.Wrap(err, "render template error")
+}
+
+// postDeleteTopic deletes the topic and everything in it. The topic's name must be typed to confirm.
+func postDeleteTopic(a *application.App, w http.ResponseWriter, r *http.Request) (err error) {
+	topic := context.Topic(r)
+	user, _ := context.SessionUser(r)
+	if strings.ToLower(strings.TrimSpace(r.FormValue("confirm_name"))) != topic.Name {
+		return httperror.StatusError{http.StatusBadRequest, errors.New("Type the topic's name to confirm deleting it")}
+	}
+
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	// attached files are deleted once nothing refers to them
+	var attachments []*models.Attachment
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		if err = tx.Commit(); err == nil {
+			deleteAttachmentFiles(a, attachments)
+		}
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	am := models.NewAttachmentModel(a.DB)
+	attachments, err = am.Find(tx, squirrel.Or{squirrel.Eq{"topics.id": topic.ID},
+		squirrel.Eq{"topics.parent_topic_id": topic.ID}})
+	if err != nil {
+		return errors.Wrap(err, "find attachments error")
+	}
+
+	tm := models.NewTopicModel(a.DB)
+	if err = tm.Delete(tx, topic); err != nil {
+		return errors.Wrap(err, "delete error")
+	}
+
+	// the topic is gone so the entry keeps its name in the details
+	alm := models.NewAuditLogModel(a.DB)
+	entry := &models.AuditEntry{Actor: user, Action: models.AuditActionDeleteTopic, Topic: topic,
+		TargetType: models.AuditTargetTopic, TargetID: topic.ID, Details: topic.Name + ": " + topic.Title}
+	if err = alm.Add(tx, entry); err != nil {
+		return errors.Wrap(err, "add audit entry error")
+	}
+
+	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
+}
+
+// getCloneTopic shows the form to clone the topic with its pinned posts to choose from.
+func getCloneTopic(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	topic := context.Topic(r)
+
+	pm := models.NewPostModel(a.DB)
+	pinnedPosts, err := pm.FindSorted(nil, models.PostSortNew, squirrel.Eq{"posts.topic_id": topic.ID},
+		models.PinnedPosts)
+	if err != nil {
+		return errors.Wrap(err, "find pinned posts error")
+	}
+
+	data := context.TemplateData(r)
+	data["PinnedPosts"] = pinnedPosts
+	err = libtemplate.Render(w, a.Templates, "clone_topic.html", data)
+	return errors.Wrap(err, "render template error")
+}
+
+// postCloneTopic clones the topic into a new topic with the name, title and description in the form. The posts checked
+// in the form are copied and roles are copied if asked.
+func postCloneTopic(a *application.App, w http.ResponseWriter, r *http.Request) (err error) {
+	topic := context.Topic(r)
+	user, _ := context.SessionUser(r)
+
+	if err = r.ParseForm(); err != nil {
+		return httperror.StatusError{http.StatusBadRequest, err}
+	}
+
+	var postIDs []int64
+	for _, value := range r.PostForm["post"] {
+		postID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return httperror.StatusError{http.StatusBadRequest, err}
+		}
+		postIDs = append(postIDs, postID)
+	}
+
+	clone := &models.Topic{Name: strings.TrimSpace(r.FormValue("name")), Title: strings.TrimSpace(r.FormValue("title")),
+		Description: strings.TrimSpace(r.FormValue("description"))}
+
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	tm := models.NewTopicModel(a.DB)
+	if err = tm.Clone(tx, topic, clone, postIDs, r.FormValue("roles") == "on"); err != nil {
+		return err
+	}
+
+	alm := models.NewAuditLogModel(a.DB)
+	entry := &models.AuditEntry{Actor: user, Action: models.AuditActionCloneTopic, Topic: clone,
+		TargetType: models.AuditTargetTopic, TargetID: clone.ID, Details: topic.Name + " to " + clone.Name}
+	if err = alm.Add(tx, entry); err != nil {
+		return errors.Wrap(err, "add audit entry error")
+	}
+
+	http.Redirect(w, r, clone.URL(), http.StatusFound)
+	return nil
+}
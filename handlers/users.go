@@ -1,23 +1,41 @@
 package handlers
 
 import (
+	"bytes"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"os"
 	"strings"
 
 	"github.com/BrianHarringtonUTSC/uTeach/application"
 	"github.com/BrianHarringtonUTSC/uTeach/context"
 	"github.com/BrianHarringtonUTSC/uTeach/httperror"
+	"github.com/BrianHarringtonUTSC/uTeach/libimage"
 	"github.com/BrianHarringtonUTSC/uTeach/libtemplate"
 	"github.com/BrianHarringtonUTSC/uTeach/models"
 	"github.com/BrianHarringtonUTSC/uTeach/session"
 	"github.com/Masterminds/squirrel"
 	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
 )
 
+// errSignUpNotAllowed is returned when someone without an account tries to log in with an email address outside the
+// allowed email domains.
+var errSignUpNotAllowed = errors.New("sign up not allowed")
+
+const (
+	avatarSize          = 128     // width and height in pixels of stored avatars
+	maxAvatarUploadSize = 5 << 20 // 5 MB
+	maxProfileFormSize  = 1 << 20 // room for the other fields and multipart overhead on top of the avatar
+)
+
 func getLogin(a *application.App, w http.ResponseWriter, r *http.Request) error {
 	if _, ok := context.SessionUser(r); ok {
 		return httperror.StatusError{http.StatusOK, errors.New("Already logged in")}
@@ -30,27 +48,110 @@ func getLogin(a *application.App, w http.ResponseWriter, r *http.Request) error
 }
 
 func loginUser(a *application.App, w http.ResponseWriter, r *http.Request, email, name string) error {
-	um := models.NewUserModel(a.DB)
-	user, err := um.FindOne(nil, squirrel.Eq{"users.email": email})
-	if err == sql.ErrNoRows {
-		// user not found so must be logging in for first time, add the user
-		user = &models.User{Email: email, Name: name}
-		err = um.Add(nil, user)
+	redirectURL := "/"
+
+	user, isNew, err := signInUser(a, email, name)
+	if errors.Cause(err) == errSignUpNotAllowed {
+		return renderSignUpNotAllowed(a, w, r, email)
 	}
-	if err != nil && err != sql.ErrNoRows {
+	if err != nil {
 		return errors.Wrap(err, "login error")
 	}
 
+	if isNew {
+		// give new users a chance to pick their own handle before it is shown to others
+		redirectURL = "/settings/handle"
+	}
+
 	us := session.NewUserSession(a.Store)
 	err = us.SaveSessionUserID(w, r, user.ID)
 	if err != nil {
 		return errors.Wrap(err, "save session user error")
 	}
 
-	http.Redirect(w, r, "/", http.StatusFound)
+	http.Redirect(w, r, redirectURL, http.StatusFound)
 	return nil
 }
 
+// signInUser finds or adds the user with the email and makes them an admin if they should be in one tx. Returns true if
+// the user was added.
+func signInUser(a *application.App, email, name string) (user *models.User, isNew bool, err error) {
+	tx, err := a.DB.Beginx()
+	if err != nil {
+		return nil, false, errors.Wrap(err, "begin transaction error")
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		err = errors.Wrap(err, "commit error")
+	}()
+
+	user, isNew, err = findOrAddUser(tx, a, email, name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = promoteBootstrapAdmin(tx, models.NewUserModel(a.DB), a, user)
+	return user, isNew, errors.Wrap(err, "promote bootstrap admin error")
+}
+
+// findOrAddUser gets the user with the email. If there is none, the user must be logging in for the first time so they
+// are added with a handle suggested from their name. Returns true if the user was added.
+func findOrAddUser(tx *sqlx.Tx, a *application.App, email, name string) (*models.User, bool, error) {
+	um := models.NewUserModel(a.DB)
+	user, err := um.FindOne(tx, squirrel.Eq{"users.email": strings.ToLower(email)})
+	if err != sql.ErrNoRows {
+		return user, false, errors.Wrap(err, "find one error")
+	}
+
+	if !a.Config.IsEmailAllowed(email) {
+		return nil, false, errSignUpNotAllowed
+	}
+
+	handle, err := um.SuggestHandle(tx, name)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "suggest handle error")
+	}
+
+	user = &models.User{Email: email, Handle: handle, Name: name}
+	err = um.Add(tx, user)
+	return user, true, errors.Wrap(err, "add error")
+}
+
+// promoteBootstrapAdmin makes the user an admin if their email is one of the admin emails in the config. This is how
+// the first admins are made.
+func promoteBootstrapAdmin(tx *sqlx.Tx, um *models.UserModel, a *application.App, user *models.User) error {
+	if user.IsAdmin || !a.Config.IsAdminEmail(user.Email) {
+		return nil
+	}
+
+	user.IsAdmin = true
+	if err := um.UpdateAdmin(tx, user); err != nil {
+		return errors.Wrap(err, "update admin error")
+	}
+
+	alm := models.NewAuditLogModel(a.DB)
+	entry := &models.AuditEntry{Action: models.AuditActionGrantAdmin, TargetType: models.AuditTargetUser,
+		TargetID: user.ID, Details: fmt.Sprintf("@%s made an admin (from admin_emails config)", user.Handle)}
+	err := alm.Add(tx, entry)
+	return errors.Wrap(err, "add audit entry error")
+}
+
+// renderSignUpNotAllowed shows the page explaining which email addresses can be used to sign up.
+func renderSignUpNotAllowed(a *application.App, w http.ResponseWriter, r *http.Request, email string) error {
+	data := context.TemplateData(r)
+	data["Email"] = email
+	data["AllowedEmailDomains"] = a.Config.AllowedEmailDomains
+
+	w.WriteHeader(http.StatusForbidden)
+	err := libtemplate.Render(w, a.Templates, "sign_up_not_allowed.html", data)
+	return errors.Wrap(err, "render template error")
+}
+
 func getOauth2Callback(a *application.App, w http.ResponseWriter, r *http.Request) error {
 	errorParam := r.FormValue("error")
 	if errorParam != "" {
@@ -78,14 +179,21 @@ func getOauth2Callback(a *application.App, w http.ResponseWriter, r *http.Reques
 	defer response.Body.Close()
 
 	u := struct {
-		Email string
-		Name  string `json:"nickname"`
+		Email         string
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"nickname"`
 	}{}
 
 	err = json.NewDecoder(response.Body).Decode(&u)
 	if err != nil {
 		return errors.Wrap(err, "json decode error")
 	}
+
+	// sign up and admin rights depend on the email address, so it must be proven to be the user's
+	if !u.EmailVerified {
+		return httperror.StatusError{http.StatusForbidden,
+			errors.New("Verify your email address using the link sent to it, then log in again")}
+	}
 	return loginUser(a, w, r, u.Email, u.Name)
 }
 
@@ -101,20 +209,48 @@ func getLogout(a *application.App, w http.ResponseWriter, r *http.Request) error
 
 func getUser(a *application.App, w http.ResponseWriter, r *http.Request) error {
 	vars := mux.Vars(r)
-	email := strings.ToLower(vars["email"])
+	handle := strings.ToLower(vars["handle"])
 
 	um := models.NewUserModel(a.DB)
-	user, err := um.FindOne(nil, squirrel.Eq{"users.email": email})
+
+	// users used to be identified by email, only admins may still use those URLs as emails should not be public
+	if strings.Contains(handle, "@") {
+		sessionUser, ok := context.SessionUser(r)
+		if !ok || !sessionUser.IsAdmin {
+			return httperror.StatusError{http.StatusNotFound, nil}
+		}
+
+		user, err := um.FindOne(nil, squirrel.Eq{"users.email": handle})
+		if err != nil {
+			return errors.Wrap(err, "find one error")
+		}
+
+		http.Redirect(w, r, user.URL(), http.StatusFound)
+		return nil
+	}
+
+	user, err := um.FindOne(nil, squirrel.Eq{"users.handle": handle})
 	if err != nil {
 		return errors.Wrap(err, "find one error")
 	}
 
+	// anonymous posts are only listed for the user themselves and admins
+	wheres := []squirrel.Sqlizer{squirrel.Eq{"posts.creator_user_id": user.ID}}
+	if sessionUser, ok := context.SessionUser(r); !ok || (sessionUser.ID != user.ID && !sessionUser.IsAdmin) {
+		wheres = append(wheres, squirrel.Eq{"posts.is_anonymous": false})
+	}
+
 	pm := models.NewPostModel(a.DB)
-	createdPosts, err := pm.Find(nil, squirrel.Eq{"posts.creator_user_id": user.ID})
+	createdPosts, err := pm.Find(nil, withPublishedPosts(r, wheres...)...)
 	if err != nil {
 		return err
 	}
 
+	tm := models.NewTagModel(a.DB)
+	if err = tm.FindForPosts(nil, createdPosts); err != nil {
+		return errors.Wrap(err, "find tags for posts error")
+	}
+
 	data := context.TemplateData(r)
 	data["User"] = user
 	data["CreatedPosts"] = createdPosts
@@ -124,3 +260,120 @@ func getUser(a *application.App, w http.ResponseWriter, r *http.Request) error {
 	err = libtemplate.Render(w, a.Templates, "user.html", data)
 	return errors.Wrap(err, "render template error")
 }
+
+func getEditHandle(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	err := libtemplate.Render(w, a.Templates, "edit_handle.html", context.TemplateData(r))
+	return errors.Wrap(err, "render template error")
+}
+
+func postEditHandle(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	user, _ := context.SessionUser(r)
+	handle := r.FormValue("handle")
+
+	um := models.NewUserModel(a.DB)
+	if err := um.UpdateHandle(nil, user, handle); err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, user.URL(), http.StatusFound)
+	return nil
+}
+
+func getEditProfile(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	err := libtemplate.Render(w, a.Templates, "edit_profile.html", context.TemplateData(r))
+	return errors.Wrap(err, "render template error")
+}
+
+func postEditProfile(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAvatarUploadSize+maxProfileFormSize)
+	// forms without an avatar may not be multipart and are parsed as usual
+	err := r.ParseMultipartForm(maxAvatarUploadSize)
+	if err != nil && err != http.ErrNotMultipart {
+		return httperror.StatusError{http.StatusBadRequest, errors.New("Avatar must be under 5 MB")}
+	}
+
+	sessionUser, _ := context.SessionUser(r)
+	user := *sessionUser
+	user.Name = r.FormValue("name")
+	user.Bio = r.FormValue("bio")
+	user.Pronouns = r.FormValue("pronouns")
+
+	oldAvatarKey := user.AvatarKey
+	if r.FormValue("remove_avatar") != "" {
+		user.AvatarKey = ""
+	}
+
+	file, header, err := r.FormFile("avatar")
+	switch {
+	case err == nil:
+		defer file.Close()
+		if header.Size > maxAvatarUploadSize {
+			return httperror.StatusError{http.StatusBadRequest, errors.New("Avatar must be under 5 MB")}
+		}
+		user.AvatarKey, err = saveAvatar(a, &user, file)
+		if err != nil {
+			return err
+		}
+	case err != http.ErrMissingFile && err != http.ErrNotMultipart:
+		return errors.Wrap(err, "form file error")
+	}
+
+	um := models.NewUserModel(a.DB)
+	if err = um.Update(nil, &user); err != nil {
+		if user.AvatarKey != oldAvatarKey {
+			a.Storage.Delete(user.AvatarKey)
+		}
+		return err
+	}
+
+	if oldAvatarKey != "" && oldAvatarKey != user.AvatarKey {
+		if err = a.Storage.Delete(oldAvatarKey); err != nil {
+			return errors.Wrap(err, "delete old avatar error")
+		}
+	}
+
+	http.Redirect(w, r, user.URL(), http.StatusFound)
+	return nil
+}
+
+// saveAvatar resizes the uploaded image and stores it, returning its storage key. Each upload gets a new random key so
+// browsers never show a stale cached avatar.
+func saveAvatar(a *application.App, user *models.User, file io.Reader) (string, error) {
+	thumbnail, err := libimage.SquareThumbnail(file, avatarSize)
+	if err == libimage.ErrUnsupportedImage {
+		return "", httperror.StatusError{http.StatusBadRequest, errors.New("Avatar must be a PNG, JPEG or GIF image")}
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "thumbnail error")
+	}
+
+	b := make([]byte, 8)
+	if _, err = rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "rand error")
+	}
+
+	key := fmt.Sprintf("avatars/%d-%s.png", user.ID, hex.EncodeToString(b))
+	if err = a.Storage.Put(key, bytes.NewReader(thumbnail)); err != nil {
+		return "", errors.Wrap(err, "storage put error")
+	}
+	return key, nil
+}
+
+func getAvatar(a *application.App, w http.ResponseWriter, r *http.Request) error {
+	key := "avatars/" + mux.Vars(r)["avatarName"]
+
+	file, err := a.Storage.Get(key)
+	if os.IsNotExist(errors.Cause(err)) {
+		return httperror.StatusError{http.StatusNotFound, nil}
+	}
+	if err != nil {
+		return errors.Wrap(err, "storage get error")
+	}
+	defer file.Close()
+
+	// avatar keys are never reused so they can be cached indefinitely
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=31536000")
+	_, err = io.Copy(w, file)
+	return errors.Wrap(err, "copy error")
+}
@@ -5,6 +5,8 @@ import (
 	"database/sql"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/BrianHarringtonUTSC/uTeach/models"
 	"github.com/pkg/errors"
@@ -16,6 +18,12 @@ type StatusError struct {
 	Err  error
 }
 
+// RetryAfter is implemented by errors for requests that can be retried later, e.g. rate limited requests. HandleError
+// sets the Retry-After header for status errors wrapping one.
+type RetryAfter interface {
+	RetryAfter() time.Duration
+}
+
 // Stacktrace interface to get err stack info
 type Stacktrace interface {
 	Stacktrace() []errors.Frame
@@ -41,6 +49,9 @@ func HandleError(w http.ResponseWriter, err error) {
 	if err != nil {
 		switch e := cause.(type) {
 		case StatusError:
+			if ra, ok := e.Err.(RetryAfter); ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(ra.RetryAfter().Seconds())))
+			}
 			http.Error(w, e.Error(), e.Code)
 		case models.InputError:
 			http.Error(w, e.Error(), http.StatusBadRequest)
@@ -0,0 +1,99 @@
+// Package libimage provides image related functions.
+package libimage
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif" // blank identifier imports register the image decoders
+	_ "image/jpeg"
+	"image/png"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ErrUnsupportedImage is returned when an image could not be decoded.
+var ErrUnsupportedImage = errors.New("image must be a PNG, JPEG or GIF")
+
+// maxSourcePixels limits the decoded size of an image to stop small files from expanding into huge bitmaps.
+const maxSourcePixels = 25000000
+
+// SquareThumbnail decodes the image in r, crops it to a centered square and scales it to size x size pixels. The result
+// is encoded as a PNG.
+func SquareThumbnail(r io.Reader, size int) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, r); err != nil {
+		return nil, errors.Wrap(err, "read error")
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(buf.Bytes()))
+	if err != nil || config.Width*config.Height > maxSourcePixels {
+		return nil, ErrUnsupportedImage
+	}
+
+	src, _, err := image.Decode(buf)
+	if err != nil {
+		return nil, ErrUnsupportedImage
+	}
+
+	dst := scale(crop(src.Bounds()), src, size)
+
+	out := new(bytes.Buffer)
+	if err = png.Encode(out, dst); err != nil {
+		return nil, errors.Wrap(err, "png encode error")
+	}
+	return out.Bytes(), nil
+}
+
+// crop returns the largest square centered in bounds.
+func crop(bounds image.Rectangle) image.Rectangle {
+	w, h := bounds.Dx(), bounds.Dy()
+	side := w
+	if h < w {
+		side = h
+	}
+
+	x := bounds.Min.X + (w-side)/2
+	y := bounds.Min.Y + (h-side)/2
+	return image.Rect(x, y, x+side, y+side)
+}
+
+// scale resizes the rect area of src to a size x size image by averaging the source pixels covered by each destination
+// pixel (a box filter). This gives reasonable quality for downscaling which is the common case for avatars.
+func scale(rect image.Rectangle, src image.Image, size int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	side := rect.Dx()
+
+	for dy := 0; dy < size; dy++ {
+		y0 := rect.Min.Y + dy*side/size
+		y1 := rect.Min.Y + (dy+1)*side/size
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+
+		for dx := 0; dx < size; dx++ {
+			x0 := rect.Min.X + dx*side/size
+			x1 := rect.Min.X + (dx+1)*side/size
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					pr, pg, pb, pa := src.At(x, y).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+
+			i := dst.PixOffset(dx, dy)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(b / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,165 @@
+package lti
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// keySetMaxAge is how long a platform's fetched key set is trusted before it is fetched again.
+	keySetMaxAge = time.Hour
+
+	// keySetMinRefresh stops tokens with unknown key ids from making us fetch a platform's key set on every request.
+	keySetMinRefresh = time.Minute
+)
+
+// ErrUnknownKey is returned when a token is signed with a key that is not in the platform's key set.
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// JWK is a JSON Web Key. Only RSA public keys are supported.
+type JWK struct {
+	Kty string `json:"kty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKS is a JSON Web Key Set, the format platforms and tools use to publish their public keys.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewJWK returns the JWK for an RSA public key.
+func NewJWK(key *rsa.PublicKey, kid string) JWK {
+	return JWK{
+		Kty: "RSA",
+		Alg: "RS256",
+		Use: "sig",
+		Kid: kid,
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// PublicKey decodes the RSA public key in the JWK.
+func (k JWK) PublicKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, errors.Errorf("unsupported key type %q", k.Kty)
+	}
+
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, errors.Wrap(err, "modulus decode error")
+	}
+
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, errors.Wrap(err, "exponent decode error")
+	}
+
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
+
+// KeyID derives a stable key id from a public key so the tool's key id only changes when its key does.
+func KeyID(key *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", errors.Wrap(err, "marshal error")
+	}
+
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:12]), nil
+}
+
+// keySet is a platform's key set as last fetched from its JWKS URL.
+type keySet struct {
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// keySetCache fetches and caches platform key sets by URL.
+type keySetCache struct {
+	client *http.Client
+	mu     sync.Mutex
+	sets   map[string]*keySet
+}
+
+// key returns the public key with id kid from the key set at url, fetching the set if it is stale or does not have the
+// key yet (platforms rotate keys by adding the new one to their set before using it).
+func (c *keySetCache) key(url, kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	set, ok := c.sets[url]
+	if ok && time.Since(set.fetchedAt) < keySetMaxAge {
+		if key, found := set.find(kid); found {
+			return key, nil
+		}
+		if time.Since(set.fetchedAt) < keySetMinRefresh {
+			return nil, ErrUnknownKey
+		}
+	}
+
+	set, err := c.fetch(url)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetch error")
+	}
+	c.sets[url] = set
+
+	if key, found := set.find(kid); found {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// fetch gets the key set at url.
+func (c *keySetCache) fetch(url string) (*keySet, error) {
+	response, err := c.client.Get(url)
+	if err != nil {
+		return nil, errors.Wrap(err, "get error")
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %s", response.Status)
+	}
+
+	var jwks JWKS
+	if err = json.NewDecoder(response.Body).Decode(&jwks); err != nil {
+		return nil, errors.Wrap(err, "json decode error")
+	}
+
+	set := &keySet{keys: make(map[string]*rsa.PublicKey), fetchedAt: time.Now()}
+	for _, jwk := range jwks.Keys {
+		// skip keys we can't use (e.g. EC keys) rather than rejecting the whole set
+		key, err := jwk.PublicKey()
+		if err != nil {
+			continue
+		}
+		set.keys[jwk.Kid] = key
+	}
+	return set, nil
+}
+
+// find returns the key with id kid. Tokens without a key id are accepted if the set only has one key.
+func (s *keySet) find(kid string) (*rsa.PublicKey, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+
+	key, ok := s.keys[kid]
+	return key, ok
+}
@@ -0,0 +1,413 @@
+// Package lti implements the tool side of LTI 1.3 (https://www.imsglobal.org/spec/lti/v1p3/) so learning management
+// systems (platforms) can launch users into the app: OIDC login initiation, launch validation and deep linking.
+package lti
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Message types and the version of LTI supported.
+const (
+	MessageTypeResourceLink        = "LtiResourceLinkRequest"
+	MessageTypeDeepLinking         = "LtiDeepLinkingRequest"
+	MessageTypeDeepLinkingResponse = "LtiDeepLinkingResponse"
+	Version                        = "1.3.0"
+
+	// ContentItemTypeLTIResourceLink is the deep linking content item type for a link that launches the tool.
+	ContentItemTypeLTIResourceLink = "ltiResourceLink"
+)
+
+const (
+	contextRolePrefix = "http://purl.imsglobal.org/vocab/lis/v2/membership#"
+	claimPrefix       = "https://purl.imsglobal.org/spec/lti/claim/"
+	dlClaimPrefix     = "https://purl.imsglobal.org/spec/lti-dl/claim/"
+
+	clockSkew                   = time.Minute // allowed difference between the platform's clock and ours
+	deepLinkingResponseLifetime = 5 * time.Minute
+	keySetFetchTimeout          = 10 * time.Second
+)
+
+// Context roles from the LIS vocabulary that are mapped to roles in the app.
+const (
+	RoleInstructor        = contextRolePrefix + "Instructor"
+	RoleTeachingAssistant = "http://purl.imsglobal.org/vocab/lis/v2/membership/Instructor#TeachingAssistant"
+	RoleContentDeveloper  = contextRolePrefix + "ContentDeveloper"
+	RoleAdministrator     = contextRolePrefix + "Administrator"
+	RoleLearner           = contextRolePrefix + "Learner"
+)
+
+// ErrInvalidLaunch is the cause of all errors returned when a launch does not pass validation.
+var ErrInvalidLaunch = errors.New("invalid launch")
+
+// Platform is an LMS registered with the tool.
+type Platform struct {
+	Issuer        string
+	ClientID      string   // the client id the platform assigned to the tool
+	DeploymentIDs []string // deployments of the tool on the platform that may launch, all are allowed if empty
+	AuthLoginURL  string   // the platform's OIDC authorization endpoint
+	JWKSURL       string   // where the platform publishes the keys it signs launches with
+}
+
+// allowsDeployment returns true if the platform may launch from the deployment.
+func (p *Platform) allowsDeployment(deploymentID string) bool {
+	if len(p.DeploymentIDs) == 0 {
+		return deploymentID != ""
+	}
+
+	for _, id := range p.DeploymentIDs {
+		if id == deploymentID {
+			return true
+		}
+	}
+	return false
+}
+
+// Context is the course (or other grouping) in the platform the launch came from.
+type Context struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+	Title string `json:"title"`
+}
+
+// DeepLinkingSettings are sent by the platform when it asks the tool to pick content to link to.
+type DeepLinkingSettings struct {
+	ReturnURL   string   `json:"deep_link_return_url"`
+	AcceptTypes []string `json:"accept_types"`
+	Data        string   `json:"data"`
+}
+
+// Accepts returns true if the platform accepts content items of type t.
+func (s *DeepLinkingSettings) Accepts(t string) bool {
+	for _, accepted := range s.AcceptTypes {
+		if accepted == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Launch holds the validated claims of a launch's id token.
+type Launch struct {
+	Platform            *Platform            `json:"-"`
+	Issuer              string               `json:"iss"`
+	Subject             string               `json:"sub"`
+	Audience            audience             `json:"aud"`
+	AuthorizedParty     string               `json:"azp"`
+	ExpiresAt           int64                `json:"exp"`
+	IssuedAt            int64                `json:"iat"`
+	Nonce               string               `json:"nonce"`
+	Email               string               `json:"email"`
+	Name                string               `json:"name"`
+	GivenName           string               `json:"given_name"`
+	FamilyName          string               `json:"family_name"`
+	MessageType         string               `json:"https://purl.imsglobal.org/spec/lti/claim/message_type"`
+	Version             string               `json:"https://purl.imsglobal.org/spec/lti/claim/version"`
+	DeploymentID        string               `json:"https://purl.imsglobal.org/spec/lti/claim/deployment_id"`
+	TargetLinkURI       string               `json:"https://purl.imsglobal.org/spec/lti/claim/target_link_uri"`
+	Roles               []string             `json:"https://purl.imsglobal.org/spec/lti/claim/roles"`
+	Context             *Context             `json:"https://purl.imsglobal.org/spec/lti/claim/context"`
+	Custom              map[string]string    `json:"https://purl.imsglobal.org/spec/lti/claim/custom"`
+	DeepLinkingSettings *DeepLinkingSettings `json:"https://purl.imsglobal.org/spec/lti-dl/claim/deep_linking_settings"`
+}
+
+// DisplayName returns the user's full name, falling back to their given and family names.
+func (l *Launch) DisplayName() string {
+	if l.Name != "" {
+		return l.Name
+	}
+	return strings.TrimSpace(l.GivenName + " " + l.FamilyName)
+}
+
+// HasRole returns true if the launching user has any of the roles in the launch's context. Short role names (e.g.
+// "Instructor"), deprecated but still sent by some platforms, are treated as context roles.
+func (l *Launch) HasRole(roles ...string) bool {
+	for _, have := range l.Roles {
+		if !strings.Contains(have, "://") {
+			have = contextRolePrefix + have
+		}
+
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// audience is the aud claim, which may be a single string or an array of strings.
+type audience []string
+
+// UnmarshalJSON allows audience to satisfy the json.Unmarshaler interface.
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(b, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+// contains returns true if s is one of the audiences.
+func (a audience) contains(s string) bool {
+	for _, aud := range a {
+		if aud == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ContentItem is an item the tool returns to the platform in a deep linking response.
+type ContentItem struct {
+	Type   string            `json:"type"`
+	Title  string            `json:"title,omitempty"`
+	Text   string            `json:"text,omitempty"`
+	URL    string            `json:"url,omitempty"`
+	Custom map[string]string `json:"custom,omitempty"`
+}
+
+// LoginRequest is a platform's request to start the OIDC login flow before a launch.
+type LoginRequest struct {
+	Issuer        string
+	LoginHint     string
+	TargetLinkURI string
+	MessageHint   string
+	ClientID      string
+	DeploymentID  string
+}
+
+// Tool is the app's side of LTI: the platforms it trusts and the key it signs its own messages with.
+type Tool struct {
+	Platforms []Platform
+	key       *rsa.PrivateKey
+	keyID     string
+	keySets   *keySetCache
+}
+
+// NewTool returns a tool for the platforms. key signs deep linking responses and is required if there are platforms.
+func NewTool(platforms []Platform, key *rsa.PrivateKey) (*Tool, error) {
+	t := &Tool{
+		Platforms: platforms,
+		key:       key,
+		keySets: &keySetCache{
+			client: &http.Client{Timeout: keySetFetchTimeout},
+			sets:   make(map[string]*keySet),
+		},
+	}
+
+	if len(platforms) > 0 && key == nil {
+		return nil, errors.New("a private key is required to use LTI platforms")
+	}
+
+	if key != nil {
+		var err error
+		t.keyID, err = KeyID(&key.PublicKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "key id error")
+		}
+	}
+	return t, nil
+}
+
+// IsEnabled returns true if any platforms are registered.
+func (t *Tool) IsEnabled() bool {
+	return len(t.Platforms) > 0
+}
+
+// Platform returns the registered platform with the issuer. If clientID is set it must also match, which allows a
+// platform to register the tool more than once.
+func (t *Tool) Platform(issuer, clientID string) (*Platform, bool) {
+	for i := range t.Platforms {
+		p := &t.Platforms[i]
+		if p.Issuer == issuer && (clientID == "" || p.ClientID == clientID) {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// JWKS returns the tool's public key set so platforms can verify messages signed by the tool.
+func (t *Tool) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	if t.key != nil {
+		jwks.Keys = append(jwks.Keys, NewJWK(&t.key.PublicKey, t.keyID))
+	}
+	return jwks
+}
+
+// AuthURL returns the platform URL to redirect the user to for authentication. The platform posts the id token and
+// state back to redirectURI.
+func (t *Tool) AuthURL(p *Platform, login *LoginRequest, redirectURI, state, nonce string) string {
+	params := url.Values{}
+	params.Set("scope", "openid")
+	params.Set("response_type", "id_token")
+	params.Set("response_mode", "form_post")
+	params.Set("prompt", "none")
+	params.Set("client_id", p.ClientID)
+	params.Set("redirect_uri", redirectURI)
+	params.Set("login_hint", login.LoginHint)
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	if login.MessageHint != "" {
+		params.Set("lti_message_hint", login.MessageHint)
+	}
+
+	separator := "?"
+	if strings.Contains(p.AuthLoginURL, "?") {
+		separator = "&"
+	}
+	return p.AuthLoginURL + separator + params.Encode()
+}
+
+// ValidateLaunch verifies the id token posted by the platform and returns its claims. The token must be signed by a key
+// in the issuing platform's key set, be addressed to the tool, be current, match nonce and be a supported message.
+func (t *Tool) ValidateLaunch(idToken, nonce string) (*Launch, error) {
+	launch := new(Launch)
+	keyFunc := func(kid string) (*rsa.PublicKey, error) {
+		// the issuer is only known after decoding the claims, so peek at them before the signature is checked and then
+		// check the signature against that issuer's keys
+		issuer, err := unverifiedIssuer(idToken)
+		if err != nil {
+			return nil, err
+		}
+
+		p, ok := t.Platform(issuer, "")
+		if !ok {
+			return nil, errors.Wrapf(ErrInvalidLaunch, "unknown issuer %q", issuer)
+		}
+		return t.keySets.key(p.JWKSURL, kid)
+	}
+
+	if err := verifyJWT(idToken, keyFunc, launch); err != nil {
+		if errors.Cause(err) == ErrInvalidToken || errors.Cause(err) == ErrUnknownKey {
+			return nil, errors.Wrap(ErrInvalidLaunch, err.Error())
+		}
+		return nil, err
+	}
+
+	p, ok := t.platformForAudience(launch)
+	if !ok {
+		return nil, errors.Wrap(ErrInvalidLaunch, "token is not addressed to this tool")
+	}
+	launch.Platform = p
+
+	now := time.Now()
+	switch {
+	case now.After(time.Unix(launch.ExpiresAt, 0).Add(clockSkew)):
+		return nil, errors.Wrap(ErrInvalidLaunch, "token has expired")
+	case now.Add(clockSkew).Before(time.Unix(launch.IssuedAt, 0)):
+		return nil, errors.Wrap(ErrInvalidLaunch, "token was issued in the future")
+	case nonce == "" || launch.Nonce != nonce:
+		return nil, errors.Wrap(ErrInvalidLaunch, "nonce does not match")
+	case launch.Version != Version:
+		return nil, errors.Wrapf(ErrInvalidLaunch, "unsupported version %q", launch.Version)
+	case !p.allowsDeployment(launch.DeploymentID):
+		return nil, errors.Wrapf(ErrInvalidLaunch, "unknown deployment %q", launch.DeploymentID)
+	case launch.Subject == "":
+		return nil, errors.Wrap(ErrInvalidLaunch, "anonymous launches are not supported")
+	}
+
+	switch launch.MessageType {
+	case MessageTypeResourceLink:
+	case MessageTypeDeepLinking:
+		if launch.DeepLinkingSettings == nil || launch.DeepLinkingSettings.ReturnURL == "" {
+			return nil, errors.Wrap(ErrInvalidLaunch, "missing deep linking settings")
+		}
+	default:
+		return nil, errors.Wrapf(ErrInvalidLaunch, "unsupported message type %q", launch.MessageType)
+	}
+
+	return launch, nil
+}
+
+// platformForAudience returns the platform that issued the launch to one of the tool's client ids. If the token has
+// more than one audience the authorized party must be the tool.
+func (t *Tool) platformForAudience(launch *Launch) (*Platform, bool) {
+	for i := range t.Platforms {
+		p := &t.Platforms[i]
+		if p.Issuer != launch.Issuer || !launch.Audience.contains(p.ClientID) {
+			continue
+		}
+
+		if len(launch.Audience) > 1 && launch.AuthorizedParty != p.ClientID {
+			continue
+		}
+		return p, true
+	}
+	return nil, false
+}
+
+// DeepLinkingResponse returns a signed JWT for the platform's deep linking return URL containing the selected items.
+func (t *Tool) DeepLinkingResponse(p *Platform, deploymentID string, settings *DeepLinkingSettings,
+	items []ContentItem) (string, error) {
+	nonce, err := RandomString()
+	if err != nil {
+		return "", errors.Wrap(err, "nonce error")
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":                           p.ClientID,
+		"aud":                           p.Issuer,
+		"iat":                           now.Unix(),
+		"exp":                           now.Add(deepLinkingResponseLifetime).Unix(),
+		"nonce":                         nonce,
+		claimPrefix + "message_type":    MessageTypeDeepLinkingResponse,
+		claimPrefix + "version":         Version,
+		claimPrefix + "deployment_id":   deploymentID,
+		dlClaimPrefix + "content_items": items,
+	}
+	if settings.Data != "" {
+		claims[dlClaimPrefix+"data"] = settings.Data
+	}
+
+	token, err := signJWT(claims, t.key, t.keyID)
+	return token, errors.Wrap(err, "sign error")
+}
+
+// RandomString returns a random hex string suitable for states and nonces.
+func RandomString() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// unverifiedIssuer returns the iss claim of a JWT without checking its signature.
+func unverifiedIssuer(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return "", ErrInvalidToken
+	}
+	return claims.Issuer, nil
+}
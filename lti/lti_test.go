@@ -0,0 +1,166 @@
+package lti
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	testIssuer   = "https://lms.example.com"
+	testClientID = "uteach-client"
+	testNonce    = "test-nonce"
+)
+
+// testPlatform is a platform served by a local key set so launches can be signed and validated without an LMS.
+type testPlatform struct {
+	key    *rsa.PrivateKey
+	keyID  string
+	server *httptest.Server
+	tool   *Tool
+}
+
+func newTestPlatform(t *testing.T) *testPlatform {
+	key := generateKey(t)
+	keyID, err := KeyID(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &testPlatform{key: key, keyID: keyID}
+	p.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(JWKS{Keys: []JWK{NewJWK(&key.PublicKey, keyID)}})
+	}))
+
+	p.tool, err = NewTool([]Platform{{
+		Issuer:       testIssuer,
+		ClientID:     testClientID,
+		AuthLoginURL: testIssuer + "/auth",
+		JWKSURL:      p.server.URL,
+	}}, generateKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func generateKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// claims returns the claims of a valid resource link launch.
+func (p *testPlatform) claims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":                           testIssuer,
+		"sub":                           "user-1",
+		"aud":                           testClientID,
+		"iat":                           now.Unix(),
+		"exp":                           now.Add(5 * time.Minute).Unix(),
+		"nonce":                         testNonce,
+		claimPrefix + "message_type":    MessageTypeResourceLink,
+		claimPrefix + "version":         Version,
+		claimPrefix + "deployment_id":   "deployment-1",
+		claimPrefix + "roles":           []string{RoleLearner},
+		claimPrefix + "target_link_uri": "https://uteach.example.com/lti/launch",
+	}
+}
+
+func (p *testPlatform) sign(t *testing.T, claims map[string]interface{}, key *rsa.PrivateKey) string {
+	token, err := signJWT(claims, key, p.keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestValidateLaunch(t *testing.T) {
+	p := newTestPlatform(t)
+	defer p.server.Close()
+
+	launch, err := p.tool.ValidateLaunch(p.sign(t, p.claims(), p.key), testNonce)
+	if err != nil {
+		t.Fatalf("ValidateLaunch() error = %v, want nil", err)
+	}
+	if launch.Subject != "user-1" || launch.Platform.ClientID != testClientID || !launch.HasRole(RoleLearner) {
+		t.Errorf("ValidateLaunch() = %+v, want the launch's claims", launch)
+	}
+}
+
+func TestValidateLaunchRejects(t *testing.T) {
+	p := newTestPlatform(t)
+	defer p.server.Close()
+
+	tests := []struct {
+		name   string
+		modify func(claims map[string]interface{})
+		key    *rsa.PrivateKey
+		nonce  string
+	}{
+		{"unknown issuer", func(c map[string]interface{}) { c["iss"] = "https://other.example.com" }, nil, testNonce},
+		{"other audience", func(c map[string]interface{}) { c["aud"] = "other-client" }, nil, testNonce},
+		{"several audiences without azp", func(c map[string]interface{}) {
+			c["aud"] = []string{testClientID, "other-client"}
+		}, nil, testNonce},
+		{"expired", func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-clockSkew - time.Minute).Unix()
+		}, nil, testNonce},
+		{"issued in the future", func(c map[string]interface{}) {
+			c["iat"] = time.Now().Add(clockSkew + time.Minute).Unix()
+		}, nil, testNonce},
+		{"wrong nonce", nil, nil, "other-nonce"},
+		{"empty nonce", func(c map[string]interface{}) { c["nonce"] = "" }, nil, ""},
+		{"signed by another key", nil, generateKey(t), testNonce},
+		{"anonymous", func(c map[string]interface{}) { delete(c, "sub") }, nil, testNonce},
+		{"unsupported message type", func(c map[string]interface{}) {
+			c[claimPrefix+"message_type"] = "LtiSubmissionReviewRequest"
+		}, nil, testNonce},
+		{"deep linking without settings", func(c map[string]interface{}) {
+			c[claimPrefix+"message_type"] = MessageTypeDeepLinking
+		}, nil, testNonce},
+	}
+
+	for _, test := range tests {
+		claims := p.claims()
+		if test.modify != nil {
+			test.modify(claims)
+		}
+
+		key := p.key
+		if test.key != nil {
+			key = test.key
+		}
+
+		_, err := p.tool.ValidateLaunch(p.sign(t, claims, key), test.nonce)
+		if errors.Cause(err) != ErrInvalidLaunch {
+			t.Errorf("%s: ValidateLaunch() error = %v, want %v", test.name, err, ErrInvalidLaunch)
+		}
+	}
+}
+
+func TestValidateLaunchRejectsTamperedToken(t *testing.T) {
+	p := newTestPlatform(t)
+	defer p.server.Close()
+
+	parts := strings.Split(p.sign(t, p.claims(), p.key), ".")
+	claims := p.claims()
+	claims["sub"] = "user-2"
+	tampered := strings.Split(p.sign(t, claims, generateKey(t)), ".")
+
+	// the other user's claims with the original signature
+	token := parts[0] + "." + tampered[1] + "." + parts[2]
+	if _, err := p.tool.ValidateLaunch(token, testNonce); errors.Cause(err) != ErrInvalidLaunch {
+		t.Errorf("ValidateLaunch() error = %v, want %v", err, ErrInvalidLaunch)
+	}
+}
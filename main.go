@@ -9,6 +9,7 @@ import (
 	"github.com/BrianHarringtonUTSC/uTeach/application"
 	"github.com/BrianHarringtonUTSC/uTeach/config"
 	"github.com/BrianHarringtonUTSC/uTeach/handlers"
+	"github.com/BrianHarringtonUTSC/uTeach/models"
 )
 
 func main() {
@@ -27,6 +28,28 @@ func main() {
 	app := application.New(*conf)
 	defer app.DB.Close()
 
+	// commands run instead of serving, e.g. uteach --config=config.json clone-topic csc108 csc108_fall
+	if flag.NArg() > 0 {
+		if err = runCommand(app, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	app.Scheduler.OnPublish(func(post *models.Post) {
+		log.Printf("Published scheduled post %d: %s\n", post.ID, post.Title)
+	})
+	app.Scheduler.OnPublish(func(post *models.Post) {
+		nm := models.NewNotificationModel(app.DB)
+		notification := &models.Notification{UserID: post.Creator.ID, URL: post.URL(),
+			Message: "Your scheduled post \"" + post.Title + "\" was published."}
+		if err := nm.Add(nil, notification); err != nil {
+			log.Println("Error notifying author of published post:", err)
+		}
+	})
+	app.Scheduler.Start()
+	defer app.Scheduler.Stop()
+
 	router := handlers.Router(app)
 	http.Handle("/", router)
 
@@ -2,6 +2,7 @@
 package middleware
 
 import (
+	"database/sql"
 	"net/http"
 	"strconv"
 	"strings"
@@ -9,7 +10,9 @@ import (
 	"github.com/BrianHarringtonUTSC/uTeach/application"
 	"github.com/BrianHarringtonUTSC/uTeach/context"
 	"github.com/BrianHarringtonUTSC/uTeach/httperror"
+	"github.com/BrianHarringtonUTSC/uTeach/libtemplate"
 	"github.com/BrianHarringtonUTSC/uTeach/models"
+	"github.com/BrianHarringtonUTSC/uTeach/ratelimit"
 	"github.com/BrianHarringtonUTSC/uTeach/session"
 	"github.com/Masterminds/squirrel"
 	"github.com/gorilla/mux"
@@ -21,6 +24,17 @@ type Middleware struct {
 	App *application.App
 }
 
+// bannedError returns the error shown to a banned user.
+func bannedError(user *models.User) error {
+	return errors.Errorf("Your account has been banned: %s", user.SuspensionReason)
+}
+
+// suspendedError returns the error shown to a suspended user that tries to post or vote.
+func suspendedError(user *models.User) error {
+	return errors.Errorf("Your account is suspended until %s: %s",
+		libtemplate.FormatAndLocalizeTime(*user.SuspendedUntil), user.SuspensionReason)
+}
+
 // SetTemplateData sets the map that contain's template data in the context.
 func (m *Middleware) SetTemplateData(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
@@ -51,37 +65,181 @@ func (m *Middleware) SetSessionUser(next http.Handler) http.Handler {
 			http.Redirect(w, r, "/", http.StatusFound)
 			return
 		}
+
+		if user.IsBanned {
+			us.Delete(w, r)
+			httperror.HandleError(w, httperror.StatusError{http.StatusForbidden, bannedError(user)})
+			return
+		}
+
+		context.SetRealSessionUser(r, user)
+		templateData["RealSessionUser"] = user
+
+		impersonation, err := m.activeImpersonation(w, r, us, user)
+		if err != nil {
+			httperror.HandleError(w, errors.Wrap(err, "active impersonation error"))
+			return
+		}
+
+		if impersonation != nil {
+			if !impersonation.AllowWrites && r.Method != "GET" && r.Method != "HEAD" {
+				httperror.HandleError(w, httperror.StatusError{http.StatusForbidden,
+					errors.New("Impersonation is read only, stop impersonating to make changes")})
+				return
+			}
+
+			// the rest of the app sees the impersonated user as the session user
+			user = impersonation.User
+			context.SetImpersonation(r, impersonation)
+			templateData["Impersonation"] = impersonation
+		}
+
+		trm := models.NewTopicRoleModel(m.App.DB)
+		moderatorRoles, err := trm.Find(nil, squirrel.Eq{"topic_roles.user_id": user.ID,
+			"topic_roles.role": []string{models.TopicRoleTA, models.TopicRoleInstructor}})
+		if err != nil {
+			httperror.HandleError(w, errors.Wrap(err, "find topic roles error"))
+			return
+		}
+
+		nm := models.NewNotificationModel(m.App.DB)
+		unreadCount, err := nm.CountUnread(nil, user)
+		if err != nil {
+			httperror.HandleError(w, errors.Wrap(err, "count unread notifications error"))
+			return
+		}
+
 		context.SetSessionUser(r, user)
 		templateData["SessionUser"] = user
+		templateData["ModeratesTopics"] = user.IsAdmin || len(moderatorRoles) > 0
+		templateData["UnreadNotificationCount"] = unreadCount
+
+		if user.IsAdmin || len(moderatorRoles) > 0 {
+			var wheres []squirrel.Sqlizer
+			if !user.IsAdmin {
+				var topicIDs []int64
+				for _, topicRole := range moderatorRoles {
+					topicIDs = append(topicIDs, topicRole.TopicID)
+				}
+
+				// moderators of a topic moderate its sections too
+				tm := models.NewTopicModel(m.App.DB)
+				topicIDs, err = tm.WithSectionIDs(nil, topicIDs)
+				if err != nil {
+					httperror.HandleError(w, errors.Wrap(err, "with section ids error"))
+					return
+				}
+				wheres = append(wheres, squirrel.Eq{"posts.topic_id": topicIDs})
+			}
+
+			pm := models.NewPostModel(m.App.DB)
+			pendingCount, err := pm.CountPending(nil, wheres...)
+			if err != nil {
+				httperror.HandleError(w, errors.Wrap(err, "count pending posts error"))
+				return
+			}
+			templateData["PendingApprovalCount"] = pendingCount
+		}
 		next.ServeHTTP(w, r)
 	}
 
 	return http.HandlerFunc(fn)
 }
 
-// SetTopic sets the topic with the name in the url in the context and template data.
+// activeImpersonation gets the impersonation the admin started in this session with the full impersonated user. It
+// returns nil if there is no impersonation. Timed out impersonations are ended and removed from the session.
+func (m *Middleware) activeImpersonation(w http.ResponseWriter, r *http.Request, us *session.UserSession,
+	admin *models.User) (*models.Impersonation, error) {
+	impersonationID, ok := us.ImpersonationID(r)
+	if !ok {
+		return nil, nil
+	}
+
+	im := models.NewImpersonationModel(m.App.DB)
+	impersonation, err := im.FindOne(nil,
+		squirrel.Eq{"impersonations.id": impersonationID, "impersonations.admin_user_id": admin.ID})
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, us.DeleteImpersonationID(w, r)
+	case err != nil:
+		return nil, errors.Wrap(err, "find one error")
+	}
+
+	if !admin.IsAdmin || !impersonation.IsActive() {
+		if err = im.End(nil, impersonation); err != nil {
+			return nil, errors.Wrap(err, "end error")
+		}
+		return nil, us.DeleteImpersonationID(w, r)
+	}
+
+	um := models.NewUserModel(m.App.DB)
+	impersonation.User, err = um.FindOne(nil, squirrel.Eq{"users.id": impersonation.User.ID})
+	if err != nil {
+		return nil, errors.Wrap(err, "find one error")
+	}
+	return impersonation, nil
+}
+
+// SetTopic sets the topic with the name in the url in the context and template data. Pages of renamed topics are
+// redirected to the topic's new name. The session user's role in a section is their role in its parent if they don't
+// have one in the section.
 func (m *Middleware) SetTopic(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		topicName := strings.ToLower(vars["topicName"])
+		topicName := strings.Replace(strings.ToLower(vars["topicName"]), "/sections/", "/", 1)
 		tm := models.NewTopicModel(m.App.DB)
 		topic, err := tm.FindOne(nil, squirrel.Eq{"topics.name": topicName})
+		if err == sql.ErrNoRows && (r.Method == "GET" || r.Method == "HEAD") {
+			if renamed, err := tm.FindRedirect(nil, topicName); err == nil {
+				url := *r.URL
+				url.Path = renamed.URL() + r.URL.Path[len("/topics/")+len(vars["topicName"]):]
+				http.Redirect(w, r, url.String(), http.StatusMovedPermanently)
+				return
+			}
+		}
 		if err != nil {
 			httperror.HandleError(w, errors.Wrap(err, "find one error"))
 			return
 		}
 
+		// sections of archived topics are read only too
+		if err = tm.LoadParent(nil, topic); err != nil {
+			httperror.HandleError(w, errors.Wrap(err, "load parent error"))
+			return
+		}
+
 		context.SetTopic(r, topic)
 
 		templateData := context.TemplateData(r)
 		templateData["Topic"] = topic
+
+		if user, ok := context.SessionUser(r); ok {
+			trm := models.NewTopicRoleModel(m.App.DB)
+			topicRoles, err := trm.Find(nil, squirrel.Eq{"topic_roles.topic_id": topic.TopicIDs(),
+				"topic_roles.user_id": user.ID})
+			if err != nil {
+				httperror.HandleError(w, errors.Wrap(err, "find topic roles error"))
+				return
+			}
+
+			for _, topicRole := range topicRoles {
+				if _, ok := context.TopicRole(r); !ok || topicRole.TopicID == topic.ID {
+					context.SetTopicRole(r, topicRole)
+					templateData["TopicRole"] = topicRole
+				}
+			}
+		}
+		templateData["IsModerator"] = m.isModerator(r)
+		templateData["IsInstructor"] = m.isInstructor(r)
+
 		next.ServeHTTP(w, r)
 	}
 
 	return http.HandlerFunc(fn)
 }
 
-// SetPost sets the post with the id in the url in the context and template data.
+// SetPost sets the post with the id in the url in the context and template data. Pages of posts in another topic,
+// e.g. moved or cross-posted posts, are redirected to the post's own topic.
 func (m *Middleware) SetPost(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -94,12 +252,25 @@ func (m *Middleware) SetPost(next http.Handler) http.Handler {
 		pm := models.NewPostModel(m.App.DB)
 		topic := context.Topic(r)
 		post, err := pm.FindOne(nil, squirrel.Eq{"posts.id": postID, "posts.topic_id": topic.ID})
+		if err == sql.ErrNoRows && (r.Method == "GET" || r.Method == "HEAD") {
+			// moved and cross-posted posts are shown in their own topic
+			if moved, err := pm.FindOne(nil, squirrel.Eq{"posts.id": postID}); err == nil {
+				http.Redirect(w, r, moved.URL(), http.StatusMovedPermanently)
+				return
+			}
+		}
 		if err != nil {
 			httperror.HandleError(w, errors.Wrap(err, "find one error"))
 			return
 		}
 		context.SetPost(r, post)
 
+		// scheduled posts are only shown to their creator and admins until they are published
+		if post.IsScheduled() && !m.isPostCreator(r) && !m.isAdmin(r) {
+			httperror.HandleError(w, httperror.StatusError{http.StatusNotFound, nil})
+			return
+		}
+
 		templateData := context.TemplateData(r)
 		templateData["Post"] = post
 
@@ -116,13 +287,26 @@ func (m *Middleware) SetTag(next http.Handler) http.Handler {
 		tagName := strings.ToLower(vars["tagName"])
 		topic := context.Topic(r)
 
+		// sections can use their parent's tags but their own tags come first
 		tm := models.NewTagModel(m.App.DB)
-		tag, err := tm.FindOne(nil, squirrel.Eq{"tags.name": tagName, "tags.topic_id": topic.ID})
+		tags, err := tm.Find(nil, squirrel.Eq{"tags.name": tagName, "tags.topic_id": topic.TopicIDs()})
 		if err != nil {
-			httperror.HandleError(w, errors.Wrap(err, "find one error"))
+			httperror.HandleError(w, errors.Wrap(err, "find error"))
+			return
+		}
+
+		if len(tags) == 0 {
+			httperror.HandleError(w, sql.ErrNoRows)
 			return
 		}
 
+		tag := tags[0]
+		for _, t := range tags {
+			if t.Topic.ID == topic.ID {
+				tag = t
+			}
+		}
+
 		context.SetTag(r, tag)
 
 		templateData := context.TemplateData(r)
@@ -132,14 +316,36 @@ func (m *Middleware) SetTag(next http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
+// MustBeTopicTag ensures the tag in the context is the topic's own tag. Sections can use their parent's tags but only
+// the parent's moderators can change them.
+func (m *Middleware) MustBeTopicTag(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if context.Tag(r).Topic.ID != context.Topic(r).ID {
+			httperror.HandleError(w, httperror.StatusError{http.StatusForbidden,
+				errors.New("This tag belongs to the parent topic and can only be changed there")})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
 // MustLogin ensures the next handler is only accessible by users that are logged in.
+// Suspended users may only make read only (GET and HEAD) requests.
 func (m *Middleware) MustLogin(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		if _, ok := context.SessionUser(r); !ok {
+		user, ok := context.SessionUser(r)
+		if !ok {
 			httperror.HandleError(w, httperror.StatusError{http.StatusForbidden, nil})
 			return
 		}
 
+		if user.IsSuspended() && r.Method != "GET" && r.Method != "HEAD" {
+			httperror.HandleError(w, httperror.StatusError{http.StatusForbidden, suspendedError(user)})
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	}
 
@@ -154,7 +360,29 @@ func (m *Middleware) isAdmin(r *http.Request) bool {
 func (m *Middleware) isPostCreator(r *http.Request) bool {
 	post := context.Post(r)
 	user, ok := context.SessionUser(r)
-	return ok && *post.Creator == *user
+	return ok && post.Creator.ID == user.ID
+}
+
+// isModerator returns true if the session user can moderate the topic in the context, i.e. they are an admin or a TA or
+// instructor in the topic.
+func (m *Middleware) isModerator(r *http.Request) bool {
+	if m.isAdmin(r) {
+		return true
+	}
+
+	topicRole, ok := context.TopicRole(r)
+	return ok && topicRole.IsModerator()
+}
+
+// isInstructor returns true if the session user can administer the topic in the context, i.e. they are an admin or an
+// instructor in the topic.
+func (m *Middleware) isInstructor(r *http.Request) bool {
+	if m.isAdmin(r) {
+		return true
+	}
+
+	topicRole, ok := context.TopicRole(r)
+	return ok && topicRole.Role == models.TopicRoleInstructor
 }
 
 // MustBeAdmin ensures the next handler is only accessible by an admin.
@@ -184,3 +412,91 @@ func (m *Middleware) MustBeAdminOrPostCreator(next http.Handler) http.Handler {
 
 	return http.HandlerFunc(fn)
 }
+
+// RateLimit limits how often the next handler can be used by each user and IP address with the limits for the class
+// of route in the config. Classes without limits in the config are unlimited.
+func (m *Middleware) RateLimit(class string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			limits := m.App.Config.RateLimits[class]
+			buckets := map[string]ratelimit.Limit{class + ":ip:" + session.RemoteIP(r): limits.IP}
+
+			if user, ok := context.SessionUser(r); ok {
+				limit := limits.User
+				if user.IsNewAccount(m.App.Config.NewAccountAge) {
+					limit = limits.NewUser
+				}
+				buckets[class+":user:"+strconv.FormatInt(user.ID, 10)] = limit
+			}
+
+			// both buckets are checked at once so a request refused by one doesn't use up the other
+			if err := m.App.Limiter.AllowAll(buckets); err != nil {
+				httperror.HandleError(w, httperror.StatusError{http.StatusTooManyRequests, err})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// MustNotBeArchived ensures the next handler is only accessible if the topic in the context and its parent are not
+// archived.
+func (m *Middleware) MustNotBeArchived(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if context.Topic(r).IsReadOnly() {
+			httperror.HandleError(w, httperror.StatusError{http.StatusForbidden,
+				errors.New("This topic is archived and read only")})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// MustBeInstructor ensures the next handler is only accessible by an admin or an instructor of the topic in the context.
+func (m *Middleware) MustBeInstructor(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if !m.isInstructor(r) {
+			httperror.HandleError(w, httperror.StatusError{http.StatusForbidden, nil})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// MustNotBeLocked ensures the next handler is only accessible if the post in the context is not locked. Moderators of
+// the topic can still change locked posts.
+func (m *Middleware) MustNotBeLocked(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if context.Post(r).IsLocked && !m.isModerator(r) {
+			httperror.HandleError(w, httperror.StatusError{http.StatusForbidden, errors.New("This post is locked")})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// MustBeModerator ensures the next handler is only accessible by a moderator of the topic in the context.
+func (m *Middleware) MustBeModerator(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if !m.isModerator(r) {
+			httperror.HandleError(w, httperror.StatusError{http.StatusForbidden, nil})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
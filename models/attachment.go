@@ -0,0 +1,146 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// attachmentContentTypes are the content types files can be attached with, as sniffed by http.DetectContentType.
+// Source code and other text files are sniffed as plain text.
+var attachmentContentTypes = map[string]bool{
+	"image/png":                 true,
+	"image/jpeg":                true,
+	"image/gif":                 true,
+	"application/pdf":           true,
+	"text/plain; charset=utf-8": true,
+}
+
+// Attachment is a file attached to a post. The file is stored in the app's storage at Key.
+type Attachment struct {
+	ID          int64
+	PostID      int64 `db:"post_id"`
+	UserID      int64 `db:"user_id"`
+	Key         string
+	Filename    string
+	ContentType string `db:"content_type"`
+	Size        int64
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+// IsImage returns true if the attachment is an image that can be shown in the page.
+func (a *Attachment) IsImage() bool {
+	return strings.HasPrefix(a.ContentType, "image/")
+}
+
+// URL returns the URL to download the attachment of the post.
+func (a *Attachment) URL(post *Post) string {
+	return post.URL() + fmt.Sprintf("/attachments/%d", a.ID)
+}
+
+// HumanSize returns the size of the attachment in KB or MB.
+func (a *Attachment) HumanSize() string {
+	return HumanSize(a.Size)
+}
+
+// IsValid returns true if the attachment is valid else false.
+func (a *Attachment) IsValid() bool {
+	return a.PostID > 0 && a.UserID > 0 && a.Key != "" && strings.TrimSpace(a.Filename) != "" && a.Size > 0 &&
+		attachmentContentTypes[a.ContentType]
+}
+
+// HumanSize returns a number of bytes in KB or MB.
+func HumanSize(size int64) string {
+	if size < 1<<20 {
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+}
+
+// AttachmentModel handles getting, adding and deleting post attachments.
+type AttachmentModel struct {
+	Base
+}
+
+// NewAttachmentModel returns a new attachment model.
+func NewAttachmentModel(db *sqlx.DB) *AttachmentModel {
+	return &AttachmentModel{Base{db}}
+}
+
+var (
+	// ErrInvalidAttachment is returned when adding an invalid attachment.
+	ErrInvalidAttachment = InputError{"Attachments must be PNG, JPEG or GIF images, PDFs or text files"}
+
+	attachmentsBuilder = squirrel.Select("post_attachments.*").
+				From("post_attachments").
+				Join("posts ON posts.id=post_attachments.post_id").
+				Join("topics ON topics.id=posts.topic_id").
+				OrderBy("post_attachments.id")
+)
+
+// Find gets all attachments filtered by wheres in the order they were added. Attachments can be filtered by their post
+// and its topic.
+func (am *AttachmentModel) Find(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) ([]*Attachment, error) {
+	selectBuilder := am.addWheresToBuilder(attachmentsBuilder, wheres...)
+	query, args, err := selectBuilder.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+
+	var attachments []*Attachment
+	err = am.sel(tx, &attachments, query, args...)
+	return attachments, errors.Wrap(err, "select error")
+}
+
+// FindOne gets the attachment filtered by wheres.
+func (am *AttachmentModel) FindOne(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) (*Attachment, error) {
+	attachments, err := am.Find(tx, wheres...)
+	if err != nil {
+		return nil, errors.Wrap(err, "find error")
+	}
+
+	switch len(attachments) {
+	case 0:
+		return nil, sql.ErrNoRows
+	case 1:
+		return attachments[0], nil
+	default:
+		return nil, errors.Errorf("expected 1, got %d", len(attachments))
+	}
+}
+
+// Add adds a new attachment. The file must already be in storage.
+func (am *AttachmentModel) Add(tx *sqlx.Tx, attachment *Attachment) error {
+	attachment.Filename = strings.TrimSpace(attachment.Filename)
+	if !attachment.IsValid() {
+		return ErrInvalidAttachment
+	}
+
+	result, err := am.exec(tx, `INSERT INTO post_attachments(post_id, user_id, key, filename, content_type, size)
+		VALUES(?, ?, ?, ?, ?, ?)`, attachment.PostID, attachment.UserID, attachment.Key, attachment.Filename,
+		attachment.ContentType, attachment.Size)
+	if err != nil {
+		return errors.Wrap(err, "exec error")
+	}
+
+	attachment.ID, err = result.LastInsertId()
+	return errors.Wrap(err, "last inserted id error")
+}
+
+// Delete deletes the attachment. The caller should delete its file from storage once the deletion is committed.
+func (am *AttachmentModel) Delete(tx *sqlx.Tx, attachment *Attachment) error {
+	_, err := am.exec(tx, "DELETE FROM post_attachments WHERE id=?", attachment.ID)
+	return errors.Wrap(err, "exec error")
+}
+
+// UsedBytes returns the total size of the files the user has attached, which counts towards their quota.
+func (am *AttachmentModel) UsedBytes(tx *sqlx.Tx, user *User) (int64, error) {
+	var used int64
+	err := am.get(tx, &used, "SELECT COALESCE(SUM(size), 0) FROM post_attachments WHERE user_id=?", user.ID)
+	return used, errors.Wrap(err, "get error")
+}
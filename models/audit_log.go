@@ -0,0 +1,150 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// Actions recorded in the audit log.
+const (
+	AuditActionPinPost          = "pin_post"
+	AuditActionUnpinPost        = "unpin_post"
+	AuditActionLockPost         = "lock_post"
+	AuditActionUnlockPost       = "unlock_post"
+	AuditActionHidePost         = "hide_post"
+	AuditActionUnhidePost       = "unhide_post"
+	AuditActionAddTopic         = "add_topic"
+	AuditActionAddTag           = "add_tag"
+	AuditActionSetRole          = "set_role"
+	AuditActionGrantAdmin       = "grant_admin"
+	AuditActionAddFilterRule    = "add_filter_rule"
+	AuditActionDeleteFilterRule = "delete_filter_rule"
+	AuditActionApprovePost      = "approve_post"
+	AuditActionRejectPost       = "reject_post"
+	AuditActionUpdateTopic      = "update_topic"
+	AuditActionRenameTopic      = "rename_topic"
+	AuditActionArchiveTopic     = "archive_topic"
+	AuditActionUnarchiveTopic   = "unarchive_topic"
+	AuditActionDeleteTopic      = "delete_topic"
+	AuditActionUpdateTag        = "update_tag"
+	AuditActionMergeTag         = "merge_tag"
+	AuditActionDeleteTag        = "delete_tag"
+	AuditActionUpdateSettings   = "update_settings"
+	AuditActionMovePost         = "move_post"
+	AuditActionCrossPost        = "cross_post"
+	AuditActionDeleteCrossPost  = "delete_cross_post"
+	AuditActionCloneTopic       = "clone_topic"
+	AuditActionAddField         = "add_field"
+	AuditActionDeleteField      = "delete_field"
+)
+
+// AuditActions are all the actions recorded in the audit log.
+var AuditActions = []string{
+	AuditActionPinPost, AuditActionUnpinPost, AuditActionLockPost, AuditActionUnlockPost, AuditActionHidePost, AuditActionUnhidePost, AuditActionAddTopic,
+	AuditActionAddTag, AuditActionSetRole, AuditActionGrantAdmin, AuditActionAddFilterRule, AuditActionDeleteFilterRule,
+	AuditActionApprovePost, AuditActionRejectPost, AuditActionUpdateTopic, AuditActionRenameTopic, AuditActionArchiveTopic,
+	AuditActionUnarchiveTopic, AuditActionDeleteTopic, AuditActionUpdateTag, AuditActionMergeTag, AuditActionDeleteTag,
+	AuditActionUpdateSettings, AuditActionMovePost, AuditActionCrossPost, AuditActionDeleteCrossPost,
+	AuditActionCloneTopic, AuditActionAddField, AuditActionDeleteField,
+}
+
+// Types of things audit log entries act on.
+const (
+	AuditTargetPost       = "post"
+	AuditTargetTopic      = "topic"
+	AuditTargetTag        = "tag"
+	AuditTargetUser       = "user"
+	AuditTargetFilterRule = "filter_rule"
+)
+
+// AuditEntry is a record of an admin or moderator action. Actor is nil for actions uTeach took on its own (e.g. hiding
+// a post that was reported too many times) and Topic is nil for actions outside of a topic.
+type AuditEntry struct {
+	ID         int64
+	Actor      *User
+	Action     string
+	Topic      *Topic
+	TargetType string
+	TargetID   int64
+	Details    string
+	CreatedAt  time.Time
+}
+
+// AuditLogModel handles appending to and getting the audit log. Entries can never be changed or deleted.
+type AuditLogModel struct {
+	Base
+}
+
+// NewAuditLogModel returns a new audit log model.
+func NewAuditLogModel(db *sqlx.DB) *AuditLogModel {
+	return &AuditLogModel{Base{db}}
+}
+
+var auditLogBuilder = squirrel.
+	Select(`audit_log.id, audit_log.action, audit_log.target_type, audit_log.target_id, audit_log.details,
+		audit_log.created_at,
+		actors.id, actors.handle, actors.name,
+		topics.id, topics.name, topics.title`).
+	From("audit_log").
+	LeftJoin("users AS actors ON actors.id=audit_log.actor_user_id").
+	LeftJoin("topics ON topics.id=audit_log.topic_id").
+	OrderBy("audit_log.created_at DESC, audit_log.id DESC")
+
+// Find gets the audit log entries filtered by wheres, newest first.
+func (alm *AuditLogModel) Find(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) ([]*AuditEntry, error) {
+	rows, err := alm.queryWhere(tx, auditLogBuilder, wheres...)
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+
+	var entries []*AuditEntry
+	for rows.Next() {
+		entry := new(AuditEntry)
+		var actorID, topicID sql.NullInt64
+		var actorHandle, actorName, topicName, topicTitle sql.NullString
+		err = rows.Scan(&entry.ID, &entry.Action, &entry.TargetType, &entry.TargetID, &entry.Details, &entry.CreatedAt,
+			&actorID, &actorHandle, &actorName,
+			&topicID, &topicName, &topicTitle)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan error")
+		}
+
+		if actorID.Valid {
+			entry.Actor = &User{ID: actorID.Int64, Handle: actorHandle.String, Name: actorName.String}
+		}
+		if topicID.Valid {
+			entry.Topic = &Topic{ID: topicID.Int64, Name: topicName.String, Title: topicTitle.String}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Add appends the entry to the audit log. It should use the same tx as the action it records so that one is never
+// committed without the other.
+func (alm *AuditLogModel) Add(tx *sqlx.Tx, entry *AuditEntry) error {
+	var actorID, topicID *int64
+	if entry.Actor != nil {
+		actorID = &entry.Actor.ID
+	}
+	if entry.Topic != nil {
+		topicID = &entry.Topic.ID
+	}
+
+	now := time.Now().UTC()
+	result, err := alm.exec(tx, `INSERT INTO audit_log(actor_user_id, action, topic_id, target_type, target_id, details,
+		created_at) VALUES(?, ?, ?, ?, ?, ?, ?)`,
+		actorID, entry.Action, topicID, entry.TargetType, entry.TargetID, entry.Details, now)
+	if err != nil {
+		return errors.Wrap(err, "exec error")
+	}
+
+	entry.ID, err = result.LastInsertId()
+	entry.CreatedAt = now
+	return errors.Wrap(err, "last inserted id error")
+}
@@ -7,6 +7,7 @@ package models
 import (
 	"database/sql/driver"
 	"regexp"
+	"time"
 
 	"github.com/Masterminds/squirrel"
 	"github.com/jmoiron/sqlx"
@@ -62,6 +63,16 @@ func (b *Base) query(tx *sqlx.Tx, query string, args ...interface{}) (*sqlx.Rows
 	return b.db.Queryx(query, args...)
 }
 
+// utcTime converts t to UTC so stored times can be compared with each other and CURRENT_TIMESTAMP. It returns nil if t
+// is nil.
+func utcTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	utc := t.UTC()
+	return &utc
+}
+
 func (b *Base) addWheresToBuilder(selectBuilder squirrel.SelectBuilder, wheres ...squirrel.Sqlizer) squirrel.SelectBuilder {
 	for _, where := range wheres {
 		selectBuilder = selectBuilder.Where(where)
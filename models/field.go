@@ -0,0 +1,257 @@
+package models
+
+import (
+	"database/sql"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// Types of custom post fields.
+const (
+	FieldTypeText   = "text"
+	FieldTypeNumber = "number"
+	FieldTypeEnum   = "enum"
+)
+
+// Field is a custom field of the posts in a topic and its sections, e.g. an assignment number. Enum fields have a
+// comma separated list of options to choose from.
+type Field struct {
+	ID         int64
+	TopicID    int64 `db:"topic_id"`
+	Name       string
+	Label      string
+	Type       string
+	Options    string
+	IsRequired bool `db:"is_required"`
+}
+
+// OptionList returns the options of an enum field.
+func (f *Field) OptionList() []string {
+	var options []string
+	for _, option := range strings.Split(f.Options, ",") {
+		if option = strings.TrimSpace(option); option != "" {
+			options = append(options, option)
+		}
+	}
+	return options
+}
+
+// IsValid returns true if the field is valid else false.
+func (f *Field) IsValid() bool {
+	switch f.Type {
+	case FieldTypeText, FieldTypeNumber:
+	case FieldTypeEnum:
+		if len(f.OptionList()) == 0 {
+			return false
+		}
+	default:
+		return false
+	}
+	return f.TopicID > 0 && singleWordAlphaNumRegex.MatchString(f.Name) && strings.TrimSpace(f.Label) != ""
+}
+
+// Validate returns the value of the field trimmed, or an input error if it isn't a valid value of the field. Numbers
+// are returned in a normal form (e.g. 01 and 1.0 become 1). Empty values are only valid for optional fields.
+func (f *Field) Validate(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch {
+	case value == "" && f.IsRequired:
+		return "", InputError{f.Label + " is required"}
+	case value == "":
+		return "", nil
+	case f.Type == FieldTypeNumber:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsInf(number, 0) || math.IsNaN(number) {
+			return "", InputError{f.Label + " must be a number"}
+		}
+		return strconv.FormatFloat(number, 'f', -1, 64), nil
+	case f.Type == FieldTypeEnum:
+		for _, option := range f.OptionList() {
+			if value == option {
+				return value, nil
+			}
+		}
+		return "", InputError{f.Label + " must be one of " + strings.Join(f.OptionList(), ", ")}
+	}
+	return value, nil
+}
+
+// Filter filters posts whose value of the field matches value, or contains it for text fields. Numbers are compared
+// by value, so no posts match a value that isn't a number.
+func (f *Field) Filter(value string) squirrel.Sqlizer {
+	switch f.Type {
+	case FieldTypeText:
+		return squirrel.Expr(`posts.id IN (SELECT post_id FROM post_field_values WHERE field_id=? AND value LIKE ?
+			ESCAPE '\')`, f.ID, "%"+likeEscaper.Replace(value)+"%")
+	case FieldTypeNumber:
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return squirrel.Expr("0")
+		}
+		return squirrel.Expr(`posts.id IN (SELECT post_id FROM post_field_values WHERE field_id=?
+			AND CAST(value AS REAL)=?)`, f.ID, number)
+	}
+	return squirrel.Expr("posts.id IN (SELECT post_id FROM post_field_values WHERE field_id=? AND value=?)", f.ID,
+		value)
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// FieldModel handles getting, adding and deleting custom post fields and their values.
+type FieldModel struct {
+	Base
+}
+
+// NewFieldModel returns a new field model.
+func NewFieldModel(db *sqlx.DB) *FieldModel {
+	return &FieldModel{Base{db}}
+}
+
+var (
+	// ErrInvalidField is returned when adding an invalid field.
+	ErrInvalidField = InputError{"Fields need a single word name, a label, a type of text, number or enum and " +
+		"options for enums"}
+
+	// ErrFieldNameTaken is returned when adding a field with the name of another field in the topic.
+	ErrFieldNameTaken = InputError{"Field name is already taken"}
+
+	fieldsBuilder = squirrel.Select("* FROM topic_fields").OrderBy("topic_fields.id")
+
+	postFieldValuesBuilder = squirrel.Select("post_id, field_id, value").From("post_field_values")
+)
+
+// Find gets all fields filtered by wheres in the order they were added.
+func (fm *FieldModel) Find(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) ([]*Field, error) {
+	selectBuilder := fm.addWheresToBuilder(fieldsBuilder, wheres...)
+	query, args, err := selectBuilder.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+
+	var fields []*Field
+	err = fm.sel(tx, &fields, query, args...)
+	return fields, errors.Wrap(err, "select error")
+}
+
+// FindOne gets the field filtered by wheres.
+func (fm *FieldModel) FindOne(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) (*Field, error) {
+	fields, err := fm.Find(tx, wheres...)
+	if err != nil {
+		return nil, errors.Wrap(err, "find error")
+	}
+
+	switch len(fields) {
+	case 0:
+		return nil, sql.ErrNoRows
+	case 1:
+		return fields[0], nil
+	default:
+		return nil, errors.Errorf("expected 1, got %d", len(fields))
+	}
+}
+
+// Add adds a new field.
+func (fm *FieldModel) Add(tx *sqlx.Tx, field *Field) error {
+	field.Name = strings.ToLower(field.Name)
+	if !field.IsValid() {
+		return ErrInvalidField
+	}
+
+	_, err := fm.FindOne(tx, squirrel.Eq{"topic_fields.name": field.Name, "topic_fields.topic_id": field.TopicID})
+	if err == nil {
+		return ErrFieldNameTaken
+	} else if err != sql.ErrNoRows {
+		return errors.Wrap(err, "find one error")
+	}
+
+	result, err := fm.exec(tx, `INSERT INTO topic_fields(topic_id, name, label, type, options, is_required)
+		VALUES(?, ?, ?, ?, ?, ?)`, field.TopicID, field.Name, strings.TrimSpace(field.Label), field.Type,
+		strings.Join(field.OptionList(), ","), field.IsRequired)
+	if err != nil {
+		return errors.Wrap(err, "exec error")
+	}
+
+	field.ID, err = result.LastInsertId()
+	return errors.Wrap(err, "last inserted id error")
+}
+
+// Delete deletes the field and its values.
+func (fm *FieldModel) Delete(tx *sqlx.Tx, field *Field) error {
+	_, err := fm.exec(tx, "DELETE FROM topic_fields WHERE id=?", field.ID)
+	return errors.Wrap(err, "exec error")
+}
+
+// FindForPosts sets the field values of each of the posts.
+func (fm *FieldModel) FindForPosts(tx *sqlx.Tx, posts []*Post) error {
+	byID := make(map[int64][]*Post)
+	var postIDs []int64
+	for _, post := range posts {
+		if _, ok := byID[post.ID]; !ok {
+			postIDs = append(postIDs, post.ID)
+		}
+		byID[post.ID] = append(byID[post.ID], post)
+		post.FieldValues = make(map[int64]string)
+	}
+
+	if len(postIDs) == 0 {
+		return nil
+	}
+
+	rows, err := fm.queryWhere(tx, postFieldValuesBuilder, squirrel.Eq{"post_id": postIDs})
+	if err != nil {
+		return errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID, fieldID int64
+		var value string
+		if err = rows.Scan(&postID, &fieldID, &value); err != nil {
+			return errors.Wrap(err, "scan error")
+		}
+
+		for _, post := range byID[postID] {
+			post.FieldValues[fieldID] = value
+		}
+	}
+	return nil
+}
+
+// validateValues returns the values of the post's fields in its topic, checked and trimmed with Field.Validate.
+// Values of other fields are left out.
+func (fm *FieldModel) validateValues(tx *sqlx.Tx, post *Post) (map[int64]string, error) {
+	fields, err := fm.Find(tx, squirrel.Eq{"topic_fields.topic_id": post.Topic.TopicIDs()})
+	if err != nil {
+		return nil, errors.Wrap(err, "find error")
+	}
+
+	values := make(map[int64]string)
+	for _, field := range fields {
+		value, err := field.Validate(post.FieldValues[field.ID])
+		if err != nil {
+			return nil, err
+		}
+		if value != "" {
+			values[field.ID] = value
+		}
+	}
+	return values, nil
+}
+
+// addValues adds the values of the post's fields by field id.
+func (fm *FieldModel) addValues(tx *sqlx.Tx, postID int64, values map[int64]string) error {
+	for fieldID, value := range values {
+		_, err := fm.exec(tx, "INSERT INTO post_field_values(post_id, field_id, value) VALUES(?, ?, ?)", postID,
+			fieldID, value)
+		if err != nil {
+			return errors.Wrap(err, "exec error")
+		}
+	}
+	return nil
+}
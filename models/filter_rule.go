@@ -0,0 +1,219 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// Kinds of patterns a filter rule can match.
+const (
+	FilterKindWord   = "word"
+	FilterKindRegex  = "regex"
+	FilterKindDomain = "domain"
+)
+
+// Actions taken on posts that match a filter rule, from least to most severe.
+const (
+	FilterActionFlag   = "flag"
+	FilterActionHold   = "hold"
+	FilterActionReject = "reject"
+)
+
+// FilterKinds and FilterActions are the kinds and actions in the order they are shown.
+var (
+	FilterKinds   = []string{FilterKindWord, FilterKindRegex, FilterKindDomain}
+	FilterActions = []string{FilterActionReject, FilterActionHold, FilterActionFlag}
+)
+
+// filterActionSeverity is used to pick the action to take when a post matches several rules.
+var filterActionSeverity = map[string]int{FilterActionFlag: 1, FilterActionHold: 2, FilterActionReject: 3}
+
+// FilterRule is a rule checked against the title and content of posts when they are added or edited. Rules with a nil
+// Topic apply to every topic.
+//
+// Words match whole words ignoring case, regexes are Go regular expressions and domains match links to the domain or
+// any of its subdomains. Matching posts are rejected, held (hidden and added to the moderation queue) or flagged (added
+// to the moderation queue).
+type FilterRule struct {
+	ID        int64
+	Topic     *Topic
+	Kind      string
+	Pattern   string
+	Action    string
+	CreatedAt time.Time
+}
+
+// regexp compiles the rule's pattern into a regular expression.
+func (fr *FilterRule) regexp() (*regexp.Regexp, error) {
+	switch fr.Kind {
+	case FilterKindWord:
+		return regexp.Compile(`(?i)\b` + regexp.QuoteMeta(fr.Pattern) + `\b`)
+	case FilterKindRegex:
+		return regexp.Compile(fr.Pattern)
+	case FilterKindDomain:
+		domain := strings.TrimPrefix(strings.ToLower(fr.Pattern), "www.")
+		return regexp.Compile(`(?i)(^|[^[:alnum:].-])([[:alnum:]-]+\.)*` + regexp.QuoteMeta(domain) + `($|[^[:alnum:].-]|\.[^[:alnum:]])`)
+	}
+	return nil, errors.Errorf("unknown filter kind %q", fr.Kind)
+}
+
+// Matches returns true if the post's title or content matches the rule.
+func (fr *FilterRule) Matches(post *Post) bool {
+	re, err := fr.regexp()
+	return err == nil && re.MatchString(post.Title+"\n"+post.Content)
+}
+
+// String describes the rule, e.g. domain "example.com".
+func (fr *FilterRule) String() string {
+	return fmt.Sprintf("%s %q", fr.Kind, fr.Pattern)
+}
+
+// IsValid returns true if the filter rule is valid else false.
+func (fr *FilterRule) IsValid() bool {
+	if fr.Pattern == "" || filterActionSeverity[fr.Action] == 0 {
+		return false
+	}
+	_, err := fr.regexp()
+	return err == nil
+}
+
+// FilterResult is the outcome of checking a post against the filter rules.
+type FilterResult struct {
+	// Action is the most severe action of the matching rules.
+	Action string
+	Rules  []*FilterRule
+}
+
+// Description lists the matching rules for moderators.
+func (fr *FilterResult) Description() string {
+	var rules []string
+	for _, rule := range fr.Rules {
+		rules = append(rules, rule.String())
+	}
+	return "Matched " + strings.Join(rules, ", ")
+}
+
+// FilterRuleModel handles getting, creating and checking filter rules.
+type FilterRuleModel struct {
+	Base
+}
+
+// NewFilterRuleModel returns a new filter rule model.
+func NewFilterRuleModel(db *sqlx.DB) *FilterRuleModel {
+	return &FilterRuleModel{Base{db}}
+}
+
+var (
+	// ErrInvalidFilterRule is returned when adding a filter rule with an unknown kind or action or a bad pattern.
+	ErrInvalidFilterRule = InputError{"Filter rules need a pattern (regexes must compile), a kind and an action"}
+
+	// ErrPostRejected is returned when adding or updating a post that matches a reject rule.
+	ErrPostRejected = InputError{"Your post contains content that is not allowed here"}
+)
+
+var filterRulesBuilder = squirrel.
+	Select(`filter_rules.id, filter_rules.kind, filter_rules.pattern, filter_rules.action, filter_rules.created_at,
+		topics.id, topics.name, topics.title`).
+	From("filter_rules").
+	LeftJoin("topics ON topics.id=filter_rules.topic_id").
+	OrderBy("topics.name, filter_rules.id")
+
+// Find gets all filter rules filtered by wheres, site wide rules first.
+func (frm *FilterRuleModel) Find(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) ([]*FilterRule, error) {
+	rows, err := frm.queryWhere(tx, filterRulesBuilder, wheres...)
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+
+	var rules []*FilterRule
+	for rows.Next() {
+		rule := new(FilterRule)
+		var topicID sql.NullInt64
+		var topicName, topicTitle sql.NullString
+		err = rows.Scan(&rule.ID, &rule.Kind, &rule.Pattern, &rule.Action, &rule.CreatedAt,
+			&topicID, &topicName, &topicTitle)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan error")
+		}
+
+		if topicID.Valid {
+			rule.Topic = &Topic{ID: topicID.Int64, Name: topicName.String, Title: topicTitle.String}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// FindForTopic gets the site wide rules and the rules for the topic. The rules of a section's parent apply to the
+// section too.
+func (frm *FilterRuleModel) FindForTopic(tx *sqlx.Tx, topic *Topic) ([]*FilterRule, error) {
+	return frm.Find(tx, squirrel.Or{squirrel.Eq{"filter_rules.topic_id": nil},
+		squirrel.Eq{"filter_rules.topic_id": topic.TopicIDs()}})
+}
+
+// Add adds a new filter rule.
+func (frm *FilterRuleModel) Add(tx *sqlx.Tx, rule *FilterRule) error {
+	rule.Pattern = strings.TrimSpace(rule.Pattern)
+	if !rule.IsValid() {
+		return ErrInvalidFilterRule
+	}
+
+	var topicID *int64
+	if rule.Topic != nil {
+		topicID = &rule.Topic.ID
+	}
+
+	now := time.Now().UTC()
+	result, err := frm.exec(tx,
+		"INSERT INTO filter_rules(topic_id, kind, pattern, action, created_at) VALUES(?, ?, ?, ?, ?)",
+		topicID, rule.Kind, rule.Pattern, rule.Action, now)
+	if err != nil {
+		return errors.Wrap(err, "exec error")
+	}
+
+	rule.ID, err = result.LastInsertId()
+	rule.CreatedAt = now
+	return errors.Wrap(err, "last inserted id error")
+}
+
+// Delete deletes the filter rule.
+func (frm *FilterRuleModel) Delete(tx *sqlx.Tx, rule *FilterRule) error {
+	_, err := frm.exec(tx, "DELETE FROM filter_rules WHERE id=?", rule.ID)
+	return errors.Wrap(err, "exec error")
+}
+
+// Check checks the post against the rules for its topic. It returns nil if no rule matches.
+func (frm *FilterRuleModel) Check(tx *sqlx.Tx, post *Post) (*FilterResult, error) {
+	rules, err := frm.FindForTopic(tx, post.Topic)
+	if err != nil {
+		return nil, errors.Wrap(err, "find for topic error")
+	}
+	return CheckFilterRules(rules, post), nil
+}
+
+// CheckFilterRules checks the post against the rules. It returns nil if no rule matches.
+func CheckFilterRules(rules []*FilterRule, post *Post) *FilterResult {
+	var result *FilterResult
+	for _, rule := range rules {
+		if !rule.Matches(post) {
+			continue
+		}
+
+		if result == nil {
+			result = new(FilterResult)
+		}
+		if filterActionSeverity[rule.Action] > filterActionSeverity[result.Action] {
+			result.Action = rule.Action
+		}
+		result.Rules = append(result.Rules, rule)
+	}
+	return result
+}
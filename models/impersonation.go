@@ -0,0 +1,134 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// ImpersonationTimeout is how long an admin can act as another user before the impersonation automatically ends.
+const ImpersonationTimeout = time.Hour
+
+// Impersonation is a period where an admin acts as another user (e.g. to reproduce a problem the user reported).
+// Impersonations are read only unless AllowWrites is set.
+type Impersonation struct {
+	ID          int64
+	Admin       *User
+	User        *User
+	AllowWrites bool
+	StartedAt   time.Time
+	EndedAt     *time.Time
+}
+
+// IsActive returns true if the impersonation has not been ended and has not timed out.
+func (i *Impersonation) IsActive() bool {
+	return i.EndedAt == nil && time.Since(i.StartedAt) < ImpersonationTimeout
+}
+
+// ImpersonationModel handles getting, starting and ending impersonations.
+type ImpersonationModel struct {
+	Base
+}
+
+// NewImpersonationModel returns a new impersonation model.
+func NewImpersonationModel(db *sqlx.DB) *ImpersonationModel {
+	return &ImpersonationModel{Base{db}}
+}
+
+var (
+	// ErrInvalidImpersonation is returned when an admin tries to impersonate themselves or another admin.
+	ErrInvalidImpersonation = InputError{"Admins can only impersonate other non admin users"}
+)
+
+var impersonationsBuilder = squirrel.
+	Select(`impersonations.id, impersonations.allow_writes, impersonations.started_at, impersonations.ended_at,
+		admins.id, admins.handle, admins.name,
+		users.id, users.handle, users.name`).
+	From("impersonations").
+	Join("users AS admins ON admins.id=impersonations.admin_user_id").
+	Join("users ON users.id=impersonations.user_id").
+	OrderBy("impersonations.started_at DESC, impersonations.id DESC")
+
+// Find gets all impersonations filtered by wheres, newest first.
+func (im *ImpersonationModel) Find(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) ([]*Impersonation, error) {
+	rows, err := im.queryWhere(tx, impersonationsBuilder, wheres...)
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+
+	var impersonations []*Impersonation
+	for rows.Next() {
+		impersonation := &Impersonation{Admin: new(User), User: new(User)}
+		err = rows.Scan(&impersonation.ID, &impersonation.AllowWrites, &impersonation.StartedAt, &impersonation.EndedAt,
+			&impersonation.Admin.ID, &impersonation.Admin.Handle, &impersonation.Admin.Name,
+			&impersonation.User.ID, &impersonation.User.Handle, &impersonation.User.Name)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan error")
+		}
+		impersonations = append(impersonations, impersonation)
+	}
+	return impersonations, nil
+}
+
+// FindOne gets the impersonation filtered by wheres.
+func (im *ImpersonationModel) FindOne(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) (*Impersonation, error) {
+	impersonations, err := im.Find(tx, wheres...)
+	if err != nil {
+		return nil, errors.Wrap(err, "find error")
+	}
+
+	switch len(impersonations) {
+	case 0:
+		return nil, sql.ErrNoRows
+	case 1:
+		return impersonations[0], nil
+	default:
+		return nil, errors.Errorf("expected 1, got %d", len(impersonations))
+	}
+}
+
+// Add starts a new impersonation.
+func (im *ImpersonationModel) Add(tx *sqlx.Tx, impersonation *Impersonation) error {
+	if !impersonation.Admin.IsAdmin || impersonation.User.IsAdmin || impersonation.Admin.ID == impersonation.User.ID {
+		return ErrInvalidImpersonation
+	}
+
+	result, err := im.exec(tx, "INSERT INTO impersonations(admin_user_id, user_id, allow_writes, started_at) VALUES(?, ?, ?, ?)",
+		impersonation.Admin.ID, impersonation.User.ID, impersonation.AllowWrites, time.Now().UTC())
+	if err != nil {
+		return errors.Wrap(err, "exec error")
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return errors.Wrap(err, "last inserted id error")
+	}
+
+	i, err := im.FindOne(tx, squirrel.Eq{"impersonations.id": id})
+	if err != nil {
+		return errors.Wrap(err, "find one error")
+	}
+
+	*impersonation = *i
+	return nil
+}
+
+// End ends the impersonation if it has not already ended.
+func (im *ImpersonationModel) End(tx *sqlx.Tx, impersonation *Impersonation) error {
+	if impersonation.EndedAt != nil {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	_, err := im.exec(tx, "UPDATE impersonations SET ended_at=? WHERE id=?", now, impersonation.ID)
+	if err != nil {
+		return errors.Wrap(err, "exec error")
+	}
+
+	impersonation.EndedAt = &now
+	return nil
+}
@@ -0,0 +1,96 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// LTIStateLifetime is how long a user has to complete an LTI login with their platform before the state expires.
+const LTIStateLifetime = 10 * time.Minute
+
+// LTIModel handles the state of LTI logins and the links between platform courses and users and the app's topics and
+// users. Platforms are identified by their issuer.
+type LTIModel struct {
+	Base
+}
+
+// NewLTIModel returns a new LTI model.
+func NewLTIModel(db *sqlx.DB) *LTIModel {
+	return &LTIModel{Base{db}}
+}
+
+// AddState stores the state and nonce of a login that was started, removing any expired ones.
+func (lm *LTIModel) AddState(tx *sqlx.Tx, state, nonce string) error {
+	now := time.Now().UTC()
+	if _, err := lm.exec(tx, "DELETE FROM lti_states WHERE created_at<?", now.Add(-LTIStateLifetime)); err != nil {
+		return errors.Wrap(err, "delete exec error")
+	}
+
+	_, err := lm.exec(tx, "INSERT INTO lti_states(state, nonce, created_at) VALUES(?, ?, ?)", state, nonce, now)
+	return errors.Wrap(err, "insert exec error")
+}
+
+// ConsumeState returns the nonce of an unexpired login state and removes it so it can only be used once. Only the
+// caller whose delete removes the state gets its nonce, so it should be called in a tx. Returns sql.ErrNoRows if there
+// is no such state.
+func (lm *LTIModel) ConsumeState(tx *sqlx.Tx, state string) (string, error) {
+	var nonce string
+	err := lm.get(tx, &nonce, "SELECT nonce FROM lti_states WHERE state=? AND created_at>=?",
+		state, time.Now().UTC().Add(-LTIStateLifetime))
+	if err != nil {
+		return "", err
+	}
+
+	result, err := lm.exec(tx, "DELETE FROM lti_states WHERE state=?", state)
+	if err != nil {
+		return "", errors.Wrap(err, "exec error")
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return "", errors.Wrap(err, "rows affected error")
+	}
+	if deleted == 0 {
+		return "", sql.ErrNoRows
+	}
+	return nonce, nil
+}
+
+// LTIContext is the link between a platform's context and a topic.
+type LTIContext struct {
+	TopicID     int64 `db:"topic_id"`
+	GrantsRoles bool  `db:"grants_roles"` // the topic was created for the context, so the platform's roles apply in it
+}
+
+// FindContext gets the link of the platform's context. Returns sql.ErrNoRows if there is none.
+func (lm *LTIModel) FindContext(tx *sqlx.Tx, issuer, contextID string) (*LTIContext, error) {
+	ltiContext := new(LTIContext)
+	err := lm.get(tx, ltiContext, "SELECT topic_id, grants_roles FROM lti_contexts WHERE issuer=? AND context_id=?",
+		issuer, contextID)
+	return ltiContext, err
+}
+
+// LinkContext links the platform's context to the topic, replacing any existing link.
+func (lm *LTIModel) LinkContext(tx *sqlx.Tx, issuer, contextID string, ltiContext *LTIContext) error {
+	_, err := lm.exec(tx,
+		"INSERT OR REPLACE INTO lti_contexts(issuer, context_id, topic_id, grants_roles) VALUES(?, ?, ?, ?)",
+		issuer, contextID, ltiContext.TopicID, ltiContext.GrantsRoles)
+	return errors.Wrap(err, "exec error")
+}
+
+// FindUserID gets the id of the user linked to the platform's subject. Returns sql.ErrNoRows if there is none.
+func (lm *LTIModel) FindUserID(tx *sqlx.Tx, issuer, subject string) (int64, error) {
+	var userID int64
+	err := lm.get(tx, &userID, "SELECT user_id FROM lti_users WHERE issuer=? AND subject=?", issuer, subject)
+	return userID, err
+}
+
+// LinkUser links the platform's subject to the user.
+func (lm *LTIModel) LinkUser(tx *sqlx.Tx, issuer, subject string, userID int64) error {
+	_, err := lm.exec(tx, "INSERT OR REPLACE INTO lti_users(issuer, subject, user_id) VALUES(?, ?, ?)",
+		issuer, subject, userID)
+	return errors.Wrap(err, "exec error")
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// Notification is a message to a user about something that happened to them, e.g. their post being approved.
+type Notification struct {
+	ID        int64
+	UserID    int64 `db:"user_id"`
+	Message   string
+	URL       string
+	CreatedAt time.Time  `db:"created_at"`
+	ReadAt    *time.Time `db:"read_at"`
+}
+
+// NotificationModel handles getting, creating and reading notifications.
+type NotificationModel struct {
+	Base
+}
+
+// NewNotificationModel returns a new notification model.
+func NewNotificationModel(db *sqlx.DB) *NotificationModel {
+	return &NotificationModel{Base{db}}
+}
+
+var notificationsBuilder = squirrel.Select("* FROM notifications").OrderBy("created_at DESC, id DESC")
+
+// Find gets all notifications filtered by wheres, newest first.
+func (nm *NotificationModel) Find(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) ([]*Notification, error) {
+	selectBuilder := nm.addWheresToBuilder(notificationsBuilder, wheres...)
+	query, args, err := selectBuilder.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+
+	var notifications []*Notification
+	err = nm.sel(tx, &notifications, query, args...)
+	return notifications, errors.Wrap(err, "select error")
+}
+
+// Add sends a new notification.
+func (nm *NotificationModel) Add(tx *sqlx.Tx, notification *Notification) error {
+	notification.Message = strings.TrimSpace(notification.Message)
+	now := time.Now().UTC()
+	result, err := nm.exec(tx, "INSERT INTO notifications(user_id, message, url, created_at) VALUES(?, ?, ?, ?)",
+		notification.UserID, notification.Message, notification.URL, now)
+	if err != nil {
+		return errors.Wrap(err, "exec error")
+	}
+
+	notification.ID, err = result.LastInsertId()
+	notification.CreatedAt = now
+	return errors.Wrap(err, "last inserted id error")
+}
+
+// CountUnread returns how many notifications the user has not read.
+func (nm *NotificationModel) CountUnread(tx *sqlx.Tx, user *User) (int, error) {
+	var count int
+	err := nm.get(tx, &count, "SELECT count(*) FROM notifications WHERE user_id=? AND read_at IS NULL", user.ID)
+	return count, errors.Wrap(err, "get error")
+}
+
+// MarkAllRead marks all of the user's notifications as read.
+func (nm *NotificationModel) MarkAllRead(tx *sqlx.Tx, user *User) error {
+	_, err := nm.exec(tx, "UPDATE notifications SET read_at=? WHERE user_id=? AND read_at IS NULL",
+		time.Now().UTC(), user.ID)
+	return errors.Wrap(err, "exec error")
+}
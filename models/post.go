@@ -13,17 +13,57 @@ import (
 	"github.com/russross/blackfriday"
 )
 
-// Post represents a post in the app.
+// Approval states of posts that needed a moderator's approval. Other posts have an empty approval.
+const (
+	PostApprovalPending  = "pending"
+	PostApprovalApproved = "approved"
+	PostApprovalRejected = "rejected"
+)
+
+// Who hid a hidden post. Posts hidden by their creator can be unhidden by them, the others only by moderators.
+const (
+	PostHiddenByCreator   = "creator"
+	PostHiddenByFilter    = "filter"
+	PostHiddenByReports   = "reports"
+	PostHiddenByModerator = "moderator"
+)
+
+// Post represents a post in the app. Posts with a PublishAt in the future are scheduled and are left out of listings
+// until then. IsPinned is false once PinnedUntil has passed. Pending posts are hidden until a moderator approves them.
+// The creator of an anonymous post is only shown to moderators and the creator. HiddenBy is who hid a hidden post.
 type Post struct {
-	ID        int64
-	Title     string
-	Content   string
-	CreatedAt time.Time
-	IsPinned  bool
-	IsVisible bool
-	Score     int
-	Topic     *Topic
-	Creator   *User
+	ID          int64
+	Title       string
+	Content     string
+	CreatedAt   time.Time
+	IsPinned    bool
+	IsVisible   bool
+	HiddenBy    string
+	IsLocked    bool
+	PublishAt   *time.Time
+	PinnedUntil *time.Time
+	Approval    string
+	IsAnonymous bool
+	FieldValues map[int64]string
+	Tags        []*Tag
+	Score       int
+	Topic       *Topic
+	Creator     *User
+}
+
+// IsPending returns true if the post is waiting for a moderator's approval.
+func (p *Post) IsPending() bool {
+	return p.Approval == PostApprovalPending
+}
+
+// IsHiddenByCreator returns true if the post was hidden by its creator, who can unhide it.
+func (p *Post) IsHiddenByCreator() bool {
+	return !p.IsVisible && p.HiddenBy == PostHiddenByCreator
+}
+
+// IsScheduled returns true if the post will be published in the future.
+func (p *Post) IsScheduled() bool {
+	return p.PublishAt != nil && p.PublishAt.After(time.Now())
 }
 
 // URL returns the unique URL for a post.
@@ -54,25 +94,82 @@ func NewPostModel(db *sqlx.DB) *PostModel {
 	return &PostModel{Base{db}}
 }
 
+// pinnedSQL is true for posts that are pinned and whose pin hasn't expired. Times are stored in UTC so they can be
+// compared with CURRENT_TIMESTAMP.
+const pinnedSQL = "(posts.is_pinned AND (posts.pinned_until IS NULL OR posts.pinned_until > CURRENT_TIMESTAMP))"
+
+// publishedSQL is true for posts that aren't scheduled for later.
+const publishedSQL = "(posts.publish_at IS NULL OR posts.publish_at <= CURRENT_TIMESTAMP)"
+
+var (
+	// PinnedPosts, UnpinnedPosts and PublishedPosts filter posts by whether they are currently pinned or published.
+	PinnedPosts    = squirrel.Expr(pinnedSQL)
+	UnpinnedPosts  = squirrel.Expr("NOT " + pinnedSQL)
+	PublishedPosts = squirrel.Expr(publishedSQL)
+
+	// VisiblePosts filters out hidden posts.
+	VisiblePosts = squirrel.Expr("posts.is_visible")
+
+	// duePublicationsPosts filters scheduled posts that have been published but not announced yet.
+	duePublicationsPosts = squirrel.Expr(
+		"posts.publish_at IS NOT NULL AND posts.publish_at <= CURRENT_TIMESTAMP AND NOT posts.publish_announced")
+)
+
 var (
 	// ErrInvalidPost is returned when adding or updating an invalid post
 	ErrInvalidPost = InputError{"Invalid post id or empty title or empty body"}
 
-	postsBuilder = squirrel.
-			Select(`posts.id, posts.title, posts.content, posts.created_at, posts.is_pinned, posts.is_visible,
+	// ErrSamePostTopic is returned when moving or cross-posting a post to its own topic.
+	ErrSamePostTopic = InputError{"The post is already in that topic"}
+
+	postsSelectBuilder = squirrel.
+			Select(`posts.id, posts.title, posts.content, posts.created_at, ` + pinnedSQL + `, posts.is_visible,
+			posts.hidden_by, posts.is_locked, posts.publish_at, posts.pinned_until, posts.approval, posts.is_anonymous,
 			count(post_votes.post_id),
-			topics.id, topics.name, topics.title, topics.description,
-			users.id, users.email, users.name, users.is_admin`).
+			topics.id, topics.name, topics.title, topics.description, topics.parent_topic_id,
+			users.id, users.email, users.handle, users.name, users.avatar_key, users.is_admin`).
 			From("posts").
 			Join("topics ON topics.id=posts.topic_id").
 			Join("users ON users.id=posts.creator_user_id").
-			LeftJoin("post_votes ON post_votes.post_id=posts.id").
+			LeftJoin("post_votes ON post_votes.post_id=posts.id")
+
+	postsBuilder = postsSelectBuilder.
 			LeftJoin("post_tags ON post_tags.post_id=posts.id").
 			GroupBy("posts.id, post_tags.tag_id").
 			OrderBy("count(post_votes.post_id) DESC, posts.created_at DESC").
 			Distinct()
+
+	// postsPageBuilder lists each post once so it can be paginated. Filter by tags with a TagFilter.
+	postsPageBuilder = postsSelectBuilder.GroupBy("posts.id")
 )
 
+// Ways to sort a page of posts.
+const (
+	PostSortTop = "top"
+	PostSortNew = "new"
+)
+
+// postSortOrders are the ORDER BY clauses of the post sorts.
+var postSortOrders = map[string]string{
+	PostSortTop: "count(post_votes.post_id) DESC, posts.created_at DESC, posts.id DESC",
+	PostSortNew: "posts.created_at DESC, posts.id DESC",
+}
+
+// IsValidPostSort returns true if sort is one of the post sorts.
+func IsValidPostSort(sort string) bool {
+	_, ok := postSortOrders[sort]
+	return ok
+}
+
+// postsSortedBuilder selects each post once in the sort order, top posts if the sort is unknown.
+func postsSortedBuilder(sort string) squirrel.SelectBuilder {
+	order, ok := postSortOrders[sort]
+	if !ok {
+		order = postSortOrders[PostSortTop]
+	}
+	return postsPageBuilder.OrderBy(order)
+}
+
 // Find gets all posts filtered by wheres.
 func (pm *PostModel) Find(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) ([]*Post, error) {
 	rows, err := pm.queryWhere(tx, postsBuilder, wheres...)
@@ -80,16 +177,44 @@ func (pm *PostModel) Find(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) ([]*Post, err
 		return nil, errors.Wrap(err, "query error")
 	}
 	defer rows.Close()
+	return scanPosts(rows)
+}
+
+// FindSorted gets all posts filtered by wheres in the sort order, top posts if the sort is unknown.
+func (pm *PostModel) FindSorted(tx *sqlx.Tx, sort string, wheres ...squirrel.Sqlizer) ([]*Post, error) {
+	rows, err := pm.queryWhere(tx, postsSortedBuilder(sort), wheres...)
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+	return scanPosts(rows)
+}
 
+// FindPage gets a page of posts filtered by wheres in the sort order, top posts if the sort is unknown. Unlike Find
+// each post is only listed once.
+func (pm *PostModel) FindPage(tx *sqlx.Tx, sort string, limit, offset uint64, wheres ...squirrel.Sqlizer) ([]*Post,
+	error) {
+	selectBuilder := postsSortedBuilder(sort).Limit(limit).Offset(offset)
+	rows, err := pm.queryWhere(tx, selectBuilder, wheres...)
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+	return scanPosts(rows)
+}
+
+// scanPosts scans rows selected by postsSelectBuilder.
+func scanPosts(rows *sqlx.Rows) ([]*Post, error) {
 	var posts []*Post
 	for rows.Next() {
 		post := new(Post)
 		topic := new(Topic)
 		creator := new(User)
 
-		err = rows.Scan(&post.ID, &post.Title, &post.Content, &post.CreatedAt, &post.IsPinned, &post.IsVisible, &post.Score,
-			&topic.ID, &topic.Name, &topic.Title, &topic.Description,
-			&creator.ID, &creator.Email, &creator.Name, &creator.IsAdmin)
+		err := rows.Scan(&post.ID, &post.Title, &post.Content, &post.CreatedAt, &post.IsPinned, &post.IsVisible,
+			&post.HiddenBy, &post.IsLocked, &post.PublishAt, &post.PinnedUntil, &post.Approval, &post.IsAnonymous, &post.Score,
+			&topic.ID, &topic.Name, &topic.Title, &topic.Description, &topic.ParentID,
+			&creator.ID, &creator.Email, &creator.Handle, &creator.Name, &creator.AvatarKey, &creator.IsAdmin)
 		if err != nil {
 			return nil, errors.Wrap(err, "scan error")
 		}
@@ -119,45 +244,103 @@ func (pm *PostModel) FindOne(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) (*Post, er
 	}
 }
 
-// Add adds a new post.
+// Add adds a new post with the values of its topic's custom fields in FieldValues by field id. Pending posts are hidden.
+// The post is checked against the filter rules for its topic first, see applyFilterRules.
 func (pm *PostModel) Add(tx *sqlx.Tx, post *Post) error {
+	return pm.add(tx, post, true)
+}
+
+// add adds a new post, see Add. Filter rules are skipped if filter is false, e.g. for posts copied by moderators.
+func (pm *PostModel) add(tx *sqlx.Tx, post *Post, filter bool) error {
 	if !post.IsValid() || post.ID > 0 {
 		return ErrInvalidPost
 	}
 
-	result, err := pm.exec(tx, "INSERT INTO posts(title, content, topic_id, creator_user_id) VALUES(?, ?, ?, ?)",
-		post.Title, post.Content, post.Topic.ID, post.Creator.ID)
+	fm := NewFieldModel(pm.db)
+	fieldValues, err := fm.validateValues(tx, post)
+	if err != nil {
+		return err
+	}
+
+	post.IsVisible = !post.IsPending()
+	var result *FilterResult
+	if filter {
+		if result, err = pm.applyFilterRules(tx, post); err != nil {
+			return err
+		}
+	}
+
+	insert, err := pm.exec(tx, `INSERT INTO posts(title, content, topic_id, creator_user_id, is_visible, hidden_by,
+		is_pinned, publish_at, pinned_until, approval, is_anonymous) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		post.Title, post.Content, post.Topic.ID, post.Creator.ID, post.IsVisible, post.HiddenBy, post.IsPinned,
+		utcTime(post.PublishAt), utcTime(post.PinnedUntil), post.Approval, post.IsAnonymous)
 	if err != nil {
 		return errors.Wrap(err, "exec error")
 	}
 
-	id, err := result.LastInsertId()
+	id, err := insert.LastInsertId()
 	if err != nil {
 		return errors.Wrap(err, "last inserted id error")
 	}
 
+	if err = pm.reportFilterResult(tx, id, result); err != nil {
+		return err
+	}
+
+	if err = fm.addValues(tx, id, fieldValues); err != nil {
+		return errors.Wrap(err, "add field values error")
+	}
+
 	p, err := pm.FindOne(tx, squirrel.Eq{"posts.id": id})
 	if err != nil {
 		return errors.Wrap(err, "find one error")
 	}
 
+	p.FieldValues = fieldValues
 	*post = *p
 	return nil
 }
 
-// Update updates a post.
+// Update updates a post. If the title or content changed the post is checked against the filter rules for its topic
+// first, see applyFilterRules.
 func (pm *PostModel) Update(tx *sqlx.Tx, post *Post) error {
 	if post.ID < 1 || !post.IsValid() {
 		return ErrInvalidPost
 	}
 
-	_, err := pm.exec(tx, "UPDATE posts SET title=?, content=?, is_pinned=?, is_visible=? WHERE id=?",
-		post.Title, post.Content, post.IsPinned, post.IsVisible, post.ID)
+	var current struct {
+		Title   string
+		Content string
+	}
+	err := pm.get(tx, &current, "SELECT title, content FROM posts WHERE id=?", post.ID)
+	if err != nil {
+		return errors.Wrap(err, "get error")
+	}
+
+	var result *FilterResult
+	if current.Title != post.Title || current.Content != post.Content {
+		if result, err = pm.applyFilterRules(tx, post); err != nil {
+			return err
+		}
+	}
+
+	if post.IsVisible {
+		post.HiddenBy = ""
+	}
+
+	_, err = pm.exec(tx, `UPDATE posts SET title=?, content=?, is_pinned=?, is_visible=?, hidden_by=?, is_locked=?,
+		pinned_until=?, approval=? WHERE id=?`,
+		post.Title, post.Content, post.IsPinned, post.IsVisible, post.HiddenBy, post.IsLocked,
+		utcTime(post.PinnedUntil), post.Approval, post.ID)
 
 	if err != nil {
 		return errors.Wrap(err, "exec error")
 	}
 
+	if err = pm.reportFilterResult(tx, post.ID, result); err != nil {
+		return err
+	}
+
 	p, err := pm.FindOne(tx, squirrel.Eq{"posts.id": post.ID})
 	if err != nil {
 		return errors.Wrap(err, "find one error")
@@ -167,6 +350,89 @@ func (pm *PostModel) Update(tx *sqlx.Tx, post *Post) error {
 	return nil
 }
 
+// applyFilterRules checks the post against the filter rules for its topic. Posts matching a reject rule return
+// ErrPostRejected and posts matching a hold rule are hidden. The result is nil if no rule matched.
+func (pm *PostModel) applyFilterRules(tx *sqlx.Tx, post *Post) (*FilterResult, error) {
+	frm := NewFilterRuleModel(pm.db)
+	result, err := frm.Check(tx, post)
+	if err != nil {
+		return nil, errors.Wrap(err, "check filter rules error")
+	}
+
+	if result != nil {
+		switch result.Action {
+		case FilterActionReject:
+			return nil, ErrPostRejected
+		case FilterActionHold:
+			post.IsVisible = false
+			post.HiddenBy = PostHiddenByFilter
+		}
+	}
+	return result, nil
+}
+
+// reportFilterResult adds held and flagged posts to the moderation queue.
+func (pm *PostModel) reportFilterResult(tx *sqlx.Tx, postID int64, result *FilterResult) error {
+	if result == nil {
+		return nil
+	}
+
+	rm := NewReportModel(pm.db)
+	err := rm.Add(tx, &Report{PostID: postID, Reason: ReportReasonFilter, Details: result.Description()})
+	if err == ErrAlreadyReported {
+		// still waiting for a moderator from an earlier edit
+		return nil
+	}
+	return errors.Wrap(err, "add report error")
+}
+
+// CountApproved returns how many of the user's posts in the topic did not need approval or were approved.
+func (pm *PostModel) CountApproved(tx *sqlx.Tx, topic *Topic, user *User) (int, error) {
+	var count int
+	err := pm.get(tx, &count, "SELECT count(*) FROM posts WHERE topic_id=? AND creator_user_id=? AND approval IN (?, ?)",
+		topic.ID, user.ID, "", PostApprovalApproved)
+	return count, errors.Wrap(err, "get error")
+}
+
+// CountPending returns how many posts filtered by wheres are waiting for approval.
+func (pm *PostModel) CountPending(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) (int, error) {
+	selectBuilder := pm.addWheresToBuilder(squirrel.Select("count(*)").From("posts"),
+		append(wheres, squirrel.Eq{"posts.approval": PostApprovalPending})...)
+	query, args, err := selectBuilder.ToSql()
+	if err != nil {
+		return 0, errors.Wrap(err, "sql error")
+	}
+
+	var count int
+	err = pm.get(tx, &count, query, args...)
+	return count, errors.Wrap(err, "get error")
+}
+
+// FindDuePublications gets the scheduled posts that have been published since the last call and marks them as
+// announced so that each post is only returned once.
+func (pm *PostModel) FindDuePublications(tx *sqlx.Tx) ([]*Post, error) {
+	posts, err := pm.Find(tx, duePublicationsPosts)
+	if err != nil {
+		return nil, errors.Wrap(err, "find error")
+	}
+
+	// posts are found once per tag
+	seen := make(map[int64]bool)
+	var due []*Post
+	for _, post := range posts {
+		if seen[post.ID] {
+			continue
+		}
+		seen[post.ID] = true
+
+		if _, err = pm.exec(tx, "UPDATE posts SET publish_announced=1 WHERE id=?", post.ID); err != nil {
+			return nil, errors.Wrap(err, "exec error")
+		}
+		due = append(due, post)
+	}
+	return due, nil
+}
+
 // GetVotedPostIds gets the ids of upvoted posts filtered by wheres. It returns a map that acts as a set (all values
 // are true) which can be used for quick lookup.
 func (pm *PostModel) GetVotedPostIds(tx *sqlx.Tx, where squirrel.Sqlizer) (map[int64]bool, error) {
@@ -198,3 +464,110 @@ func (pm *PostModel) UpdatePostVoteForUser(tx *sqlx.Tx, post *Post, user *User,
 	}
 	return errors.Wrap(err, "exec error")
 }
+
+// InTopics filters posts that are in or cross-posted to any of the topics.
+func InTopics(topicIDs ...int64) squirrel.Sqlizer {
+	args := make([]interface{}, len(topicIDs))
+	for i, topicID := range topicIDs {
+		args[i] = topicID
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(topicIDs)), ",")
+	crossposted := squirrel.Expr("posts.id IN (SELECT post_id FROM post_crossposts WHERE topic_id IN ("+placeholders+"))",
+		args...)
+	return squirrel.Or{squirrel.Eq{"posts.topic_id": topicIDs}, crossposted}
+}
+
+// Move moves the post to the topic. Its tags are replaced by the tags with the same names that can be used in the
+// topic and tags without one are dropped and returned. Values of custom fields the topic doesn't have are dropped.
+// Cross-posts to the topic are removed as the post is now in it.
+func (pm *PostModel) Move(tx *sqlx.Tx, post *Post, topic *Topic) ([]*Tag, error) {
+	if post.Topic.ID == topic.ID {
+		return nil, ErrSamePostTopic
+	}
+
+	tm := NewTagModel(pm.db)
+	if err := tm.FindForPosts(tx, []*Post{post}); err != nil {
+		return nil, errors.Wrap(err, "find tags for post error")
+	}
+	oldTags := post.Tags
+
+	if _, err := pm.exec(tx, "UPDATE posts SET topic_id=? WHERE id=?", topic.ID, post.ID); err != nil {
+		return nil, errors.Wrap(err, "exec error")
+	}
+
+	if _, err := pm.exec(tx, "DELETE FROM post_crossposts WHERE post_id=? AND topic_id=?", post.ID, topic.ID); err != nil {
+		return nil, errors.Wrap(err, "exec error")
+	}
+
+	if _, err := pm.exec(tx, "DELETE FROM post_tags WHERE post_id=?", post.ID); err != nil {
+		return nil, errors.Wrap(err, "exec error")
+	}
+
+	query, args, err := squirrel.Delete("post_field_values").Where(squirrel.Eq{"post_id": post.ID}).
+		Where("field_id NOT IN (SELECT id FROM topic_fields WHERE topic_id IN (?, ?))", topic.ID, topic.ParentID).
+		ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+	if _, err = pm.exec(tx, query, args...); err != nil {
+		return nil, errors.Wrap(err, "exec error")
+	}
+
+	p, err := pm.FindOne(tx, squirrel.Eq{"posts.id": post.ID})
+	if err != nil {
+		return nil, errors.Wrap(err, "find one error")
+	}
+	*post = *p
+
+	var dropped []*Tag
+	for _, oldTag := range oldTags {
+		tags, err := tm.Find(tx, squirrel.Eq{"tags.name": oldTag.Name, "tags.topic_id": topic.TopicIDs()})
+		if err != nil {
+			return nil, errors.Wrap(err, "find tags error")
+		}
+
+		if len(tags) == 0 {
+			dropped = append(dropped, oldTag)
+			continue
+		}
+
+		// sections can use their parent's tags but their own tags come first
+		tag := tags[0]
+		for _, t := range tags {
+			if t.Topic.ID == topic.ID {
+				tag = t
+			}
+		}
+
+		if err = tm.AddPostTag(tx, post, tag); err != nil {
+			return nil, errors.Wrap(err, "add post tag error")
+		}
+	}
+
+	return dropped, nil
+}
+
+// CrossPostTopics gets the topics the post is cross-posted to.
+func (pm *PostModel) CrossPostTopics(tx *sqlx.Tx, post *Post) ([]*Topic, error) {
+	tm := NewTopicModel(pm.db)
+	topics, err := tm.Find(tx, squirrel.Expr("topics.id IN (SELECT topic_id FROM post_crossposts WHERE post_id=?)",
+		post.ID))
+	return topics, errors.Wrap(err, "find error")
+}
+
+// AddCrossPost makes the post also appear in the topic.
+func (pm *PostModel) AddCrossPost(tx *sqlx.Tx, post *Post, topic *Topic) error {
+	if post.Topic.ID == topic.ID {
+		return ErrSamePostTopic
+	}
+
+	_, err := pm.exec(tx, "INSERT OR IGNORE INTO post_crossposts(post_id, topic_id) VALUES(?, ?)", post.ID, topic.ID)
+	return errors.Wrap(err, "exec error")
+}
+
+// DeleteCrossPost stops the post from appearing in the topic.
+func (pm *PostModel) DeleteCrossPost(tx *sqlx.Tx, post *Post, topic *Topic) error {
+	_, err := pm.exec(tx, "DELETE FROM post_crossposts WHERE post_id=? AND topic_id=?", post.ID, topic.ID)
+	return errors.Wrap(err, "exec error")
+}
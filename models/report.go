@@ -0,0 +1,197 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// ReportReason is a category users pick when reporting a post.
+type ReportReason struct {
+	Name  string
+	Label string
+}
+
+// ReportReasonFilter is the reason for reports made automatically when a post matches a hold or flag filter rule.
+const ReportReasonFilter = "filter"
+
+// ReportReasons are the reasons users can report a post for, in the order they are shown.
+var ReportReasons = []ReportReason{
+	{"spam", "Spam"},
+	{"inappropriate", "Inappropriate or offensive"},
+	{"off_topic", "Off topic"},
+	{"other", "Other"},
+}
+
+// Ways a moderator can resolve the reports on a post.
+const (
+	ReportResolutionHidden    = "hidden"
+	ReportResolutionDismissed = "dismissed"
+	ReportResolutionSuspended = "suspended"
+)
+
+// Report is a user flagging a post for moderators to review. Reports are open until a moderator resolves them.
+// Reporter is nil for reports made by the content filter.
+type Report struct {
+	ID         int64
+	PostID     int64
+	Reporter   *User
+	Reason     string
+	Details    string
+	CreatedAt  time.Time
+	ResolvedAt *time.Time
+	Resolution string
+}
+
+// ReasonLabel returns the human readable reason.
+func (r *Report) ReasonLabel() string {
+	if r.Reason == ReportReasonFilter {
+		return "Content filter"
+	}
+	for _, reason := range ReportReasons {
+		if reason.Name == r.Reason {
+			return reason.Label
+		}
+	}
+	return r.Reason
+}
+
+// IsValid returns true if the report is valid else false.
+func (r *Report) IsValid() bool {
+	if r.Reason == ReportReasonFilter {
+		return r.PostID > 0 && r.Reporter == nil
+	}
+	for _, reason := range ReportReasons {
+		if reason.Name == r.Reason {
+			return r.PostID > 0 && r.Reporter != nil
+		}
+	}
+	return false
+}
+
+// IsValidReportResolution returns true if resolution is one of the report resolutions.
+func IsValidReportResolution(resolution string) bool {
+	return resolution == ReportResolutionHidden || resolution == ReportResolutionDismissed ||
+		resolution == ReportResolutionSuspended
+}
+
+// ReportModel handles getting, creating and resolving reports.
+type ReportModel struct {
+	Base
+}
+
+// NewReportModel returns a new report model.
+func NewReportModel(db *sqlx.DB) *ReportModel {
+	return &ReportModel{Base{db}}
+}
+
+var (
+	// ErrInvalidReport is returned when adding a report without a valid reason.
+	ErrInvalidReport = InputError{"Choose a reason for reporting the post"}
+
+	// ErrAlreadyReported is returned when a user reports a post they have an open report on.
+	ErrAlreadyReported = InputError{"You have already reported this post"}
+
+	// ErrInvalidReportResolution is returned when resolving reports with an unknown resolution.
+	ErrInvalidReportResolution = InputError{"Reports must be resolved by hiding, dismissing or suspending"}
+)
+
+var reportsBuilder = squirrel.
+	Select(`reports.id, reports.post_id, reports.reason, reports.details, reports.created_at, reports.resolved_at,
+		reports.resolution,
+		reporters.id, reporters.handle, reporters.name`).
+	From("reports").
+	LeftJoin("users AS reporters ON reporters.id=reports.reporter_user_id").
+	Join("posts ON posts.id=reports.post_id").
+	OrderBy("reports.created_at, reports.id")
+
+// Find gets all reports filtered by wheres, oldest first.
+func (rm *ReportModel) Find(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) ([]*Report, error) {
+	rows, err := rm.queryWhere(tx, reportsBuilder, wheres...)
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+
+	var reports []*Report
+	for rows.Next() {
+		report := new(Report)
+		var reporterID sql.NullInt64
+		var reporterHandle, reporterName sql.NullString
+		err = rows.Scan(&report.ID, &report.PostID, &report.Reason, &report.Details, &report.CreatedAt,
+			&report.ResolvedAt, &report.Resolution,
+			&reporterID, &reporterHandle, &reporterName)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan error")
+		}
+
+		if reporterID.Valid {
+			report.Reporter = &User{ID: reporterID.Int64, Handle: reporterHandle.String, Name: reporterName.String}
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// Add adds a new open report. A user (or the content filter) can only have one open report on a post.
+func (rm *ReportModel) Add(tx *sqlx.Tx, report *Report) error {
+	report.Details = strings.TrimSpace(report.Details)
+	if !report.IsValid() {
+		return ErrInvalidReport
+	}
+
+	var reporterID interface{} // nil for the content filter so the query checks IS NULL
+	if report.Reporter != nil {
+		reporterID = report.Reporter.ID
+	}
+
+	query, args, err := squirrel.Select("count(*)").From("reports").
+		Where(squirrel.Eq{"post_id": report.PostID, "reporter_user_id": reporterID, "resolved_at": nil}).ToSql()
+	if err != nil {
+		return errors.Wrap(err, "sql error")
+	}
+
+	var count int
+	if err = rm.get(tx, &count, query, args...); err != nil {
+		return errors.Wrap(err, "get error")
+	}
+	if count > 0 {
+		return ErrAlreadyReported
+	}
+
+	now := time.Now().UTC()
+	result, err := rm.exec(tx,
+		"INSERT INTO reports(post_id, reporter_user_id, reason, details, created_at) VALUES(?, ?, ?, ?, ?)",
+		report.PostID, reporterID, report.Reason, report.Details, now)
+	if err != nil {
+		return errors.Wrap(err, "exec error")
+	}
+
+	report.ID, err = result.LastInsertId()
+	report.CreatedAt = now
+	return errors.Wrap(err, "last inserted id error")
+}
+
+// CountReporters returns the number of distinct users with open reports on the post.
+func (rm *ReportModel) CountReporters(tx *sqlx.Tx, postID int64) (int, error) {
+	var count int
+	err := rm.get(tx, &count,
+		"SELECT count(DISTINCT reporter_user_id) FROM reports WHERE post_id=? AND resolved_at IS NULL", postID)
+	return count, errors.Wrap(err, "get error")
+}
+
+// Resolve resolves all open reports on the post.
+func (rm *ReportModel) Resolve(tx *sqlx.Tx, postID int64, resolver *User, resolution string) error {
+	if !IsValidReportResolution(resolution) {
+		return ErrInvalidReportResolution
+	}
+
+	_, err := rm.exec(tx,
+		"UPDATE reports SET resolved_at=?, resolver_user_id=?, resolution=? WHERE post_id=? AND resolved_at IS NULL",
+		time.Now().UTC(), resolver.ID, resolution, postID)
+	return errors.Wrap(err, "exec error")
+}
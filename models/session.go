@@ -0,0 +1,108 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// Session represents a server side session. Only the token is sent to the client (in a signed cookie), the session's
+// values are encoded in data.
+type Session struct {
+	ID         int64
+	Token      string
+	UserID     sql.NullInt64 `db:"user_id"`
+	Data       string
+	CreatedAt  time.Time `db:"created_at"`
+	LastSeenAt time.Time `db:"last_seen_at"`
+	UserAgent  string    `db:"user_agent"`
+	IPAddress  string    `db:"ip_address"`
+}
+
+// SessionModel handles getting, creating and deleting sessions.
+type SessionModel struct {
+	Base
+}
+
+// NewSessionModel returns a new session model.
+func NewSessionModel(db *sqlx.DB) *SessionModel {
+	return &SessionModel{Base{db}}
+}
+
+var sessionsBuilder = squirrel.Select("* FROM sessions").OrderBy("sessions.last_seen_at DESC")
+
+// Find gets all sessions filtered by wheres, most recently used first.
+func (sm *SessionModel) Find(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) ([]*Session, error) {
+	selectBuilder := sm.addWheresToBuilder(sessionsBuilder, wheres...)
+	query, args, err := selectBuilder.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+
+	var sessions []*Session
+	err = sm.sel(tx, &sessions, query, args...)
+	return sessions, errors.Wrap(err, "select error")
+}
+
+// FindOne gets the session filtered by wheres.
+func (sm *SessionModel) FindOne(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) (*Session, error) {
+	sessions, err := sm.Find(tx, wheres...)
+	if err != nil {
+		return nil, errors.Wrap(err, "find error")
+	}
+
+	switch len(sessions) {
+	case 0:
+		return nil, sql.ErrNoRows
+	case 1:
+		return sessions[0], nil
+	default:
+		return nil, errors.Errorf("expected 1, got %d", len(sessions))
+	}
+}
+
+// Add adds a new session.
+func (sm *SessionModel) Add(tx *sqlx.Tx, session *Session) error {
+	now := time.Now().UTC()
+	result, err := sm.exec(tx, `INSERT INTO sessions(token, user_id, data, created_at, last_seen_at, user_agent, ip_address)
+		VALUES(?, ?, ?, ?, ?, ?, ?)`,
+		session.Token, session.UserID, session.Data, now, now, session.UserAgent, session.IPAddress)
+	if err != nil {
+		return errors.Wrap(err, "exec error")
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return errors.Wrap(err, "last inserted id error")
+	}
+
+	s, err := sm.FindOne(tx, squirrel.Eq{"sessions.id": id})
+	if err != nil {
+		return errors.Wrap(err, "find one error")
+	}
+
+	*session = *s
+	return nil
+}
+
+// Update updates a session's data, user and client metadata.
+func (sm *SessionModel) Update(tx *sqlx.Tx, session *Session) error {
+	_, err := sm.exec(tx, `UPDATE sessions SET user_id=?, data=?, last_seen_at=?, user_agent=?, ip_address=?
+		WHERE id=?`,
+		session.UserID, session.Data, session.LastSeenAt, session.UserAgent, session.IPAddress, session.ID)
+	return errors.Wrap(err, "exec error")
+}
+
+// Delete deletes all sessions filtered by where.
+func (sm *SessionModel) Delete(tx *sqlx.Tx, where squirrel.Sqlizer) error {
+	query, args, err := squirrel.Delete("sessions").Where(where).ToSql()
+	if err != nil {
+		return errors.Wrap(err, "query error")
+	}
+
+	_, err = sm.exec(tx, query, args...)
+	return errors.Wrap(err, "exec error")
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// statsDayLayout is the format of days in stats.
+const statsDayLayout = "2006-01-02"
+
+// DayStats are the stats of the posts created on a day.
+type DayStats struct {
+	Day     string
+	Posts   int
+	Votes   int
+	Unvoted int
+}
+
+// UserStats are how many of the posts a user created and voted on.
+type UserStats struct {
+	Handle string
+	Name   string
+	Posts  int
+	Votes  int
+}
+
+// TagStats are how many of the posts have a tag.
+type TagStats struct {
+	Name  string
+	Posts int
+}
+
+// VoteStats are how many of the posts have a number of votes.
+type VoteStats struct {
+	Votes int
+	Posts int
+}
+
+// TopicStats are the stats of the visible posts in topics created from From until the end of To. Days without posts
+// are left out of Days.
+type TopicStats struct {
+	From             time.Time
+	To               time.Time
+	Posts            int
+	Votes            int
+	Unvoted          int
+	Days             []*DayStats
+	Users            []*UserStats
+	Tags             []*TagStats
+	VoteDistribution []*VoteStats
+}
+
+// StatsModel handles computing stats of posts.
+type StatsModel struct {
+	Base
+}
+
+// NewStatsModel returns a new stats model.
+func NewStatsModel(db *sqlx.DB) *StatsModel {
+	return &StatsModel{Base{db}}
+}
+
+// statsUsersLimit is the number of most active users in stats.
+const statsUsersLimit = 10
+
+// statsPostsBuilder selects the posts stats are computed over with their number of votes.
+var statsPostsBuilder = squirrel.
+	Select("posts.id, posts.created_at, posts.creator_user_id, count(post_votes.post_id) AS votes").
+	From("posts").
+	LeftJoin("post_votes ON post_votes.post_id=posts.id").
+	Where("posts.is_visible").
+	GroupBy("posts.id")
+
+// Get computes the stats of the posts in the topics created from the start of from until the end of to, in UTC.
+func (sm *StatsModel) Get(tx *sqlx.Tx, topicIDs []int64, from, to time.Time) (*TopicStats, error) {
+	selectBuilder := sm.addWheresToBuilder(statsPostsBuilder, InTopics(topicIDs...),
+		squirrel.Expr("posts.created_at >= ? AND posts.created_at < ?", from.Format(statsDayLayout),
+			to.AddDate(0, 0, 1).Format(statsDayLayout)))
+	postsQuery, args, err := selectBuilder.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+	with := "WITH p AS (" + postsQuery + ") "
+
+	stats := &TopicStats{From: from, To: to}
+	err = sm.sel(tx, &stats.Days, with+`SELECT date(p.created_at) AS day, count(*) AS posts, sum(p.votes) AS votes,
+		sum(p.votes=0) AS unvoted FROM p GROUP BY day ORDER BY day`, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "select days error")
+	}
+
+	for _, day := range stats.Days {
+		stats.Posts += day.Posts
+		stats.Votes += day.Votes
+		stats.Unvoted += day.Unvoted
+	}
+
+	err = sm.sel(tx, &stats.Users, with+`SELECT users.handle, users.name,
+		(SELECT count(*) FROM p WHERE p.creator_user_id=users.id) AS posts,
+		(SELECT count(*) FROM post_votes JOIN p ON p.id=post_votes.post_id WHERE post_votes.user_id=users.id) AS votes
+		FROM users WHERE posts+votes > 0 ORDER BY posts+votes DESC, users.handle LIMIT ?`,
+		append(args, statsUsersLimit)...)
+	if err != nil {
+		return nil, errors.Wrap(err, "select users error")
+	}
+
+	err = sm.sel(tx, &stats.Tags, with+`SELECT tags.name, count(*) AS posts FROM p
+		JOIN post_tags ON post_tags.post_id=p.id
+		JOIN tags ON tags.id=post_tags.tag_id
+		GROUP BY tags.id ORDER BY posts DESC, tags.name`, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "select tags error")
+	}
+
+	err = sm.sel(tx, &stats.VoteDistribution, with+`SELECT p.votes, count(*) AS posts FROM p GROUP BY p.votes
+		ORDER BY p.votes`, args...)
+	return stats, errors.Wrap(err, "select vote distribution error")
+}
@@ -0,0 +1,111 @@
+package models
+
+import (
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// Subscription is a user's subscription to a topic. Posts in the topic published after LastReadAt are unread.
+type Subscription struct {
+	UserID     int64     `db:"user_id"`
+	TopicID    int64     `db:"topic_id"`
+	CreatedAt  time.Time `db:"created_at"`
+	LastReadAt time.Time `db:"last_read_at"`
+}
+
+// SubscriptionModel handles topic subscriptions and muted tags.
+type SubscriptionModel struct {
+	Base
+}
+
+// NewSubscriptionModel returns a new subscription model.
+func NewSubscriptionModel(db *sqlx.DB) *SubscriptionModel {
+	return &SubscriptionModel{Base{db}}
+}
+
+var subscriptionsBuilder = squirrel.Select("* FROM topic_subscriptions")
+
+// Find gets all subscriptions filtered by wheres.
+func (sm *SubscriptionModel) Find(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) ([]*Subscription, error) {
+	selectBuilder := sm.addWheresToBuilder(subscriptionsBuilder, wheres...)
+	query, args, err := selectBuilder.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+
+	var subscriptions []*Subscription
+	err = sm.sel(tx, &subscriptions, query, args...)
+	return subscriptions, errors.Wrap(err, "select error")
+}
+
+// Subscribe subscribes the user to the topic. Existing posts start out read.
+func (sm *SubscriptionModel) Subscribe(tx *sqlx.Tx, user *User, topic *Topic) error {
+	now := time.Now().UTC()
+	_, err := sm.exec(tx, `INSERT OR IGNORE INTO topic_subscriptions(user_id, topic_id, created_at, last_read_at)
+		VALUES(?, ?, ?, ?)`, user.ID, topic.ID, now, now)
+	return errors.Wrap(err, "exec error")
+}
+
+// Unsubscribe unsubscribes the user from the topic.
+func (sm *SubscriptionModel) Unsubscribe(tx *sqlx.Tx, user *User, topic *Topic) error {
+	_, err := sm.exec(tx, "DELETE FROM topic_subscriptions WHERE user_id=? AND topic_id=?", user.ID, topic.ID)
+	return errors.Wrap(err, "exec error")
+}
+
+// MarkRead marks the posts in the topic as read if the user is subscribed to it.
+func (sm *SubscriptionModel) MarkRead(tx *sqlx.Tx, user *User, topic *Topic) error {
+	_, err := sm.exec(tx, "UPDATE topic_subscriptions SET last_read_at=? WHERE user_id=? AND topic_id=?",
+		time.Now().UTC(), user.ID, topic.ID)
+	return errors.Wrap(err, "exec error")
+}
+
+// CountUnread returns the number of unread posts in each of the user's subscribed topics by topic id, including posts
+// cross-posted to them. Posts by the user, hidden, scheduled and muted posts are not counted.
+func (sm *SubscriptionModel) CountUnread(tx *sqlx.Tx, user *User) (map[int64]int, error) {
+	rows, err := sm.query(tx, `SELECT topic_subscriptions.topic_id, count(*) FROM posts
+		JOIN topic_subscriptions ON topic_subscriptions.user_id=? AND (topic_subscriptions.topic_id=posts.topic_id
+			OR EXISTS (SELECT 1 FROM post_crossposts WHERE post_crossposts.post_id=posts.id
+				AND post_crossposts.topic_id=topic_subscriptions.topic_id))
+		WHERE COALESCE(posts.publish_at, posts.created_at) > topic_subscriptions.last_read_at
+			AND posts.creator_user_id!=? AND posts.is_visible AND `+publishedSQL+`
+			AND posts.id NOT IN (SELECT post_tags.post_id FROM post_tags
+				JOIN muted_tags ON muted_tags.tag_id=post_tags.tag_id WHERE muted_tags.user_id=?)
+		GROUP BY topic_subscriptions.topic_id`, user.ID, user.ID, user.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+
+	counts := make(map[int64]int)
+	for rows.Next() {
+		var topicID int64
+		var count int
+		if err = rows.Scan(&topicID, &count); err != nil {
+			return nil, errors.Wrap(err, "scan error")
+		}
+		counts[topicID] = count
+	}
+	return counts, nil
+}
+
+// MutedTags gets the tags the user muted.
+func (sm *SubscriptionModel) MutedTags(tx *sqlx.Tx, user *User) ([]*Tag, error) {
+	tm := NewTagModel(sm.db)
+	tags, err := tm.Find(tx, squirrel.Expr("tags.id IN (SELECT tag_id FROM muted_tags WHERE user_id=?)", user.ID))
+	return tags, errors.Wrap(err, "find tags error")
+}
+
+// MuteTag mutes the tag for the user.
+func (sm *SubscriptionModel) MuteTag(tx *sqlx.Tx, user *User, tag *Tag) error {
+	_, err := sm.exec(tx, "INSERT OR IGNORE INTO muted_tags(user_id, tag_id) VALUES(?, ?)", user.ID, tag.ID)
+	return errors.Wrap(err, "exec error")
+}
+
+// UnmuteTag unmutes the tag for the user.
+func (sm *SubscriptionModel) UnmuteTag(tx *sqlx.Tx, user *User, tag *Tag) error {
+	_, err := sm.exec(tx, "DELETE FROM muted_tags WHERE user_id=? AND tag_id=?", user.ID, tag.ID)
+	return errors.Wrap(err, "exec error")
+}
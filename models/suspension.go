@@ -0,0 +1,133 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// Suspension actions recorded in a user's suspension history.
+const (
+	SuspensionActionSuspend = "suspend"
+	SuspensionActionBan     = "ban"
+	SuspensionActionLift    = "lift"
+)
+
+// Suspension is an entry in the audit trail of suspensions, bans and lifts made by admins.
+type Suspension struct {
+	ID             int64
+	User           *User
+	Actor          *User
+	Action         string
+	Reason         string
+	SuspendedUntil *time.Time
+	CreatedAt      time.Time
+}
+
+// IsValid returns true if the suspension is valid else false.
+func (s *Suspension) IsValid() bool {
+	switch s.Action {
+	case SuspensionActionSuspend:
+		return s.SuspendedUntil != nil && s.Reason != ""
+	case SuspensionActionBan:
+		return s.Reason != ""
+	case SuspensionActionLift:
+		return true
+	}
+	return false
+}
+
+// SuspensionModel handles getting and creating suspension history.
+type SuspensionModel struct {
+	Base
+}
+
+// NewSuspensionModel returns a new suspension model.
+func NewSuspensionModel(db *sqlx.DB) *SuspensionModel {
+	return &SuspensionModel{Base{db}}
+}
+
+var (
+	// ErrInvalidSuspension is returned when adding an invalid suspension.
+	ErrInvalidSuspension = InputError{"A reason is required and suspensions must have an end date"}
+
+	// ErrCannotSuspendAdmin is returned when trying to suspend or ban an admin.
+	ErrCannotSuspendAdmin = InputError{"Admins cannot be suspended or banned"}
+)
+
+var suspensionsBuilder = squirrel.
+	Select(`user_suspensions.id, user_suspensions.action, user_suspensions.reason,
+		user_suspensions.suspended_until, user_suspensions.created_at,
+		users.id, users.handle, users.name,
+		actors.id, actors.handle, actors.name`).
+	From("user_suspensions").
+	Join("users ON users.id=user_suspensions.user_id").
+	Join("users AS actors ON actors.id=user_suspensions.actor_user_id").
+	OrderBy("user_suspensions.created_at DESC, user_suspensions.id DESC")
+
+// Find gets the suspension history filtered by wheres, newest first.
+func (sm *SuspensionModel) Find(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) ([]*Suspension, error) {
+	rows, err := sm.queryWhere(tx, suspensionsBuilder, wheres...)
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+
+	var suspensions []*Suspension
+	for rows.Next() {
+		suspension := &Suspension{User: new(User), Actor: new(User)}
+		err = rows.Scan(&suspension.ID, &suspension.Action, &suspension.Reason,
+			&suspension.SuspendedUntil, &suspension.CreatedAt,
+			&suspension.User.ID, &suspension.User.Handle, &suspension.User.Name,
+			&suspension.Actor.ID, &suspension.Actor.Handle, &suspension.Actor.Name)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan error")
+		}
+		suspensions = append(suspensions, suspension)
+	}
+	return suspensions, nil
+}
+
+// Add records the suspension and applies it to the suspension's user.
+func (sm *SuspensionModel) Add(tx *sqlx.Tx, suspension *Suspension) error {
+	suspension.Reason = strings.TrimSpace(suspension.Reason)
+	if !suspension.IsValid() {
+		return ErrInvalidSuspension
+	}
+	if suspension.User.IsAdmin && suspension.Action != SuspensionActionLift {
+		return ErrCannotSuspendAdmin
+	}
+
+	result, err := sm.exec(tx, `INSERT INTO user_suspensions(user_id, actor_user_id, action, reason, suspended_until)
+		VALUES(?, ?, ?, ?, ?)`,
+		suspension.User.ID, suspension.Actor.ID, suspension.Action, suspension.Reason, suspension.SuspendedUntil)
+	if err != nil {
+		return errors.Wrap(err, "exec error")
+	}
+
+	user := suspension.User
+	switch suspension.Action {
+	case SuspensionActionSuspend:
+		user.SuspendedUntil, user.IsBanned = suspension.SuspendedUntil, false
+	case SuspensionActionBan:
+		user.SuspendedUntil, user.IsBanned = nil, true
+	case SuspensionActionLift:
+		user.SuspendedUntil, user.IsBanned = nil, false
+	}
+	user.SuspensionReason = suspension.Reason
+
+	um := NewUserModel(sm.db)
+	if err = um.UpdateSuspension(tx, user); err != nil {
+		return errors.Wrap(err, "update suspension error")
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return errors.Wrap(err, "last inserted id error")
+	}
+	suspension.ID = id
+	return nil
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"database/sql"
+	"regexp"
 	"strings"
 
 	"github.com/Masterminds/squirrel"
@@ -9,24 +10,33 @@ import (
 	"github.com/pkg/errors"
 )
 
-// Tag represents a tag in the app.
+// Tag represents a tag in the app. Color is a hex color like #1e88e5 or empty for the default color.
 type Tag struct {
-	ID    int64
-	Name  string
-	Topic *Topic
+	ID          int64
+	Name        string
+	Description string
+	Color       string
+	Topic       *Topic
 }
 
+var tagColorRegex = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+
 // URL returns the unique URL for a topic.
 func (t *Tag) URL() string {
 	return t.Topic.TagsURL() + "/" + t.Name
 }
 
+// EditURL returns the URL of the page to edit the tag.
+func (t *Tag) EditURL() string {
+	return t.URL() + "/edit"
+}
+
 // IsValid returns true if the tag is valid else false.
 func (t *Tag) IsValid() bool {
-	return singleWordAlphaNumRegex.MatchString(t.Name)
+	return singleWordAlphaNumRegex.MatchString(t.Name) && (t.Color == "" || tagColorRegex.MatchString(t.Color))
 }
 
-// TagModel handles getting and creating tags.
+// TagModel handles getting, creating, changing and merging tags.
 type TagModel struct {
 	Base
 }
@@ -38,13 +48,26 @@ func NewTagModel(db *sqlx.DB) *TagModel {
 
 var (
 	// ErrInvalidTag is returned when adding or updating an invalid tag
-	ErrInvalidTag = InputError{"Invalid name"}
+	ErrInvalidTag = InputError{"Invalid name or color"}
+
+	// ErrTagNameTaken is returned when renaming a tag to the name of another tag in the topic.
+	ErrTagNameTaken = InputError{"A tag with that name already exists in this topic"}
+
+	// ErrInvalidTagMerge is returned when merging a tag into itself or into a tag in another topic.
+	ErrInvalidTagMerge = InputError{"Tags can only be merged into another tag in the same topic"}
 
 	tagsBuilder = squirrel.
-			Select("tags.id, tags.name, topics.id, topics.name, topics.title").
+			Select("tags.id, tags.name, tags.description, tags.color, topics.id, topics.name, topics.title").
 			From("tags").
 			Join("topics ON topics.id=tags.topic_id").
 			OrderBy("tags.name")
+
+	postTagsBuilder = squirrel.
+			Select("post_tags.post_id, tags.id, tags.name, tags.description, tags.color, topics.id, topics.name, topics.title").
+			From("post_tags").
+			Join("tags ON tags.id=post_tags.tag_id").
+			Join("topics ON topics.id=tags.topic_id").
+			OrderBy("tags.name")
 )
 
 // Find gets all tags filtered by wheres.
@@ -59,7 +82,7 @@ func (tm *TagModel) Find(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) ([]*Tag, error
 	for rows.Next() {
 		tag := new(Tag)
 		topic := new(Topic)
-		err = rows.Scan(&tag.ID, &tag.Name, &topic.ID, &topic.Name, &topic.Title)
+		err = rows.Scan(&tag.ID, &tag.Name, &tag.Description, &tag.Color, &topic.ID, &topic.Name, &topic.Title)
 		if err != nil {
 			return nil, errors.Wrap(err, "scan error")
 		}
@@ -93,7 +116,8 @@ func (tm *TagModel) Add(tx *sqlx.Tx, tag *Tag) error {
 	}
 
 	tag.Name = strings.ToLower(tag.Name)
-	result, err := tm.exec(tx, "INSERT INTO tags(name, topic_id) VALUES(?, ?)", tag.Name, tag.Topic.ID)
+	result, err := tm.exec(tx, "INSERT INTO tags(name, topic_id, description, color) VALUES(?, ?, ?, ?)",
+		tag.Name, tag.Topic.ID, tag.Description, tag.Color)
 	if err != nil {
 		return errors.Wrap(err, "exec error")
 	}
@@ -112,9 +136,174 @@ func (tm *TagModel) Add(tx *sqlx.Tx, tag *Tag) error {
 	return nil
 }
 
-// AddPostTag adds a tag for the post.
+// AddPostTag adds a tag for the post. The tag must be in the post's topic or its parent.
 func (tm *TagModel) AddPostTag(tx *sqlx.Tx, post *Post, tag *Tag) error {
 	_, err := tm.exec(tx, "INSERT INTO post_tags(post_id, tag_id, topic_id) VALUES(?, ?, ?)",
-		post.ID, tag.ID, post.Topic.ID)
+		post.ID, tag.ID, tag.Topic.ID)
+	return errors.Wrap(err, "exec error")
+}
+
+// FindForPosts sets the tags of each of the posts.
+func (tm *TagModel) FindForPosts(tx *sqlx.Tx, posts []*Post) error {
+	byID := make(map[int64][]*Post)
+	var postIDs []int64
+	for _, post := range posts {
+		if _, ok := byID[post.ID]; !ok {
+			postIDs = append(postIDs, post.ID)
+		}
+		byID[post.ID] = append(byID[post.ID], post)
+		post.Tags = nil
+	}
+
+	if len(postIDs) == 0 {
+		return nil
+	}
+
+	rows, err := tm.queryWhere(tx, postTagsBuilder, squirrel.Eq{"post_tags.post_id": postIDs})
+	if err != nil {
+		return errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID int64
+		tag := new(Tag)
+		topic := new(Topic)
+		err = rows.Scan(&postID, &tag.ID, &tag.Name, &tag.Description, &tag.Color, &topic.ID, &topic.Name, &topic.Title)
+		if err != nil {
+			return errors.Wrap(err, "scan error")
+		}
+		tag.Topic = topic
+
+		for _, post := range byID[postID] {
+			post.Tags = append(post.Tags, tag)
+		}
+	}
+	return nil
+}
+
+// Update updates the tag's name, description and color.
+func (tm *TagModel) Update(tx *sqlx.Tx, tag *Tag) error {
+	tag.Name = strings.ToLower(tag.Name)
+	if !tag.IsValid() {
+		return ErrInvalidTag
+	}
+
+	var count int
+	err := tm.get(tx, &count, "SELECT count(*) FROM tags WHERE name=? AND topic_id=? AND id!=?",
+		tag.Name, tag.Topic.ID, tag.ID)
+	if err != nil {
+		return errors.Wrap(err, "get error")
+	}
+	if count > 0 {
+		return ErrTagNameTaken
+	}
+
+	_, err = tm.exec(tx, "UPDATE tags SET name=?, description=?, color=? WHERE id=?",
+		tag.Name, tag.Description, tag.Color, tag.ID)
 	return errors.Wrap(err, "exec error")
 }
+
+// Merge moves the posts tagged with from to into and deletes from. Posts that already have both tags keep one
+// post_tags row for into.
+func (tm *TagModel) Merge(tx *sqlx.Tx, from, into *Tag) error {
+	if from.ID == into.ID || from.Topic.ID != into.Topic.ID {
+		return ErrInvalidTagMerge
+	}
+
+	_, err := tm.exec(tx, `INSERT OR IGNORE INTO post_tags(post_id, tag_id, topic_id)
+		SELECT post_id, ?, topic_id FROM post_tags WHERE tag_id=?`, into.ID, from.ID)
+	if err != nil {
+		return errors.Wrap(err, "copy post tags error")
+	}
+
+	return errors.Wrap(tm.Delete(tx, from), "delete error")
+}
+
+// Delete deletes the tag. Its posts are kept but lose the tag.
+func (tm *TagModel) Delete(tx *sqlx.Tx, tag *Tag) error {
+	_, err := tm.exec(tx, "DELETE FROM tags WHERE id=?", tag.ID)
+	return errors.Wrap(err, "exec error")
+}
+
+// TagFilter filters posts by their tags. Posts must have all of the All tags, at least one of the Any tags and none of
+// the Not tags. Empty lists are ignored.
+type TagFilter struct {
+	All []*Tag
+	Any []*Tag
+	Not []*Tag
+}
+
+// IsEmpty returns true if the filter has no tags.
+func (tf *TagFilter) IsEmpty() bool {
+	return len(tf.All) == 0 && len(tf.Any) == 0 && len(tf.Not) == 0
+}
+
+// ToSql builds subqueries on post_tags so the filter can be used as a where on posts.
+func (tf *TagFilter) ToSql() (string, []interface{}, error) {
+	and := squirrel.And{squirrel.Expr("1=1")}
+
+	if len(tf.All) > 0 {
+		sub := squirrel.Select("post_id").From("post_tags").Where(squirrel.Eq{"tag_id": tagIDs(tf.All)}).
+			GroupBy("post_id").Having("count(DISTINCT tag_id)=?", len(tf.All))
+		and = append(and, subquerySqlizer{"posts.id IN", sub})
+	}
+
+	if len(tf.Any) > 0 {
+		sub := squirrel.Select("post_id").From("post_tags").Where(squirrel.Eq{"tag_id": tagIDs(tf.Any)})
+		and = append(and, subquerySqlizer{"posts.id IN", sub})
+	}
+
+	if len(tf.Not) > 0 {
+		sub := squirrel.Select("post_id").From("post_tags").Where(squirrel.Eq{"tag_id": tagIDs(tf.Not)})
+		and = append(and, subquerySqlizer{"posts.id NOT IN", sub})
+	}
+
+	return and.ToSql()
+}
+
+// String describes the filter, e.g. week3 AND assignment1 AND (hint OR solution) NOT solved.
+func (tf *TagFilter) String() string {
+	var parts []string
+	for _, tag := range tf.All {
+		parts = append(parts, tag.Name)
+	}
+
+	var anyNames []string
+	for _, tag := range tf.Any {
+		anyNames = append(anyNames, tag.Name)
+	}
+	switch len(anyNames) {
+	case 0:
+	case 1:
+		parts = append(parts, anyNames[0])
+	default:
+		parts = append(parts, "("+strings.Join(anyNames, " OR ")+")")
+	}
+
+	s := strings.Join(parts, " AND ")
+	for _, tag := range tf.Not {
+		s += " NOT " + tag.Name
+	}
+	return strings.TrimSpace(s)
+}
+
+// tagIDs returns the ids of the tags.
+func tagIDs(tags []*Tag) []int64 {
+	ids := make([]int64, len(tags))
+	for i, tag := range tags {
+		ids[i] = tag.ID
+	}
+	return ids
+}
+
+// subquerySqlizer is a where like "posts.id IN (SELECT ...)".
+type subquerySqlizer struct {
+	prefix   string
+	subquery squirrel.SelectBuilder
+}
+
+func (ss subquerySqlizer) ToSql() (string, []interface{}, error) {
+	query, args, err := ss.subquery.ToSql()
+	return ss.prefix + " (" + query + ")", args, err
+}
@@ -2,6 +2,8 @@ package models
 
 import (
 	"database/sql"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/Masterminds/squirrel"
@@ -9,17 +11,64 @@ import (
 	"github.com/pkg/errors"
 )
 
-// Topic represents a topic in the app.
+// Topic represents a topic in the app. Archived topics are read only.
+//
+// Topics can have sections (e.g. the lecture sections of a course), which are topics with a ParentID. A section's name
+// is its parent's name and its own name separated by a slash, e.g. csc108/l0101. Sections inherit their parent's tags
+// and roles and show their parent's pinned posts.
 type Topic struct {
 	ID          int64
 	Name        string
 	Title       string
 	Description string
+
+	// ApproveFirstPosts is how many posts a user needs approved by a moderator before they can post freely.
+	ApproveFirstPosts int  `db:"approve_first_posts"`
+	IsArchived        bool `db:"is_archived"`
+
+	ParentID *int64 `db:"parent_topic_id"`
+	Parent   *Topic `db:"-"` // only set by LoadParent
 }
 
-// URL returns the unique URL for a topic.
+// URL returns the unique URL for a topic, e.g. /topics/csc108/sections/l0101 for a section.
 func (t *Topic) URL() string {
-	return "/topics/" + t.Name
+	return "/topics/" + strings.Replace(t.Name, "/", "/sections/", 1)
+}
+
+// IsSection returns true if the topic is a section of another topic.
+func (t *Topic) IsSection() bool {
+	return t.ParentID != nil
+}
+
+// ParentName returns the name of the section's parent topic or an empty string if the topic isn't a section.
+func (t *Topic) ParentName() string {
+	if i := strings.Index(t.Name, "/"); i >= 0 {
+		return t.Name[:i]
+	}
+	return ""
+}
+
+// ParentURL returns the URL of the section's parent topic.
+func (t *Topic) ParentURL() string {
+	return "/topics/" + t.ParentName()
+}
+
+// IsReadOnly returns true if the topic or its parent is archived. The parent is only checked if it was loaded.
+func (t *Topic) IsReadOnly() bool {
+	return t.IsArchived || (t.Parent != nil && t.Parent.IsArchived)
+}
+
+// ShortName returns the topic's name without its parent's name.
+func (t *Topic) ShortName() string {
+	return t.Name[strings.Index(t.Name, "/")+1:]
+}
+
+// TopicIDs returns the ids of the topic and its parent, whose tags and roles apply to the topic.
+func (t *Topic) TopicIDs() []int64 {
+	if t.ParentID != nil {
+		return []int64{t.ID, *t.ParentID}
+	}
+	return []int64{t.ID}
 }
 
 // NewPostURL returns the URL of the page to create a new post under the topic.
@@ -29,7 +78,20 @@ func (t *Topic) NewPostURL() string {
 
 // IsValid returns true if the topic is valid else false.
 func (t *Topic) IsValid() bool {
-	return t.Title != "" && t.Description != "" && singleWordAlphaNumRegex.MatchString(t.Name)
+	if t.Title == "" || t.Description == "" {
+		return false
+	}
+
+	parts := strings.Split(t.Name, "/")
+	if len(parts) != 1 && !(len(parts) == 2 && t.IsSection()) {
+		return false
+	}
+	for _, part := range parts {
+		if !singleWordAlphaNumRegex.MatchString(part) {
+			return false
+		}
+	}
+	return true
 }
 
 // TagsURL returns the URL of the page listing the tags under the topic.
@@ -42,7 +104,17 @@ func (t *Topic) NewTagURL() string {
 	return t.TagsURL() + "/new"
 }
 
-// TopicModel handles getting and creating topics.
+// EditURL returns the URL of the page to edit the topic.
+func (t *Topic) EditURL() string {
+	return t.URL() + "/edit"
+}
+
+// DeleteURL returns the URL of the page to delete the topic.
+func (t *Topic) DeleteURL() string {
+	return t.URL() + "/delete"
+}
+
+// TopicModel handles getting, creating, renaming and deleting topics.
 type TopicModel struct {
 	Base
 }
@@ -52,10 +124,21 @@ func NewTopicModel(db *sqlx.DB) *TopicModel {
 	return &TopicModel{Base{db}}
 }
 
+// maxSuggestedTopicNameLength keeps names derived from long course titles readable in URLs.
+const maxSuggestedTopicNameLength = 30
+
+var nonTopicNameCharRegex = regexp.MustCompile(`[^a-z0-9]+`)
+
 var (
 	// ErrInvalidTopic is returned when adding or updating an invalid topic
 	ErrInvalidTopic = InputError{"Cannot have empty name and/or title"}
 
+	// ErrTopicNameTaken is returned when renaming a topic to the name of another topic.
+	ErrTopicNameTaken = InputError{"Topic name is already taken"}
+
+	// ErrInvalidClone is returned when cloning a section or posts that are not pinned in the cloned topic.
+	ErrInvalidClone = InputError{"Only courses and topics can be cloned, with pinned posts from the cloned topic"}
+
 	topicsBuilder = squirrel.Select("* FROM topics")
 )
 
@@ -97,8 +180,8 @@ func (tm *TopicModel) Add(tx *sqlx.Tx, topic *Topic) error {
 
 	topic.Name = strings.ToLower(topic.Name)
 
-	query := "INSERT INTO topics(name, title, description) VALUES(?, ?, ?)"
-	result, err := tm.exec(tx, query, topic.Name, topic.Title, topic.Description)
+	query := "INSERT INTO topics(name, title, description, parent_topic_id) VALUES(?, ?, ?, ?)"
+	result, err := tm.exec(tx, query, topic.Name, topic.Title, topic.Description, topic.ParentID)
 	if err != nil {
 		return errors.Wrap(err, "exec error")
 	}
@@ -116,3 +199,309 @@ func (tm *TopicModel) Add(tx *sqlx.Tx, topic *Topic) error {
 	*topic = *t
 	return nil
 }
+
+// SuggestName returns an unused topic name derived from s (e.g. an LMS course label). If the derived name is taken, a
+// number is appended to it.
+func (tm *TopicModel) SuggestName(tx *sqlx.Tx, s string) (string, error) {
+	base := nonTopicNameCharRegex.ReplaceAllString(strings.ToLower(s), "_")
+	base = strings.Trim(base, "_")
+	if len(base) > maxSuggestedTopicNameLength {
+		base = strings.TrimRight(base[:maxSuggestedTopicNameLength], "_")
+	}
+	if base == "" {
+		base = "course"
+	}
+
+	name := base
+	for i := 2; ; i++ {
+		var count int
+		if err := tm.get(tx, &count, "SELECT count(*) FROM topics WHERE name=?", name); err != nil {
+			return "", errors.Wrap(err, "get error")
+		}
+		if count == 0 {
+			return name, nil
+		}
+		name = base + "_" + strconv.Itoa(i)
+	}
+}
+
+// Update updates the topic's title, description, settings and archived state. Use Rename to change the name.
+func (tm *TopicModel) Update(tx *sqlx.Tx, topic *Topic) error {
+	if !topic.IsValid() || topic.ApproveFirstPosts < 0 {
+		return ErrInvalidTopic
+	}
+
+	_, err := tm.exec(tx, "UPDATE topics SET title=?, description=?, approve_first_posts=?, is_archived=? WHERE id=?",
+		topic.Title, topic.Description, topic.ApproveFirstPosts, topic.IsArchived, topic.ID)
+	return errors.Wrap(err, "exec error")
+}
+
+// Rename changes the topic's name, or the section's own name for sections. Sections of the topic are renamed with it.
+// Old names redirect to the topics until another topic takes them.
+func (tm *TopicModel) Rename(tx *sqlx.Tx, topic *Topic, name string) error {
+	name = strings.ToLower(name)
+	if !singleWordAlphaNumRegex.MatchString(name) {
+		return ErrInvalidTopic
+	}
+	if topic.IsSection() {
+		name = topic.ParentName() + "/" + name
+	}
+	if name == topic.Name {
+		return nil
+	}
+
+	sections, err := tm.Find(tx, squirrel.Eq{"topics.parent_topic_id": topic.ID})
+	if err != nil {
+		return errors.Wrap(err, "find sections error")
+	}
+	for _, section := range sections {
+		if err = tm.rename(tx, section, name+"/"+section.ShortName()); err != nil {
+			return errors.Wrap(err, "rename section error")
+		}
+	}
+	return tm.rename(tx, topic, name)
+}
+
+// rename changes the topic's full name and adds a redirect from the old name.
+func (tm *TopicModel) rename(tx *sqlx.Tx, topic *Topic, name string) error {
+	var count int
+	if err := tm.get(tx, &count, "SELECT count(*) FROM topics WHERE name=?", name); err != nil {
+		return errors.Wrap(err, "get error")
+	}
+	if count > 0 {
+		return ErrTopicNameTaken
+	}
+
+	if _, err := tm.exec(tx, "DELETE FROM topic_redirects WHERE old_name=?", name); err != nil {
+		return errors.Wrap(err, "delete redirect error")
+	}
+
+	_, err := tm.exec(tx, "INSERT OR REPLACE INTO topic_redirects(old_name, topic_id) VALUES(?, ?)", topic.Name, topic.ID)
+	if err != nil {
+		return errors.Wrap(err, "add redirect error")
+	}
+
+	if _, err = tm.exec(tx, "UPDATE topics SET name=? WHERE id=?", name, topic.ID); err != nil {
+		return errors.Wrap(err, "exec error")
+	}
+
+	topic.Name = name
+	return nil
+}
+
+// FindRedirect gets the topic that used to be named oldName.
+func (tm *TopicModel) FindRedirect(tx *sqlx.Tx, oldName string) (*Topic, error) {
+	var topicID int64
+	err := tm.get(tx, &topicID, "SELECT topic_id FROM topic_redirects WHERE old_name=?", strings.ToLower(oldName))
+	if err != nil {
+		return nil, errors.Wrap(err, "get error")
+	}
+	return tm.FindOne(tx, squirrel.Eq{"topics.id": topicID})
+}
+
+// WithSectionIDs returns the topic ids with the ids of all of their sections.
+func (tm *TopicModel) WithSectionIDs(tx *sqlx.Tx, topicIDs []int64) ([]int64, error) {
+	query, args, err := squirrel.Select("id").From("topics").
+		Where(squirrel.Or{squirrel.Eq{"id": topicIDs}, squirrel.Eq{"parent_topic_id": topicIDs}}).ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "sql error")
+	}
+
+	var ids []int64
+	err = tm.sel(tx, &ids, query, args...)
+	return ids, errors.Wrap(err, "select error")
+}
+
+// LoadParent sets the parent of a section. It does nothing for topics that are not sections.
+func (tm *TopicModel) LoadParent(tx *sqlx.Tx, topic *Topic) error {
+	if !topic.IsSection() {
+		return nil
+	}
+
+	parent, err := tm.FindOne(tx, squirrel.Eq{"topics.id": *topic.ParentID})
+	if err != nil {
+		return errors.Wrap(err, "find one error")
+	}
+	topic.Parent = parent
+	return nil
+}
+
+// CountPosts returns how many posts are in the topic and its sections.
+func (tm *TopicModel) CountPosts(tx *sqlx.Tx, topic *Topic) (int, error) {
+	var count int
+	err := tm.get(tx, &count,
+		"SELECT count(*) FROM posts WHERE topic_id IN (SELECT id FROM topics WHERE id=? OR parent_topic_id=?)",
+		topic.ID, topic.ID)
+	return count, errors.Wrap(err, "get error")
+}
+
+// Delete deletes the topic along with its posts, tags, roles and everything else in it.
+func (tm *TopicModel) Delete(tx *sqlx.Tx, topic *Topic) error {
+	_, err := tm.exec(tx, "DELETE FROM topics WHERE id=?", topic.ID)
+	return errors.Wrap(err, "exec error")
+}
+
+// Clone adds clone as a new topic with the settings, tags, custom fields and roles of source. The posts with the ids,
+// e.g. a syllabus or FAQ, are copied into it as pinned posts with their tags and field values, and other posts are left
+// behind. Only pinned posts can be copied, so students' posts never are, and the copies skip the filter rules since
+// moderators already published them. Sections are not cloned.
+// Use a tx so a clone that fails part way is not left behind.
+func (tm *TopicModel) Clone(tx *sqlx.Tx, source, clone *Topic, postIDs []int64, copyRoles bool) error {
+	if source.IsSection() || clone.ParentID != nil {
+		return ErrInvalidClone
+	}
+
+	if _, err := tm.FindOne(tx, squirrel.Eq{"topics.name": strings.ToLower(clone.Name)}); err == nil {
+		return ErrTopicNameTaken
+	} else if err != sql.ErrNoRows {
+		return errors.Wrap(err, "find one error")
+	}
+
+	// a post picked twice is only copied once
+	seen := make(map[int64]bool)
+	var uniqueIDs []int64
+	for _, id := range postIDs {
+		if !seen[id] {
+			uniqueIDs = append(uniqueIDs, id)
+		}
+		seen[id] = true
+	}
+	postIDs = uniqueIDs
+
+	pm := NewPostModel(tm.db)
+	var posts []*Post
+	if len(postIDs) > 0 {
+		var err error
+		posts, err = pm.FindSorted(tx, PostSortNew, squirrel.Eq{"posts.id": postIDs, "posts.topic_id": source.ID},
+			PinnedPosts)
+		if err != nil {
+			return errors.Wrap(err, "find posts error")
+		}
+		if len(posts) != len(postIDs) {
+			return ErrInvalidClone
+		}
+	}
+
+	if err := tm.Add(tx, clone); err != nil {
+		return err
+	}
+
+	clone.ApproveFirstPosts = source.ApproveFirstPosts
+	if err := tm.Update(tx, clone); err != nil {
+		return errors.Wrap(err, "update error")
+	}
+
+	tsm := NewTopicSettingsModel(tm.db)
+	settings, err := tsm.Get(tx, source)
+	if err != nil {
+		return errors.Wrap(err, "get settings error")
+	}
+	settings.TopicID = clone.ID
+	if err = tsm.Save(tx, settings); err != nil {
+		return errors.Wrap(err, "save settings error")
+	}
+
+	tagModel := NewTagModel(tm.db)
+	tags, err := tagModel.Find(tx, squirrel.Eq{"tags.topic_id": source.TopicIDs()})
+	if err != nil {
+		return errors.Wrap(err, "find tags error")
+	}
+
+	// a section's posts can use its parent's tags so the clone gets copies of those too. If both have a tag with the
+	// same name the section's own tag is copied, like in SetTag.
+	clonedTags := make(map[int64]*Tag)
+	clonedTagsByName := make(map[string]*Tag)
+	for _, own := range []bool{true, false} {
+		for _, tag := range tags {
+			if (tag.Topic.ID == source.ID) != own {
+				continue
+			}
+
+			clonedTag, ok := clonedTagsByName[tag.Name]
+			if !ok {
+				clonedTag = &Tag{Name: tag.Name, Topic: clone, Description: tag.Description, Color: tag.Color}
+				if err = tagModel.Add(tx, clonedTag); err != nil {
+					return errors.Wrap(err, "add tag error")
+				}
+				clonedTagsByName[tag.Name] = clonedTag
+			}
+			clonedTags[tag.ID] = clonedTag
+		}
+	}
+
+	if err = tagModel.FindForPosts(tx, posts); err != nil {
+		return errors.Wrap(err, "find tags for posts error")
+	}
+
+	fm := NewFieldModel(tm.db)
+	if err = fm.FindForPosts(tx, posts); err != nil {
+		return errors.Wrap(err, "find field values for posts error")
+	}
+
+	// the posts are copied before the fields so that required fields added after a post was written, e.g. an
+	// assignment number, don't stop it from being copied
+	var clonedPosts []*Post
+	for i := len(posts) - 1; i >= 0; i-- {
+		// add the oldest post first so the copies are in the same order
+		post := posts[i]
+		clonedPost := &Post{Title: post.Title, Content: post.Content, Topic: clone, Creator: post.Creator,
+			IsPinned: true, IsAnonymous: post.IsAnonymous}
+		if err = pm.add(tx, clonedPost, false); err != nil {
+			return errors.Wrap(err, "add post error")
+		}
+		clonedPosts = append(clonedPosts, clonedPost)
+
+		for _, tag := range post.Tags {
+			if clonedTag, ok := clonedTags[tag.ID]; ok {
+				if err = tagModel.AddPostTag(tx, clonedPost, clonedTag); err != nil {
+					return errors.Wrap(err, "add post tag error")
+				}
+			}
+		}
+	}
+
+	fields, err := fm.Find(tx, squirrel.Eq{"topic_fields.topic_id": source.ID})
+	if err != nil {
+		return errors.Wrap(err, "find fields error")
+	}
+
+	clonedFieldIDs := make(map[int64]int64)
+	for _, field := range fields {
+		clonedField := *field
+		clonedField.TopicID = clone.ID
+		if err = fm.Add(tx, &clonedField); err != nil {
+			return errors.Wrap(err, "add field error")
+		}
+		clonedFieldIDs[field.ID] = clonedField.ID
+	}
+
+	for i, clonedPost := range clonedPosts {
+		values := make(map[int64]string)
+		for fieldID, value := range posts[len(posts)-1-i].FieldValues {
+			if clonedFieldID, ok := clonedFieldIDs[fieldID]; ok {
+				values[clonedFieldID] = value
+			}
+		}
+		if err = fm.addValues(tx, clonedPost.ID, values); err != nil {
+			return errors.Wrap(err, "add field values error")
+		}
+	}
+
+	if !copyRoles {
+		return nil
+	}
+
+	trm := NewTopicRoleModel(tm.db)
+	topicRoles, err := trm.Find(tx, squirrel.Eq{"topic_roles.topic_id": source.ID})
+	if err != nil {
+		return errors.Wrap(err, "find topic roles error")
+	}
+
+	for _, topicRole := range topicRoles {
+		clonedRole := &TopicRole{TopicID: clone.ID, UserID: topicRole.UserID, Role: topicRole.Role}
+		if err = trm.Set(tx, clonedRole); err != nil {
+			return errors.Wrap(err, "set topic role error")
+		}
+	}
+	return nil
+}
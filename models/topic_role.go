@@ -0,0 +1,97 @@
+package models
+
+import (
+	"database/sql"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// Roles a user can have in a topic.
+const (
+	TopicRoleStudent    = "student"
+	TopicRoleTA         = "ta"
+	TopicRoleInstructor = "instructor"
+)
+
+// TopicRole is the role of a user in a topic (e.g. from the course roster in an LMS).
+type TopicRole struct {
+	TopicID int64 `db:"topic_id"`
+	UserID  int64 `db:"user_id"`
+	Role    string
+}
+
+// IsModerator returns true if the role lets the user moderate the topic.
+func (tr *TopicRole) IsModerator() bool {
+	return tr.Role == TopicRoleTA || tr.Role == TopicRoleInstructor
+}
+
+// IsValidTopicRole returns true if role is one of the topic roles.
+func IsValidTopicRole(role string) bool {
+	return role == TopicRoleStudent || role == TopicRoleTA || role == TopicRoleInstructor
+}
+
+// TopicRoleModel handles getting, setting and removing users' roles in topics.
+type TopicRoleModel struct {
+	Base
+}
+
+// NewTopicRoleModel returns a new topic role model.
+func NewTopicRoleModel(db *sqlx.DB) *TopicRoleModel {
+	return &TopicRoleModel{Base{db}}
+}
+
+var (
+	// ErrInvalidTopicRole is returned when setting a role that does not exist.
+	ErrInvalidTopicRole = InputError{"Topic role must be student, ta or instructor"}
+)
+
+var topicRolesBuilder = squirrel.Select("* FROM topic_roles")
+
+// Find gets all topic roles filtered by wheres.
+func (trm *TopicRoleModel) Find(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) ([]*TopicRole, error) {
+	selectBuilder := trm.addWheresToBuilder(topicRolesBuilder, wheres...)
+	query, args, err := selectBuilder.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+
+	var topicRoles []*TopicRole
+	err = trm.sel(tx, &topicRoles, query, args...)
+	return topicRoles, errors.Wrap(err, "select error")
+}
+
+// FindOne gets the topic role filtered by wheres.
+func (trm *TopicRoleModel) FindOne(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) (*TopicRole, error) {
+	topicRoles, err := trm.Find(tx, wheres...)
+	if err != nil {
+		return nil, errors.Wrap(err, "find error")
+	}
+
+	switch len(topicRoles) {
+	case 0:
+		return nil, sql.ErrNoRows
+	case 1:
+		return topicRoles[0], nil
+	default:
+		return nil, errors.Errorf("expected 1, got %d", len(topicRoles))
+	}
+}
+
+// Set gives the user the role in the topic, replacing any role they had.
+func (trm *TopicRoleModel) Set(tx *sqlx.Tx, topicRole *TopicRole) error {
+	if !IsValidTopicRole(topicRole.Role) {
+		return ErrInvalidTopicRole
+	}
+
+	_, err := trm.exec(tx, "INSERT OR REPLACE INTO topic_roles(topic_id, user_id, role) VALUES(?, ?, ?)",
+		topicRole.TopicID, topicRole.UserID, topicRole.Role)
+	return errors.Wrap(err, "exec error")
+}
+
+// Delete removes the user's role in the topic.
+func (trm *TopicRoleModel) Delete(tx *sqlx.Tx, topicRole *TopicRole) error {
+	_, err := trm.exec(tx, "DELETE FROM topic_roles WHERE topic_id=? AND user_id=?", topicRole.TopicID, topicRole.UserID)
+	return errors.Wrap(err, "exec error")
+}
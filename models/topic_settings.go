@@ -0,0 +1,102 @@
+package models
+
+import (
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// Who may post in a topic. Members have any role in the topic and instructors are its TAs and instructors.
+const (
+	TopicPostersEveryone    = "everyone"
+	TopicPostersMembers     = "members"
+	TopicPostersInstructors = "instructors"
+)
+
+// TopicSettings configures how a topic behaves. Topics without saved settings use DefaultTopicSettings.
+type TopicSettings struct {
+	TopicID               int64  `db:"topic_id"`
+	WhoCanPost            string `db:"who_can_post"`
+	AllowAnonymous        bool   `db:"allow_anonymous"`
+	StudentsCanCreateTags bool   `db:"students_can_create_tags"`
+	DefaultSort           string `db:"default_sort"`
+	RequireTag            bool   `db:"require_tag"`
+}
+
+// DefaultTopicSettings returns the settings of a topic that has none saved.
+func DefaultTopicSettings(topicID int64) *TopicSettings {
+	return &TopicSettings{TopicID: topicID, WhoCanPost: TopicPostersEveryone, DefaultSort: PostSortTop}
+}
+
+// IsValid returns true if the settings are valid else false.
+func (ts *TopicSettings) IsValid() bool {
+	switch ts.WhoCanPost {
+	case TopicPostersEveryone, TopicPostersMembers, TopicPostersInstructors:
+	default:
+		return false
+	}
+	return ts.TopicID > 0 && IsValidPostSort(ts.DefaultSort)
+}
+
+// CanPost returns true if a user with the role in the topic may post in it. The role is nil if the user has none.
+// Admins may always post.
+func (ts *TopicSettings) CanPost(user *User, role *TopicRole) bool {
+	switch {
+	case user.IsAdmin || ts.WhoCanPost == TopicPostersEveryone:
+		return true
+	case ts.WhoCanPost == TopicPostersMembers:
+		return role != nil
+	default:
+		return role != nil && role.IsModerator()
+	}
+}
+
+// CanCreateTags returns true if a user with the role in the topic may create tags in it. The role is nil if the user
+// has none. Admins and moderators may always create tags.
+func (ts *TopicSettings) CanCreateTags(user *User, role *TopicRole) bool {
+	switch {
+	case user.IsAdmin || (role != nil && role.IsModerator()):
+		return true
+	default:
+		return ts.StudentsCanCreateTags && role != nil && role.Role == TopicRoleStudent
+	}
+}
+
+// TopicSettingsModel handles getting and saving topics' settings.
+type TopicSettingsModel struct {
+	Base
+}
+
+// NewTopicSettingsModel returns a new topic settings model.
+func NewTopicSettingsModel(db *sqlx.DB) *TopicSettingsModel {
+	return &TopicSettingsModel{Base{db}}
+}
+
+var (
+	// ErrInvalidTopicSettings is returned when saving invalid settings.
+	ErrInvalidTopicSettings = InputError{"Who can post must be everyone, members or instructors and sort top or new"}
+)
+
+// Get gets the topic's settings, the defaults if it has none saved.
+func (tsm *TopicSettingsModel) Get(tx *sqlx.Tx, topic *Topic) (*TopicSettings, error) {
+	settings := new(TopicSettings)
+	err := tsm.get(tx, settings, "SELECT * FROM topic_settings WHERE topic_id=?", topic.ID)
+	if err == sql.ErrNoRows {
+		return DefaultTopicSettings(topic.ID), nil
+	}
+	return settings, errors.Wrap(err, "get error")
+}
+
+// Save saves the topic's settings, replacing any it had.
+func (tsm *TopicSettingsModel) Save(tx *sqlx.Tx, settings *TopicSettings) error {
+	if !settings.IsValid() {
+		return ErrInvalidTopicSettings
+	}
+
+	_, err := tsm.exec(tx, `INSERT OR REPLACE INTO topic_settings(topic_id, who_can_post, allow_anonymous,
+		students_can_create_tags, default_sort, require_tag) VALUES(?, ?, ?, ?, ?, ?)`,
+		settings.TopicID, settings.WhoCanPost, settings.AllowAnonymous, settings.StudentsCanCreateTags,
+		settings.DefaultSort, settings.RequireTag)
+	return errors.Wrap(err, "exec error")
+}
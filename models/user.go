@@ -2,29 +2,91 @@ package models
 
 import (
 	"database/sql"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Masterminds/squirrel"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 )
 
+const (
+	minHandleLength = 3
+	maxHandleLength = 30
+
+	maxNameLength     = 50
+	maxBioLength      = 500
+	maxPronounsLength = 30
+)
+
+var (
+	handleRegex        = regexp.MustCompile(`^[a-z0-9]+(_[a-z0-9]+)*$`)
+	nonHandleCharRegex = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
 // User represents a user in the app.
 type User struct {
-	ID      int64
-	Email   string
-	Name    string
-	IsAdmin bool `db:"is_admin"`
+	ID        int64
+	Email     string
+	Handle    string
+	Name      string
+	Bio       string
+	Pronouns  string
+	AvatarKey string `db:"avatar_key"`
+	IsAdmin   bool   `db:"is_admin"`
+
+	SuspendedUntil   *time.Time `db:"suspended_until"`
+	IsBanned         bool       `db:"is_banned"`
+	SuspensionReason string     `db:"suspension_reason"`
+
+	CreatedAt time.Time `db:"created_at"`
 }
 
 // URL returns the unique URL for a user.
 func (u *User) URL() string {
-	return "/users/" + u.Email
+	return "/users/" + u.Handle
+}
+
+// AvatarURL returns the URL of the user's avatar or an empty string if the user has not uploaded one.
+func (u *User) AvatarURL() string {
+	if u.AvatarKey == "" {
+		return ""
+	}
+	return "/" + u.AvatarKey
+}
+
+// IsSuspended returns true if the user is currently suspended. Suspended users can read but not post or vote.
+func (u *User) IsSuspended() bool {
+	return u.SuspendedUntil != nil && u.SuspendedUntil.After(time.Now())
+}
+
+// IsRestricted returns true if the user is suspended or banned.
+func (u *User) IsRestricted() bool {
+	return u.IsBanned || u.IsSuspended()
+}
+
+// IsNewAccount returns true if the user signed up less than age ago.
+func (u *User) IsNewAccount(age time.Duration) bool {
+	return time.Since(u.CreatedAt) < age
 }
 
 // IsValid returns true if the user is valid else false.
 func (u *User) IsValid() bool {
-	return u.Email != "" && u.Name != ""
+	return u.Email != "" && u.Name != "" && IsValidHandle(u.Handle)
+}
+
+// IsValidProfile returns true if the user's editable profile fields are valid else false.
+func (u *User) IsValidProfile() bool {
+	name := strings.TrimSpace(u.Name)
+	return name != "" && len(name) <= maxNameLength && len(u.Bio) <= maxBioLength && len(u.Pronouns) <= maxPronounsLength
+}
+
+// IsValidHandle returns true if handle can be used as a user's public handle else false.
+// A handle is lower case alphanumeric words separated by single underscores.
+func IsValidHandle(handle string) bool {
+	return len(handle) >= minHandleLength && len(handle) <= maxHandleLength && handleRegex.MatchString(handle)
 }
 
 // UserModel handles getting and creating users.
@@ -39,7 +101,16 @@ func NewUserModel(db *sqlx.DB) *UserModel {
 
 var (
 	// ErrInvalidUser is returned when adding or updating an invalid user
-	ErrInvalidUser = InputError{"empty email and/or name"}
+	ErrInvalidUser = InputError{"empty email and/or name or invalid handle"}
+
+	// ErrInvalidHandle is returned when a handle does not meet the handle requirements.
+	ErrInvalidHandle = InputError{"Handles must be 3 to 30 lower case letters, numbers or single underscores between words"}
+
+	// ErrHandleTaken is returned when a handle is already in use by another user.
+	ErrHandleTaken = InputError{"Handle is already taken"}
+
+	// ErrInvalidProfile is returned when updating a user with an invalid profile.
+	ErrInvalidProfile = InputError{"Name must be 1 to 50 characters, bio at most 500 and pronouns at most 30"}
 
 	usersBuilder = squirrel.Select("* FROM users")
 )
@@ -76,13 +147,14 @@ func (um *UserModel) FindOne(tx *sqlx.Tx, wheres ...squirrel.Sqlizer) (*User, er
 
 // Add adds a new user.
 func (um *UserModel) Add(tx *sqlx.Tx, user *User) error {
+	user.Handle = strings.ToLower(user.Handle)
 	if !user.IsValid() {
 		return ErrInvalidUser
 	}
 
 	user.Email = strings.ToLower(user.Email)
 	user.Name = strings.Title(user.Name)
-	result, err := um.exec(tx, "INSERT INTO users(email, name) VALUES(?, ?)", user.Email, user.Name)
+	result, err := um.exec(tx, "INSERT INTO users(email, handle, name) VALUES(?, ?, ?)", user.Email, user.Handle, user.Name)
 	if err != nil {
 		return errors.Wrap(err, "exec error")
 	}
@@ -100,3 +172,95 @@ func (um *UserModel) Add(tx *sqlx.Tx, user *User) error {
 	*user = *u
 	return nil
 }
+
+// Update updates the user's profile (name, bio, pronouns and avatar).
+func (um *UserModel) Update(tx *sqlx.Tx, user *User) error {
+	user.Name = strings.TrimSpace(user.Name)
+	user.Bio = strings.TrimSpace(user.Bio)
+	user.Pronouns = strings.TrimSpace(user.Pronouns)
+	if user.ID < 1 || !user.IsValidProfile() {
+		return ErrInvalidProfile
+	}
+
+	_, err := um.exec(tx, "UPDATE users SET name=?, bio=?, pronouns=?, avatar_key=? WHERE id=?",
+		user.Name, user.Bio, user.Pronouns, user.AvatarKey, user.ID)
+	if err != nil {
+		return errors.Wrap(err, "exec error")
+	}
+
+	u, err := um.FindOne(tx, squirrel.Eq{"users.id": user.ID})
+	if err != nil {
+		return errors.Wrap(err, "find one error")
+	}
+
+	*user = *u
+	return nil
+}
+
+// UpdateSuspension updates whether the user is suspended or banned and why.
+func (um *UserModel) UpdateSuspension(tx *sqlx.Tx, user *User) error {
+	_, err := um.exec(tx, "UPDATE users SET suspended_until=?, is_banned=?, suspension_reason=? WHERE id=?",
+		user.SuspendedUntil, user.IsBanned, user.SuspensionReason, user.ID)
+	return errors.Wrap(err, "exec error")
+}
+
+// UpdateAdmin sets whether the user is an admin.
+func (um *UserModel) UpdateAdmin(tx *sqlx.Tx, user *User) error {
+	_, err := um.exec(tx, "UPDATE users SET is_admin=? WHERE id=?", user.IsAdmin, user.ID)
+	return errors.Wrap(err, "exec error")
+}
+
+// UpdateHandle changes the user's handle.
+func (um *UserModel) UpdateHandle(tx *sqlx.Tx, user *User, handle string) error {
+	handle = strings.ToLower(handle)
+	if !IsValidHandle(handle) {
+		return ErrInvalidHandle
+	}
+
+	taken, err := um.isHandleTaken(tx, handle, user.ID)
+	if err != nil {
+		return errors.Wrap(err, "is handle taken error")
+	}
+	if taken {
+		return ErrHandleTaken
+	}
+
+	if _, err = um.exec(tx, "UPDATE users SET handle=? WHERE id=?", handle, user.ID); err != nil {
+		return errors.Wrap(err, "exec error")
+	}
+
+	user.Handle = handle
+	return nil
+}
+
+// SuggestHandle returns an unused handle derived from name (e.g. an OAuth2 nickname). If the derived handle is taken, a
+// number is appended to it.
+func (um *UserModel) SuggestHandle(tx *sqlx.Tx, name string) (string, error) {
+	base := nonHandleCharRegex.ReplaceAllString(strings.ToLower(name), "_")
+	base = strings.Trim(base, "_")
+	if len(base) > maxHandleLength-4 { // leave room for a numeric suffix
+		base = strings.TrimRight(base[:maxHandleLength-4], "_")
+	}
+	if len(base) < minHandleLength {
+		base = "user"
+	}
+
+	handle := base
+	for i := 2; ; i++ {
+		taken, err := um.isHandleTaken(tx, handle, 0)
+		if err != nil {
+			return "", errors.Wrap(err, "is handle taken error")
+		}
+		if !taken {
+			return handle, nil
+		}
+		handle = base + "_" + strconv.Itoa(i)
+	}
+}
+
+// isHandleTaken returns true if a user other than the one with excludeUserID has the handle.
+func (um *UserModel) isHandleTaken(tx *sqlx.Tx, handle string, excludeUserID int64) (bool, error) {
+	var count int
+	err := um.get(tx, &count, "SELECT count(*) FROM users WHERE handle=? AND id!=?", handle, excludeUserID)
+	return count > 0, errors.Wrap(err, "get error")
+}
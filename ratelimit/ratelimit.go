@@ -0,0 +1,137 @@
+// Package ratelimit provides in memory token bucket rate limiting.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often buckets that have refilled are removed so idle clients don't use memory forever.
+const sweepInterval = 10 * time.Minute
+
+// Limit is a token bucket. A client can make Burst requests at once and then PerMinute requests a minute after that.
+// A limit with a PerMinute of 0 is unlimited.
+type Limit struct {
+	PerMinute float64
+	Burst     int
+}
+
+// IsUnlimited returns true if the limit does not restrict requests.
+func (l Limit) IsUnlimited() bool {
+	return l.PerMinute <= 0
+}
+
+// interval is how long it takes for one token to be added to the bucket.
+func (l Limit) interval() time.Duration {
+	return time.Duration(float64(time.Minute) / l.PerMinute)
+}
+
+// LimitError is returned when a client has no tokens left.
+type LimitError struct {
+	Wait time.Duration
+}
+
+// Error returns the message shown to the limited client.
+func (le LimitError) Error() string {
+	return fmt.Sprintf("Too many requests, try again in %d seconds", le.retryAfterSeconds())
+}
+
+// RetryAfter returns how long the client should wait before trying again.
+func (le LimitError) RetryAfter() time.Duration {
+	return time.Duration(le.retryAfterSeconds()) * time.Second
+}
+
+func (le LimitError) retryAfterSeconds() int {
+	return int(math.Ceil(le.Wait.Seconds()))
+}
+
+type bucket struct {
+	limit   Limit
+	tokens  float64
+	updated time.Time
+}
+
+// refill adds the tokens earned since the bucket was last updated.
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.updated).Minutes()*b.limit.PerMinute)
+	b.updated = now
+}
+
+// Limiter tracks a token bucket for each key. It is safe for concurrent use.
+type Limiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// New returns a new limiter.
+func New() *Limiter {
+	return &Limiter{buckets: make(map[string]*bucket), lastSweep: time.Now(), now: time.Now}
+}
+
+// Allow takes a token from the key's bucket. It returns a LimitError if the bucket is empty. The bucket is created full
+// and its limit is changed if a different limit is passed (e.g. a new account becoming old enough for normal limits).
+func (l *Limiter) Allow(key string, limit Limit) error {
+	return l.AllowAll(map[string]Limit{key: limit})
+}
+
+// AllowAll takes a token from the bucket of each key with its limit, but only if all of them have a token so a request
+// refused by one bucket does not use up the others. It returns a LimitError with the longest wait if any bucket is
+// empty. Buckets are created and updated like in Allow.
+func (l *Limiter) AllowAll(limits map[string]Limit) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	var buckets []*bucket
+	var wait time.Duration
+	for key, limit := range limits {
+		if limit.IsUnlimited() {
+			continue
+		}
+
+		b, ok := l.buckets[key]
+		if !ok {
+			b = &bucket{limit: limit, tokens: float64(limit.Burst), updated: now}
+			l.buckets[key] = b
+		}
+		b.limit = limit
+		b.refill(now)
+
+		if b.tokens < 1 {
+			if w := time.Duration((1 - b.tokens) * float64(limit.interval())); w > wait {
+				wait = w
+			}
+		}
+		buckets = append(buckets, b)
+	}
+
+	if wait > 0 {
+		return LimitError{wait}
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return nil
+}
+
+// sweep removes the buckets that are full since they behave the same as new buckets.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
@@ -0,0 +1,161 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock for the limiter that only moves when the test advances it.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestLimiter() (*Limiter, *fakeClock) {
+	clock := &fakeClock{time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := New()
+	l.now = clock.Now
+	l.lastSweep = clock.Now()
+	return l, clock
+}
+
+func TestAllowDeniesAfterBurst(t *testing.T) {
+	l, _ := newTestLimiter()
+	limit := Limit{PerMinute: 6, Burst: 3}
+
+	for i := 0; i < limit.Burst; i++ {
+		if err := l.Allow("key", limit); err != nil {
+			t.Fatalf("Allow() #%d error = %v, want nil", i+1, err)
+		}
+	}
+
+	err := l.Allow("key", limit)
+	limitErr, ok := err.(LimitError)
+	if !ok {
+		t.Fatalf("Allow() after burst error = %v, want a LimitError", err)
+	}
+
+	// one token is added every 10 seconds
+	if limitErr.RetryAfter() != 10*time.Second {
+		t.Errorf("RetryAfter() = %v, want %v", limitErr.RetryAfter(), 10*time.Second)
+	}
+
+	if err = l.Allow("other", limit); err != nil {
+		t.Errorf("Allow() with another key error = %v, want nil", err)
+	}
+}
+
+func TestAllowRefills(t *testing.T) {
+	l, clock := newTestLimiter()
+	limit := Limit{PerMinute: 6, Burst: 2}
+
+	l.Allow("key", limit)
+	l.Allow("key", limit)
+
+	clock.Advance(4 * time.Second)
+	err := l.Allow("key", limit)
+	limitErr, ok := err.(LimitError)
+	if !ok {
+		t.Fatalf("Allow() before a token is added error = %v, want a LimitError", err)
+	}
+
+	// part of a token has been added, the wait is rounded up to whole seconds
+	if limitErr.RetryAfter() != 6*time.Second {
+		t.Errorf("RetryAfter() = %v, want %v", limitErr.RetryAfter(), 6*time.Second)
+	}
+
+	clock.Advance(6 * time.Second)
+	if err = l.Allow("key", limit); err != nil {
+		t.Errorf("Allow() after a token is added error = %v, want nil", err)
+	}
+
+	// the bucket never holds more than the burst however long it is idle
+	clock.Advance(time.Hour)
+	for i := 0; i < limit.Burst; i++ {
+		if err = l.Allow("key", limit); err != nil {
+			t.Fatalf("Allow() #%d after refill error = %v, want nil", i+1, err)
+		}
+	}
+	if err = l.Allow("key", limit); err == nil {
+		t.Error("Allow() after refilled burst error = nil, want a LimitError")
+	}
+}
+
+func TestAllowUnlimited(t *testing.T) {
+	l, _ := newTestLimiter()
+	for i := 0; i < 100; i++ {
+		if err := l.Allow("key", Limit{}); err != nil {
+			t.Fatalf("Allow() #%d error = %v, want nil", i+1, err)
+		}
+	}
+}
+
+func TestAllowAllOnlySpendsWhenAllowed(t *testing.T) {
+	l, _ := newTestLimiter()
+	ip := Limit{PerMinute: 60, Burst: 10}
+	user := Limit{PerMinute: 1, Burst: 1}
+
+	if err := l.AllowAll(map[string]Limit{"ip": ip, "user": user}); err != nil {
+		t.Fatalf("AllowAll() error = %v, want nil", err)
+	}
+
+	// the user bucket is empty so these are refused without using the ip's tokens
+	for i := 0; i < 20; i++ {
+		if err := l.AllowAll(map[string]Limit{"ip": ip, "user": user}); err == nil {
+			t.Fatalf("AllowAll() #%d with an empty user bucket error = nil, want a LimitError", i+1)
+		}
+	}
+
+	for i := 1; i < ip.Burst; i++ {
+		if err := l.Allow("ip", ip); err != nil {
+			t.Fatalf("Allow() of ip #%d error = %v, want nil", i, err)
+		}
+	}
+}
+
+func TestAllowAllReturnsLongestWait(t *testing.T) {
+	l, _ := newTestLimiter()
+	fast := Limit{PerMinute: 60, Burst: 1}
+	slow := Limit{PerMinute: 2, Burst: 1}
+	l.AllowAll(map[string]Limit{"fast": fast, "slow": slow})
+
+	err := l.AllowAll(map[string]Limit{"fast": fast, "slow": slow})
+	limitErr, ok := err.(LimitError)
+	if !ok {
+		t.Fatalf("AllowAll() error = %v, want a LimitError", err)
+	}
+	if limitErr.RetryAfter() != 30*time.Second {
+		t.Errorf("RetryAfter() = %v, want %v", limitErr.RetryAfter(), 30*time.Second)
+	}
+}
+
+func TestSweepRemovesFullBuckets(t *testing.T) {
+	l, clock := newTestLimiter()
+	limit := Limit{PerMinute: 1, Burst: 2}
+
+	l.Allow("idle", limit)
+	clock.Advance(sweepInterval - time.Minute)
+	l.Allow("busy", limit)
+	l.Allow("busy", limit)
+
+	// idle has refilled, busy has only earned one of its two tokens back
+	clock.Advance(time.Minute)
+	l.Allow("other", limit)
+
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("sweep kept a full bucket")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Error("sweep removed a bucket that isn't full")
+	}
+	if !l.lastSweep.Equal(clock.Now()) {
+		t.Errorf("lastSweep = %v, want %v", l.lastSweep, clock.Now())
+	}
+}
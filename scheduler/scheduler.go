@@ -0,0 +1,119 @@
+// Package scheduler runs the app's background jobs, like announcing scheduled posts when they are published.
+package scheduler
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/BrianHarringtonUTSC/uTeach/models"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// PublishListener is called with each scheduled post once it is published.
+type PublishListener func(post *models.Post)
+
+// Job is run on every check, e.g. to clean up expired rows.
+type Job func() error
+
+// Scheduler periodically checks for scheduled posts that have been published and passes them to the publish
+// listeners, then runs its jobs. Each post is only announced once, even across restarts.
+type Scheduler struct {
+	db        *sqlx.DB
+	interval  time.Duration
+	mu        sync.Mutex
+	listeners []PublishListener
+	jobs      []Job
+	stop      chan struct{}
+}
+
+// New returns a scheduler that checks for published posts every interval. It does nothing until it is started.
+func New(db *sqlx.DB, interval time.Duration) *Scheduler {
+	return &Scheduler{db: db, interval: interval}
+}
+
+// OnPublish adds a listener for published posts.
+func (s *Scheduler) OnPublish(listener PublishListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, listener)
+}
+
+// OnTick adds a job that is run on every check.
+func (s *Scheduler) OnTick(job Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, job)
+}
+
+// Start runs the scheduler in the background until Stop is called.
+func (s *Scheduler) Start() {
+	s.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			if err := s.PublishDue(); err != nil {
+				log.Printf("%+v\n", errors.Wrap(err, "publish due error"))
+			}
+			s.runJobs()
+
+			select {
+			case <-ticker.C:
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the scheduler.
+func (s *Scheduler) Stop() {
+	close(s.stop)
+}
+
+// runJobs runs the jobs, logging their errors so one failing job doesn't stop the others.
+func (s *Scheduler) runJobs() {
+	s.mu.Lock()
+	jobs := s.jobs
+	s.mu.Unlock()
+
+	for _, job := range jobs {
+		if err := job(); err != nil {
+			log.Printf("%+v\n", errors.Wrap(err, "job error"))
+		}
+	}
+}
+
+// PublishDue announces the scheduled posts published since the last check to the listeners.
+func (s *Scheduler) PublishDue() (err error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin transaction error")
+	}
+
+	pm := models.NewPostModel(s.db)
+	posts, err := pm.FindDuePublications(tx)
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "find due publications error")
+	}
+
+	// the posts are marked as announced before the listeners run so a failing listener can't announce a post twice
+	if err = tx.Commit(); err != nil {
+		return errors.Wrap(err, "commit error")
+	}
+
+	s.mu.Lock()
+	listeners := s.listeners
+	s.mu.Unlock()
+
+	for _, post := range posts {
+		for _, listener := range listeners {
+			listener(post)
+		}
+	}
+	return nil
+}
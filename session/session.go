@@ -8,8 +8,9 @@ import (
 )
 
 const (
-	userSessionName = "user-session"
-	userIDKey       = "user-id"
+	userSessionName    = "user-session"
+	userIDKey          = "user-id"
+	impersonationIDKey = "impersonation-id"
 )
 
 // UserSession handles getting and storing user specific properties in a session.
@@ -28,7 +29,7 @@ func (us *UserSession) get(r *http.Request) (*sessions.Session, error) {
 }
 
 // SaveSessionUserID saves the user id in the session. Creates a new session if there was non existing, or overwrites
-// if it already exists.
+// if it already exists. The session gets a new token if the user changes.
 func (us *UserSession) SaveSessionUserID(w http.ResponseWriter, r *http.Request, id int64) error {
 	session, err := us.get(r)
 	if err != nil {
@@ -57,6 +58,50 @@ func (us *UserSession) SessionUserID(r *http.Request) (int64, bool) {
 	return id, ok
 }
 
+// SaveImpersonationID saves the id of the impersonation the admin in the session has started.
+func (us *UserSession) SaveImpersonationID(w http.ResponseWriter, r *http.Request, id int64) error {
+	session, err := us.get(r)
+	if err != nil {
+		return err
+	}
+
+	session.Values[impersonationIDKey] = id
+	return session.Save(r, w)
+}
+
+// ImpersonationID gets the id of the impersonation stored in the user session.
+// The second return value is a boolean which is true if there is an impersonation id in the session, else false.
+func (us *UserSession) ImpersonationID(r *http.Request) (int64, bool) {
+	session, err := us.get(r)
+	if err != nil {
+		return -1, false
+	}
+
+	id, ok := session.Values[impersonationIDKey].(int64)
+	return id, ok
+}
+
+// DeleteImpersonationID removes the impersonation from the session so the admin acts as themselves again.
+func (us *UserSession) DeleteImpersonationID(w http.ResponseWriter, r *http.Request) error {
+	session, err := us.get(r)
+	if err != nil {
+		return err
+	}
+
+	delete(session.Values, impersonationIDKey)
+	return session.Save(r, w)
+}
+
+// Token gets the token identifying the server side session of the request. The second return value is false if the
+// request does not have a saved session.
+func (us *UserSession) Token(r *http.Request) (string, bool) {
+	session, err := us.get(r)
+	if err != nil || session.IsNew {
+		return "", false
+	}
+	return session.ID, true
+}
+
 // Delete deletes the user session.
 func (us *UserSession) Delete(w http.ResponseWriter, r *http.Request) error {
 	session, err := us.get(r)
@@ -64,6 +109,7 @@ func (us *UserSession) Delete(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 	delete(session.Values, userIDKey)
+	delete(session.Values, impersonationIDKey)
 	session.Options.MaxAge = -1
 	return session.Save(r, w)
 }
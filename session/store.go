@@ -0,0 +1,208 @@
+package session
+
+import (
+	"database/sql"
+	"encoding/base32"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/BrianHarringtonUTSC/uTeach/models"
+	"github.com/Masterminds/squirrel"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// lastSeenResolution is how stale a session's last seen time may get before it is written again. It stops every
+// request from writing to the db.
+const lastSeenResolution = time.Minute
+
+// DBStore is a sessions.Store that keeps sessions in the db. The cookie only holds a signed and encrypted session token
+// so sessions can be listed and revoked server side.
+// Sessions expire after IdleTimeout without any requests or AbsoluteTimeout after they were created, whichever is first.
+type DBStore struct {
+	Codecs          []securecookie.Codec
+	Options         *sessions.Options // default configuration
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+	db              *sqlx.DB
+}
+
+// NewDBStore returns a new DBStore. keyPairs are used to sign and encrypt the cookie and session data, see
+// sessions.NewCookieStore for details.
+func NewDBStore(db *sqlx.DB, idleTimeout, absoluteTimeout time.Duration, keyPairs ...[]byte) *DBStore {
+	s := &DBStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   int(absoluteTimeout.Seconds()),
+			HttpOnly: true,
+		},
+		IdleTimeout:     idleTimeout,
+		AbsoluteTimeout: absoluteTimeout,
+		db:              db,
+	}
+
+	for _, codec := range s.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(s.Options.MaxAge)
+		}
+	}
+	return s
+}
+
+// IsExpired returns true if the session has passed its idle or absolute timeout.
+func (s *DBStore) IsExpired(session *models.Session) bool {
+	now := time.Now()
+	return now.Sub(session.LastSeenAt) > s.IdleTimeout || now.Sub(session.CreatedAt) > s.AbsoluteTimeout
+}
+
+// DeleteExpired removes all sessions that have passed their idle or absolute timeout.
+func (s *DBStore) DeleteExpired() error {
+	now := time.Now().UTC()
+	sm := models.NewSessionModel(s.db)
+	err := sm.Delete(nil, squirrel.Or{
+		squirrel.Lt{"sessions.last_seen_at": now.Add(-s.IdleTimeout)},
+		squirrel.Lt{"sessions.created_at": now.Add(-s.AbsoluteTimeout)},
+	})
+	return errors.Wrap(err, "delete error")
+}
+
+// Get returns a session for the given name after adding it to the registry.
+func (s *DBStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry. If the request has a cookie for an
+// unexpired session, its values are loaded.
+func (s *DBStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	// cookies that can't be decoded (e.g. signed with old keys) are treated as if there was no session
+	var token string
+	if err = securecookie.DecodeMulti(name, c.Value, &token, s.Codecs...); err != nil {
+		return session, nil
+	}
+
+	sm := models.NewSessionModel(s.db)
+	row, err := sm.FindOne(nil, squirrel.Eq{"sessions.token": token})
+	switch {
+	case err == sql.ErrNoRows:
+		// session was revoked or expired and cleaned up, a new one will be created on save
+		return session, nil
+	case err != nil:
+		return session, errors.Wrap(err, "find one error")
+	}
+
+	if s.IsExpired(row) {
+		return session, errors.Wrap(sm.Delete(nil, squirrel.Eq{"sessions.id": row.ID}), "delete error")
+	}
+
+	if err = securecookie.DecodeMulti(name, row.Data, &session.Values, s.Codecs...); err != nil {
+		return session, err
+	}
+	session.ID = token
+	session.IsNew = false
+
+	if time.Since(row.LastSeenAt) > lastSeenResolution {
+		row.LastSeenAt = time.Now().UTC()
+		row.UserAgent = r.UserAgent()
+		row.IPAddress = RemoteIP(r)
+		if err = sm.Update(nil, row); err != nil {
+			return session, errors.Wrap(err, "update error")
+		}
+	}
+
+	return session, nil
+}
+
+// Save writes the session to the db and sets the cookie. A session with a negative MaxAge is deleted.
+func (s *DBStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	sm := models.NewSessionModel(s.db)
+
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := sm.Delete(nil, squirrel.Eq{"sessions.token": session.ID}); err != nil {
+				return errors.Wrap(err, "delete error")
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	data, err := securecookie.EncodeMulti(session.Name(), session.Values, s.Codecs...)
+	if err != nil {
+		return err
+	}
+
+	row := &models.Session{
+		Token:      session.ID,
+		Data:       data,
+		LastSeenAt: time.Now().UTC(),
+		UserAgent:  r.UserAgent(),
+		IPAddress:  RemoteIP(r),
+	}
+	if userID, ok := session.Values[userIDKey].(int64); ok {
+		row.UserID = sql.NullInt64{Int64: userID, Valid: true}
+	}
+
+	existing, err := sm.FindOne(nil, squirrel.Eq{"sessions.token": session.ID})
+	switch {
+	case err == sql.ErrNoRows || session.ID == "":
+		if err = s.add(sm, session, row); err != nil {
+			return err
+		}
+	case err != nil:
+		return errors.Wrap(err, "find one error")
+	case existing.UserID != row.UserID:
+		// the token is replaced when the user changes (e.g. on login) so a token known before can't be fixated on them
+		if err = sm.Delete(nil, squirrel.Eq{"sessions.id": existing.ID}); err != nil {
+			return errors.Wrap(err, "delete error")
+		}
+		if err = s.add(sm, session, row); err != nil {
+			return err
+		}
+	default:
+		row.ID = existing.ID
+		if err = sm.Update(nil, row); err != nil {
+			return errors.Wrap(err, "update error")
+		}
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// add writes the session to the db under a new random token.
+func (s *DBStore) add(sm *models.SessionModel, session *sessions.Session, row *models.Session) error {
+	row.Token = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	if err := sm.Add(nil, row); err != nil {
+		return errors.Wrap(err, "add error")
+	}
+	session.ID = row.Token
+	return nil
+}
+
+// RemoteIP returns the IP address of the client that made the request.
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -1,15 +1,47 @@
 CREATE TABLE IF NOT EXISTS users(
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
 	email TEXT NOT NULL UNIQUE,
+	handle TEXT NOT NULL UNIQUE,
 	name TEXT NOT NULL,
-	is_admin BOOLEAN DEFAULT 0 NOT NULL
+	bio TEXT DEFAULT '' NOT NULL,
+	pronouns TEXT DEFAULT '' NOT NULL,
+	avatar_key TEXT DEFAULT '' NOT NULL,
+	is_admin BOOLEAN DEFAULT 0 NOT NULL,
+	suspended_until TIMESTAMP,
+	is_banned BOOLEAN DEFAULT 0 NOT NULL,
+	suspension_reason TEXT DEFAULT '' NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL
 );
 
 CREATE TABLE IF NOT EXISTS topics(
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
 	name TEXT NOT NULL UNIQUE,
 	title TEXT NOT NULL,
-	description TEXT NOT NULL
+	description TEXT NOT NULL,
+	approve_first_posts INTEGER DEFAULT 0 NOT NULL, -- a user's first this many posts need a moderator's approval
+	is_archived INTEGER DEFAULT 0 NOT NULL, -- archived topics are read only
+	parent_topic_id INTEGER, -- set for sections of a course, whose names are the parent's name/the section's name
+	FOREIGN KEY(parent_topic_id) REFERENCES topics(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_topics_parent_topic_id ON topics(parent_topic_id);
+
+-- topics without settings use the defaults
+CREATE TABLE IF NOT EXISTS topic_settings(
+	topic_id INTEGER PRIMARY KEY,
+	who_can_post TEXT DEFAULT 'everyone' NOT NULL, -- everyone, members or instructors
+	allow_anonymous BOOLEAN DEFAULT 0 NOT NULL,
+	students_can_create_tags BOOLEAN DEFAULT 0 NOT NULL,
+	default_sort TEXT DEFAULT 'top' NOT NULL, -- top or new
+	require_tag BOOLEAN DEFAULT 0 NOT NULL, -- new posts need a tag
+	FOREIGN KEY(topic_id) REFERENCES topics(id) ON DELETE CASCADE
+);
+
+-- old names of renamed topics so that links to them keep working
+CREATE TABLE IF NOT EXISTS topic_redirects(
+	old_name TEXT PRIMARY KEY,
+	topic_id INTEGER NOT NULL,
+	FOREIGN KEY(topic_id) REFERENCES topics(id) ON DELETE CASCADE
 );
 
 CREATE TABLE IF NOT EXISTS posts(
@@ -21,6 +53,13 @@ CREATE TABLE IF NOT EXISTS posts(
 	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
 	is_pinned BOOLEAN DEFAULT 0 NOT NULL,
 	is_visible BOOLEAN DEFAULT 1 NOT NULL,
+	hidden_by TEXT DEFAULT '' NOT NULL, -- creator, filter, reports or moderator for hidden posts
+	is_locked BOOLEAN DEFAULT 0 NOT NULL,
+	publish_at TIMESTAMP, -- hidden from listings until then if set
+	publish_announced BOOLEAN DEFAULT 0 NOT NULL, -- set once the scheduler has announced a scheduled post
+	pinned_until TIMESTAMP, -- is_pinned expires at this time if set
+	approval TEXT DEFAULT '' NOT NULL, -- pending, approved or rejected for posts that needed a moderator's approval
+	is_anonymous BOOLEAN DEFAULT 0 NOT NULL, -- the creator is only shown to moderators and themselves
 	UNIQUE(id, topic_id),
 	FOREIGN KEY(topic_id) REFERENCES topics(id) ON DELETE CASCADE,
 	FOREIGN KEY(creator_user_id) REFERENCES users(id) ON DELETE CASCADE
@@ -28,6 +67,43 @@ CREATE TABLE IF NOT EXISTS posts(
 
 CREATE INDEX IF NOT EXISTS idx_posts_topic_id ON posts(topic_id);
 
+-- custom fields of posts in a topic and its sections, e.g. an assignment number
+CREATE TABLE IF NOT EXISTS topic_fields(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	topic_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	label TEXT NOT NULL,
+	type TEXT NOT NULL, -- text, number or enum
+	options TEXT DEFAULT '' NOT NULL, -- comma separated choices of enum fields
+	is_required BOOLEAN DEFAULT 0 NOT NULL,
+	UNIQUE(name, topic_id),
+	FOREIGN KEY(topic_id) REFERENCES topics(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_topic_fields_topic_id ON topic_fields(topic_id);
+
+CREATE TABLE IF NOT EXISTS post_field_values(
+	post_id INTEGER NOT NULL,
+	field_id INTEGER NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY(post_id, field_id),
+	FOREIGN KEY(post_id) REFERENCES posts(id) ON DELETE CASCADE,
+	FOREIGN KEY(field_id) REFERENCES topic_fields(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_post_field_values_field_id ON post_field_values(field_id);
+
+-- posts that also appear in other topics than their own
+CREATE TABLE IF NOT EXISTS post_crossposts(
+	post_id INTEGER NOT NULL,
+	topic_id INTEGER NOT NULL,
+	PRIMARY KEY(post_id, topic_id),
+	FOREIGN KEY(post_id) REFERENCES posts(id) ON DELETE CASCADE,
+	FOREIGN KEY(topic_id) REFERENCES topics(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_post_crossposts_topic_id ON post_crossposts(topic_id);
+
 CREATE TABLE IF NOT EXISTS post_votes(
 	post_id INTEGER NOT NULL,
 	user_id TEXT  NOT NULL,
@@ -43,6 +119,8 @@ CREATE TABLE IF NOT EXISTS tags(
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
 	name TEXT NOT NULL,
 	topic_id INTEGER NOT NULL,
+	description TEXT DEFAULT '' NOT NULL,
+	color TEXT DEFAULT '' NOT NULL, -- hex color, e.g. #1e88e5, or empty for the default
 	UNIQUE(name, topic_id),
 	UNIQUE(id, topic_id),
 	FOREIGN KEY(topic_id) REFERENCES topics(id) ON DELETE CASCADE
@@ -53,11 +131,186 @@ CREATE INDEX IF NOT EXISTS idx_tags_topic_id ON tags(topic_id);
 CREATE TABLE IF NOT EXISTS post_tags(
 	post_id INTEGER NOT NULL,
 	tag_id INTEGER NOT NULL,
-	topic_id INTEGER NOT NULL,
+	topic_id INTEGER NOT NULL, -- the tag's topic, which is the post's topic or its parent for posts in sections
 	PRIMARY KEY (post_id, tag_id),
-	FOREIGN KEY(post_id, topic_id) REFERENCES posts(id, topic_id) ON DELETE CASCADE,
+	FOREIGN KEY(post_id) REFERENCES posts(id) ON DELETE CASCADE,
 	FOREIGN KEY(tag_id, topic_id) REFERENCES tags(id, topic_id) ON DELETE CASCADE
 );
 
 CREATE INDEX IF NOT EXISTS idx_post_tags_post_id ON post_tags(post_id);
 CREATE INDEX IF NOT EXISTS idx_post_tags_tag_id ON post_tags(tag_id);
+
+CREATE TABLE IF NOT EXISTS sessions(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	token TEXT NOT NULL UNIQUE,
+	user_id INTEGER,
+	data TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	user_agent TEXT DEFAULT '' NOT NULL,
+	ip_address TEXT DEFAULT '' NOT NULL,
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+
+CREATE TABLE IF NOT EXISTS user_suspensions(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	actor_user_id INTEGER NOT NULL,
+	action TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	suspended_until TIMESTAMP,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY(actor_user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_suspensions_user_id ON user_suspensions(user_id);
+
+CREATE TABLE IF NOT EXISTS impersonations(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	admin_user_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	allow_writes BOOLEAN DEFAULT 0 NOT NULL,
+	started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	ended_at TIMESTAMP,
+	FOREIGN KEY(admin_user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS topic_roles(
+	topic_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	role TEXT NOT NULL,
+	PRIMARY KEY(topic_id, user_id),
+	FOREIGN KEY(topic_id) REFERENCES topics(id) ON DELETE CASCADE,
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_topic_roles_user_id ON topic_roles(user_id);
+
+CREATE TABLE IF NOT EXISTS lti_states(
+	state TEXT PRIMARY KEY,
+	nonce TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS lti_contexts(
+	issuer TEXT NOT NULL,
+	context_id TEXT NOT NULL,
+	topic_id INTEGER NOT NULL,
+	grants_roles INTEGER DEFAULT 0 NOT NULL, -- the topic was created for the context, so roles from the platform apply in it
+	PRIMARY KEY(issuer, context_id),
+	FOREIGN KEY(topic_id) REFERENCES topics(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS lti_users(
+	issuer TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	user_id INTEGER NOT NULL,
+	PRIMARY KEY(issuer, subject),
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS reports(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	post_id INTEGER NOT NULL,
+	reporter_user_id INTEGER, -- NULL for reports made by the content filter
+	reason TEXT NOT NULL,
+	details TEXT DEFAULT '' NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	resolved_at TIMESTAMP,
+	resolver_user_id INTEGER,
+	resolution TEXT DEFAULT '' NOT NULL,
+	FOREIGN KEY(post_id) REFERENCES posts(id) ON DELETE CASCADE,
+	FOREIGN KEY(reporter_user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY(resolver_user_id) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_reports_post_id ON reports(post_id);
+
+-- audit_log is append only. It has no foreign keys so entries outlive the users and topics they mention.
+CREATE TABLE IF NOT EXISTS audit_log(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	actor_user_id INTEGER,
+	action TEXT NOT NULL,
+	topic_id INTEGER,
+	target_type TEXT NOT NULL,
+	target_id INTEGER NOT NULL,
+	details TEXT DEFAULT '' NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at);
+
+CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+BEGIN
+	SELECT RAISE(ABORT, 'audit_log is append only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+BEGIN
+	SELECT RAISE(ABORT, 'audit_log is append only');
+END;
+
+-- filter_rules with a NULL topic_id apply to every topic.
+CREATE TABLE IF NOT EXISTS filter_rules(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	topic_id INTEGER,
+	kind TEXT NOT NULL,
+	pattern TEXT NOT NULL,
+	action TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	FOREIGN KEY(topic_id) REFERENCES topics(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS notifications(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	message TEXT NOT NULL,
+	url TEXT DEFAULT '' NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	read_at TIMESTAMP,
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_notifications_user_id ON notifications(user_id);
+
+CREATE TABLE IF NOT EXISTS topic_subscriptions(
+	user_id INTEGER NOT NULL,
+	topic_id INTEGER NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	last_read_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL, -- posts after this are unread
+	PRIMARY KEY(user_id, topic_id),
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY(topic_id) REFERENCES topics(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_topic_subscriptions_topic_id ON topic_subscriptions(topic_id);
+
+-- posts with muted tags are left out of the user's feed and unread counts
+CREATE TABLE IF NOT EXISTS muted_tags(
+	user_id INTEGER NOT NULL,
+	tag_id INTEGER NOT NULL,
+	PRIMARY KEY(user_id, tag_id),
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY(tag_id) REFERENCES tags(id) ON DELETE CASCADE
+);
+
+-- files attached to posts. The file itself is in the app's storage at key.
+CREATE TABLE IF NOT EXISTS post_attachments(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	post_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL, -- the uploader, whose quota the file counts towards
+	key TEXT NOT NULL UNIQUE,
+	filename TEXT NOT NULL,
+	content_type TEXT NOT NULL, -- sniffed from the file's contents, not the client's claim
+	size INTEGER NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	FOREIGN KEY(post_id) REFERENCES posts(id) ON DELETE CASCADE,
+	FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_post_attachments_post_id ON post_attachments(post_id);
+CREATE INDEX IF NOT EXISTS idx_post_attachments_user_id ON post_attachments(user_id);
@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	s3Algorithm  = "AWS4-HMAC-SHA256"
+	s3Service    = "s3"
+	s3DateLayout = "20060102"
+	s3TimeLayout = "20060102T150405Z"
+)
+
+// S3Config is the location and credentials of an S3 compatible bucket.
+type S3Config struct {
+	Endpoint        string // e.g. https://s3.us-east-1.amazonaws.com or http://localhost:9000 for a local stand-in
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// S3 stores files in a bucket of an S3 compatible service, e.g. AWS S3 or MinIO. Requests use path style URLs
+// (endpoint/bucket/key) and are signed with AWS Signature Version 4.
+type S3 struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3 returns a storage for the bucket in the config.
+func NewS3(config S3Config) (*S3, error) {
+	endpoint, err := url.Parse(strings.TrimRight(config.Endpoint, "/"))
+	if err != nil {
+		return nil, errors.Wrap(err, "parse endpoint error")
+	}
+
+	if (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, errors.Errorf("invalid s3 endpoint %q", config.Endpoint)
+	}
+
+	if config.Region == "" || config.Bucket == "" || config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, errors.New("s3 storage needs a region, bucket, access key id and secret access key")
+	}
+
+	return &S3{config, endpoint, &http.Client{Timeout: time.Minute}}, nil
+}
+
+// Put stores the contents of r at key. The contents are read into memory first because the signature covers a hash
+// of them.
+func (s *S3) Put(key string, r io.Reader) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, "read error")
+	}
+
+	resp, err := s.do("PUT", key, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s.statusError(resp)
+	}
+	return nil
+}
+
+// Get opens the file at key.
+func (s *S3) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+	default:
+		defer resp.Body.Close()
+		return nil, s.statusError(resp)
+	}
+}
+
+// Delete removes the file at key.
+func (s *S3) Delete(key string) error {
+	resp, err := s.do("DELETE", key, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK &&
+		resp.StatusCode != http.StatusNotFound {
+		return s.statusError(resp)
+	}
+	return nil
+}
+
+// do sends a signed request for the key with the body.
+func (s *S3) do(method string, key string, body []byte) (*http.Response, error) {
+	if key == "" || strings.Contains(key, "..") {
+		return nil, ErrInvalidKey
+	}
+
+	// the path is escaped by hand because the signature must cover exactly the path that is sent
+	escapedPath := s.endpoint.EscapedPath() + "/" + s3Escape(s.config.Bucket) + "/" + s3Escape(key)
+	u := *s.endpoint
+	u.Path = s.endpoint.Path + "/" + s.config.Bucket + "/" + key
+	u.RawPath = escapedPath
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "new request error")
+	}
+
+	s.sign(req, escapedPath, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	return resp, errors.Wrap(err, "request error")
+}
+
+// sign adds the headers of an AWS Signature Version 4 signature to the request. See
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html.
+func (s *S3) sign(req *http.Request, escapedPath string, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeLayout))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		escapedPath,
+		"", // no query string
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + now.Format(s3TimeLayout),
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{now.Format(s3DateLayout), s.config.Region, s3Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{s3Algorithm, now.Format(s3TimeLayout), scope,
+		sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.config.SecretAccessKey), now.Format(s3DateLayout))
+	signingKey = hmacSHA256(signingKey, s.config.Region)
+	signingKey = hmacSHA256(signingKey, s3Service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", s3Algorithm,
+		s.config.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// statusError returns an error with the status and message of an unsuccessful response.
+func (s *S3) statusError(resp *http.Response) error {
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return errors.Errorf("s3 %s error: %s", resp.Status, bytes.TrimSpace(message))
+}
+
+// s3Escape percent encodes everything in the key except unreserved characters and slashes, as Signature Version 4
+// requires.
+func s3Escape(key string) string {
+	var escaped bytes.Buffer
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testBucket = "uteach"
+
+// s3StandIn is a local stand-in for an S3 compatible service that keeps objects in memory. Requests that are not
+// signed with its credentials are refused with the reason in the body, which S3 includes in its errors.
+type s3StandIn struct {
+	s3      *S3
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newTestS3(t *testing.T) (*S3, func()) {
+	standIn := &s3StandIn{objects: make(map[string][]byte)}
+	server := httptest.NewServer(standIn)
+
+	s, err := NewS3(S3Config{
+		Endpoint:        server.URL,
+		Region:          "us-east-1",
+		Bucket:          testBucket,
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "secret",
+	})
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+
+	// the stand-in keeps its own copy so tests can change the client's credentials
+	standIn.s3 = &S3{config: s.config, endpoint: s.endpoint, client: s.client}
+	return s, server.Close
+}
+
+func (s *s3StandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = s.checkSignature(r, body); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	prefix := "/" + testBucket + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, prefix)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case "PUT":
+		s.objects[key] = body
+	case "GET":
+		object, ok := s.objects[key]
+		if !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		w.Write(object)
+	case "DELETE":
+		// like S3, deleting a missing key succeeds
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// checkSignature checks the Signature Version 4 headers of the request, signing the request the server received again
+// to check the signature.
+func (s *s3StandIn) checkSignature(r *http.Request, body []byte) error {
+	date := r.Header.Get("X-Amz-Date")
+	now, err := time.Parse(s3TimeLayout, date)
+	if err != nil {
+		return fmt.Errorf("X-Amz-Date = %q, want a time like %s", date, s3TimeLayout)
+	}
+
+	if hash := r.Header.Get("X-Amz-Content-Sha256"); hash != sha256Hex(body) {
+		return fmt.Errorf("X-Amz-Content-Sha256 = %q, want %q", hash, sha256Hex(body))
+	}
+
+	auth := r.Header.Get("Authorization")
+	wantPrefix := s3Algorithm + " Credential=AKIDEXAMPLE/" + now.Format(s3DateLayout) + "/us-east-1/s3/aws4_request, " +
+		"SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature="
+	if !strings.HasPrefix(auth, wantPrefix) {
+		return fmt.Errorf("Authorization = %q, want prefix %q", auth, wantPrefix)
+	}
+
+	received, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	if err != nil {
+		return err
+	}
+
+	s.s3.sign(received, r.URL.EscapedPath(), body, now)
+	if want := received.Header.Get("Authorization"); auth != want {
+		return fmt.Errorf("Authorization = %q, want %q", auth, want)
+	}
+	return nil
+}
+
+func TestS3PutGetDelete(t *testing.T) {
+	s, cleanup := newTestS3(t)
+	defer cleanup()
+
+	// spaces and other reserved characters must be escaped the same way in the path and the signature
+	key := "attachments/1/lecture notes (v2).txt"
+	if err := s.Put(key, strings.NewReader("notes")); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	r, err := s.Get(key)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	contents, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(contents) != "notes" {
+		t.Errorf("Get() contents = %q, %v, want %q", contents, err, "notes")
+	}
+
+	if err = s.Delete(key); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err = s.Get(key); !os.IsNotExist(err) {
+		t.Errorf("Get() after Delete() error = %v, want not exist", err)
+	}
+}
+
+func TestS3GetMissingKey(t *testing.T) {
+	s, cleanup := newTestS3(t)
+	defer cleanup()
+
+	if _, err := s.Get("missing.txt"); !os.IsNotExist(err) {
+		t.Errorf("Get() error = %v, want not exist", err)
+	}
+}
+
+func TestS3DeleteMissingKey(t *testing.T) {
+	s, cleanup := newTestS3(t)
+	defer cleanup()
+
+	if err := s.Delete("missing.txt"); err != nil {
+		t.Errorf("Delete() error = %v, want nil", err)
+	}
+}
+
+func TestS3RejectsWrongSecret(t *testing.T) {
+	s, cleanup := newTestS3(t)
+	defer cleanup()
+
+	s.config.SecretAccessKey = "wrong"
+	if err := s.Put("notes.txt", strings.NewReader("notes")); err == nil {
+		t.Error("Put() with the wrong secret error = nil, want an error")
+	}
+}
+
+func TestS3RejectsInvalidKeys(t *testing.T) {
+	s, cleanup := newTestS3(t)
+	defer cleanup()
+
+	for _, key := range []string{"", "../x", "a/../../x"} {
+		if err := s.Put(key, strings.NewReader("x")); err != ErrInvalidKey {
+			t.Errorf("Put(%q) error = %v, want %v", key, err, ErrInvalidKey)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Package storage provides a common interface for storing uploaded files and its implementations.
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidKey is returned when a key is empty or would escape the storage's root.
+var ErrInvalidKey = errors.New("invalid storage key")
+
+// Storage stores and retrieves files by a slash separated key (e.g. "avatars/1-a3f2.png").
+type Storage interface {
+	// Put stores the contents of r at key, overwriting any existing file.
+	Put(key string, r io.Reader) error
+
+	// Get opens the file at key. The caller must close it. If there is no such file the error satisfies os.IsNotExist.
+	Get(key string) (io.ReadCloser, error)
+
+	// Delete removes the file at key. Deleting a key that does not exist is not an error.
+	Delete(key string) error
+}
+
+// Local stores files on the local filesystem under a root directory.
+type Local struct {
+	root string
+}
+
+// NewLocal returns a local storage rooted at root. The directory is created if it does not exist.
+func NewLocal(root string) (*Local, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, errors.Wrap(err, "mkdir error")
+	}
+	return &Local{root}, nil
+}
+
+// path converts the key to a path under the storage root.
+func (l *Local) path(key string) (string, error) {
+	cleaned := filepath.Clean("/" + key)
+	if key == "" || cleaned == "/" || strings.Contains(key, "..") {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(l.root, filepath.FromSlash(cleaned)), nil
+}
+
+// Put stores the contents of r at key. The file is written to a temporary file first so readers never see a partially
+// written file.
+func (l *Local) Put(key string, r io.Reader) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrap(err, "mkdir error")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return errors.Wrap(err, "create temp error")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "copy error")
+	}
+
+	if err = tmp.Close(); err != nil {
+		return errors.Wrap(err, "close error")
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), path), "rename error")
+}
+
+// Get opens the file at key.
+func (l *Local) Get(key string) (io.ReadCloser, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Delete removes the file at key.
+func (l *Local) Delete(key string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return errors.Wrap(err, "remove error")
+}
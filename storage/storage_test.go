@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTestLocal(t *testing.T) (*Local, func()) {
+	root, err := ioutil.TempDir("", "storage-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := NewLocal(root)
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	return l, func() { os.RemoveAll(root) }
+}
+
+func TestLocalPutGetDelete(t *testing.T) {
+	l, cleanup := newTestLocal(t)
+	defer cleanup()
+
+	key := "attachments/1/notes.txt"
+	if err := l.Put(key, strings.NewReader("first")); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if err := l.Put(key, strings.NewReader("second")); err != nil {
+		t.Fatalf("Put() overwrite error = %v", err)
+	}
+
+	r, err := l.Get(key)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	contents, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(contents) != "second" {
+		t.Errorf("Get() contents = %q, %v, want %q", contents, err, "second")
+	}
+
+	if err = l.Delete(key); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err = l.Get(key); !os.IsNotExist(err) {
+		t.Errorf("Get() after Delete() error = %v, want not exist", err)
+	}
+	if err = l.Delete(key); err != nil {
+		t.Errorf("Delete() of missing key error = %v, want nil", err)
+	}
+}
+
+func TestLocalRejectsInvalidKeys(t *testing.T) {
+	l, cleanup := newTestLocal(t)
+	defer cleanup()
+
+	for _, key := range []string{"", "/", "../x", "a/../../x", "a/.."} {
+		if err := l.Put(key, strings.NewReader("x")); err != ErrInvalidKey {
+			t.Errorf("Put(%q) error = %v, want %v", key, err, ErrInvalidKey)
+		}
+		if _, err := l.Get(key); err != ErrInvalidKey {
+			t.Errorf("Get(%q) error = %v, want %v", key, err, ErrInvalidKey)
+		}
+		if err := l.Delete(key); err != ErrInvalidKey {
+			t.Errorf("Delete(%q) error = %v, want %v", key, err, ErrInvalidKey)
+		}
+	}
+}